@@ -2,13 +2,15 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,14 +27,23 @@ const (
 	colorBold   = "\033[1m"
 )
 
+// Reconnecting after the connection drops
+const (
+	maxReconnectAttempts = 10
+	maxReconnectBackoff  = 30 * time.Second
+)
+
 // Message structure for communication
 type Message struct {
+	ID       uint64 `json:",omitempty"` // Unique, increasing message ID assigned by the server
 	Sender   string
 	RoomName string
 	Content  string
-	Type     string // "text", "file", "command", "file-request", "file-chunk"
+	Type     string // "text", "private", "file", "command", "file-request", "file-chunk", "file-aborted"
 	FileData []byte // Used for file transfer
 	FileName string // Used for file transfer
+	Target   string // Recipient username for private messages
+	Time     int64  `json:",omitempty"` // Unix milliseconds when the server accepted the message
 }
 
 // Add file transfer state tracking
@@ -46,18 +57,174 @@ type fileTransferState struct {
 	lastPercent float64
 }
 
+// incomingFile tracks a file being received from another user
+type incomingFile struct {
+	sender   string
+	fileName string
+	path     string
+	file     *os.File
+	received int64
+}
+
+// downloadTable holds the files offered to the user and those being
+// received. The reader goroutine records offers and receives the files, the
+// input goroutine accepts offers, which opens the file.
+type downloadTable struct {
+	mutex  sync.Mutex
+	offers map[string]string        // File offered most recently per sender
+	files  map[string]*incomingFile // Keyed by downloadKey
+	latest string                   // Sender of the latest offer
+}
+
+func newDownloadTable() *downloadTable {
+	return &downloadTable{offers: make(map[string]string), files: make(map[string]*incomingFile)}
+}
+
+// offer records that sender wants to send fileName, dropping an earlier
+// transfer of the same file
+func (d *downloadTable) offer(sender, fileName string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if old, ok := d.files[downloadKey(sender, fileName)]; ok {
+		old.abort()
+		delete(d.files, downloadKey(sender, fileName))
+	}
+	d.offers[sender] = fileName
+	d.latest = sender
+}
+
+// accept opens the file offered by sender, or by whoever offered one last
+// if sender is empty, and returns the sender
+func (d *downloadTable) accept(dir, sender string) (string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if sender == "" {
+		sender = d.latest
+	}
+	fileName, ok := d.offers[sender]
+	if !ok {
+		return sender, nil // Let the server answer
+	}
+	download, err := openDownload(dir, sender, fileName)
+	if err != nil {
+		return sender, err
+	}
+	delete(d.offers, sender)
+	d.files[downloadKey(sender, fileName)] = download
+	return sender, nil
+}
+
+// get returns the file being received under key
+func (d *downloadTable) get(key string) (*incomingFile, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	download, ok := d.files[key]
+	return download, ok
+}
+
+// take removes the file being received under key and returns it
+func (d *downloadTable) take(key string) (*incomingFile, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	download, ok := d.files[key]
+	delete(d.files, key)
+	return download, ok
+}
+
+// forget drops the offer of fileName by sender and removes the file if it
+// was accepted
+func (d *downloadTable) forget(sender, fileName string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.offers[sender] == fileName {
+		delete(d.offers, sender)
+	}
+	if download, ok := d.files[downloadKey(sender, fileName)]; ok {
+		download.abort()
+		delete(d.files, downloadKey(sender, fileName))
+	}
+}
+
+// abortAll forgets every offer and removes the files being received
+func (d *downloadTable) abortAll() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for key, download := range d.files {
+		download.abort()
+		delete(d.files, key)
+	}
+	d.offers = make(map[string]string)
+	d.latest = ""
+}
+
+// unreadCounts counts chat messages received in rooms other than the current
+// one. It is shared by the reader and input goroutines.
+type unreadCounts struct {
+	mutex  sync.Mutex
+	counts map[string]int
+}
+
+func newUnreadCounts() *unreadCounts {
+	return &unreadCounts{counts: make(map[string]int)}
+}
+
+func (u *unreadCounts) add(room string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.counts[room]++
+}
+
+func (u *unreadCounts) clear(room string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	delete(u.counts, room)
+}
+
+// String lists the rooms with unread messages, e.g. "dev 3, general 1"
+func (u *unreadCounts) String() string {
+	if u == nil {
+		return ""
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	rooms := make([]string, 0, len(u.counts))
+	for room, n := range u.counts {
+		rooms = append(rooms, fmt.Sprintf("%s %d", room, n))
+	}
+	sort.Strings(rooms)
+	return strings.Join(rooms, ", ")
+}
+
 func main() {
 	serverAddr := flag.String("server", "localhost:8080", "Server address in the form host:port")
+	downloadsDir := flag.String("downloads", "downloads", "Directory where received files are saved")
+	useTLS := flag.Bool("tls", false, "Connect using TLS")
+	caFile := flag.String("ca", "", "CA certificate used to verify the server (system roots if empty)")
+	insecure := flag.Bool("insecure", false, "Skip TLS certificate verification (development only)")
+	certFile := flag.String("cert", "", "Client certificate for mutual TLS")
+	keyFile := flag.String("key", "", "Client private key for mutual TLS")
+	autoReconnect := flag.Bool("reconnect", true, "Reconnect and resume the session when the connection drops")
 	flag.Parse()
 
 	// Connect to the server
-	conn, err := net.Dial("tcp", *serverAddr)
+	redial := func() (net.Conn, error) {
+		return dial(*serverAddr, *useTLS, *caFile, *insecure, *certFile, *keyFile)
+	}
+	rawConn, err := redial()
 	if err != nil {
 		fmt.Println("Error connecting to server:", err)
 		return
 	}
+	conn := newServerConn(rawConn)
 	defer conn.Close()
 
+	// Offer protocol v2, older servers simply ignore the hello frame
+	if err := conn.sendHello(); err != nil {
+		fmt.Println("Error sending handshake:", err)
+		return
+	}
+
 	clearScreen()
 	printBanner()
 	printHelp()
@@ -70,12 +237,58 @@ func main() {
 	// Keep track of current input and chat state
 	currentInput := ""
 	currentRoom := "general"
+	unread := newUnreadCounts() // Unread messages per room other than currentRoom
 	loggedIn := false
 	username := ""
+	lastDMSender := "" // Used by /r to reply to the last private message
 
 	// Add file transfer state
 	fileTransfer := fileTransferState{}
 
+	// Files offered and being received
+	downloads := newDownloadTable()
+
+	// Token to resume the session with and the newest chat message seen.
+	// Only touched by the reader goroutine.
+	sessionToken := ""
+	var lastSeenID uint64
+
+	// resume replaces a dropped connection and resumes the session on it,
+	// reporting false if the client should give up
+	resume := func() bool {
+		if !*autoReconnect || !loggedIn {
+			return false
+		}
+		conn.reconnecting.Store(true)
+		defer conn.reconnecting.Store(false)
+
+		// Transfers do not survive the connection
+		downloads.abortAll()
+		fileTransfer.active = false
+
+		newConn, err := reconnect(redial)
+		if err != nil {
+			fmt.Printf(colorRed+"Could not reconnect: %v\n"+colorReset, err)
+			return false
+		}
+		conn.swap(newConn)
+		if err := conn.sendHello(); err != nil {
+			fmt.Println(colorRed+"Error sending handshake:"+colorReset, err)
+			return false
+		}
+
+		if sessionToken == "" {
+			loggedIn = false
+			fmt.Println(colorYellow + "Reconnected, log in again with /login" + colorReset)
+			return true
+		}
+		if err := conn.sendLine(fmt.Sprintf("/resume %s %d", sessionToken, lastSeenID)); err != nil {
+			return false
+		}
+		fmt.Println(colorYellow + "Reconnected, resuming session..." + colorReset)
+		return true
+	}
+
 	// Start goroutine to read messages from the server
 	go func() {
 		defer func() {
@@ -97,23 +310,63 @@ func main() {
 			// Read raw message bytes with timeout
 			conn.SetReadDeadline(time.Now().Add(1 * time.Hour)) // 1 hour timeout
 
-			msgBytes, err := reader.ReadBytes('\n')
-			if err != nil {
-				if err == io.EOF || strings.Contains(err.Error(), "connection") {
-					fmt.Println("\n" + colorRed + "Server connection closed." + colorReset)
-				} else {
-					fmt.Printf("\n"+colorRed+"Error reading from server: %v\n"+colorReset, err)
+			var message Message
+			var err error
+
+			if isBinaryFrame(reader) {
+				// File chunks may arrive as binary frames between text lines
+				message, err = readFileFrame(reader)
+				if err != nil {
+					fmt.Printf("\n"+colorRed+"Error reading file data from server: %v\n"+colorReset, err)
+					if !resume() {
+						return
+					}
+					reader = bufio.NewReader(conn)
+					continue
+				}
+				conn.SetReadDeadline(time.Time{})
+			} else {
+				msgBytes, err := reader.ReadBytes('\n')
+				if err != nil {
+					if err == io.EOF || strings.Contains(err.Error(), "connection") {
+						fmt.Println("\n" + colorRed + "Server connection closed." + colorReset)
+					} else {
+						fmt.Printf("\n"+colorRed+"Error reading from server: %v\n"+colorReset, err)
+					}
+					if !resume() {
+						return
+					}
+					reader = bufio.NewReader(conn)
+					continue
+				}
+
+				// Reset read deadline after successful read
+				conn.SetReadDeadline(time.Time{})
+
+				var handshake bool
+				message, handshake, err = conn.decode(msgBytes)
+				if err != nil {
+					fmt.Printf("\n"+colorRed+"Error parsing message: %v\n"+colorReset, err) // Ensure newline if error
+					continue
+				}
+				if handshake {
+					continue
 				}
-				return
 			}
 
-			// Reset read deadline after successful read
-			conn.SetReadDeadline(time.Time{})
+			// Remember the newest chat message, a resumed session replays what came after it
+			isChat := message.Type == "text" && message.RoomName != "" && message.Sender != "Server"
+			if (isChat || message.Type == "history") && message.ID > lastSeenID {
+				lastSeenID = message.ID
+			}
 
-			var message Message
-			err = json.Unmarshal(msgBytes, &message)
-			if err != nil {
-				fmt.Printf("\n"+colorRed+"Error parsing message: %v\n"+colorReset, err) // Ensure newline if error
+			// Keep the session token, it is not for display
+			if message.Type == "session" {
+				sessionToken = message.Content
+				// Without a chat message seen yet, what follows the token is what to replay
+				if lastSeenID == 0 {
+					lastSeenID = message.ID
+				}
 				continue
 			}
 
@@ -127,21 +380,44 @@ func main() {
 
 			// Check for status messages that should update client state
 			if message.Type == "text" && message.Sender == "Server" {
+				if strings.HasPrefix(message.Content, "Session resumed") {
+					loggedIn = true
+				} else if strings.HasPrefix(message.Content, "Resume failed") {
+					loggedIn = false
+					sessionToken = ""
+					currentRoom = "general"
+				}
 				if strings.Contains(message.Content, "Login successful") ||
 					strings.Contains(message.Content, "Registered and logged in") {
 					loggedIn = true
+					// Logged in with a client certificate, the server tells us who we are
+					if strings.HasPrefix(message.Content, "Login successful! Authenticated as ") {
+						parts := strings.Fields(message.Content)
+						if len(parts) > 4 {
+							username = parts[4]
+						}
+					}
 					// Extract username from the login command that was sent
-					if currentInput != "" && strings.HasPrefix(currentInput, "/login") {
+					if strings.HasPrefix(currentInput, "/login") || strings.HasPrefix(currentInput, "/register") {
 						parts := strings.Fields(currentInput)
 						if len(parts) >= 2 {
 							username = parts[1]
 						}
 					}
-				} else if strings.HasPrefix(message.Content, "You have joined room:") {
+				} else if strings.HasPrefix(message.Content, "You have joined room:") ||
+					strings.HasPrefix(message.Content, "You have switched to room:") {
 					parts := strings.Fields(message.Content)
 					if len(parts) > 4 {
 						currentRoom = parts[len(parts)-1]
+						unread.clear(currentRoom)
 					}
+				} else if strings.HasPrefix(message.Content, "You have left room:") {
+					parts := strings.Fields(message.Content)
+					unread.clear(parts[len(parts)-1])
+				} else if strings.HasPrefix(message.Content, "You are not in any room") {
+					currentRoom = ""
+				} else if strings.HasPrefix(message.Content, "Room ") && strings.Contains(message.Content, " was deleted by ") {
+					unread.clear(strings.Fields(message.Content)[1])
 				}
 			}
 
@@ -160,8 +436,13 @@ func main() {
 					continue
 				}
 
-				// Format room messages nicely
-				if message.RoomName != "" && message.RoomName != "general" {
+				// Chat in rooms we are not looking at counts as unread
+				if message.RoomName != "" && message.RoomName != currentRoom && message.Sender != "Server" {
+					unread.add(message.RoomName)
+				}
+
+				// Format room messages nicely, naming the room unless it is general and current
+				if message.RoomName != "" && (message.RoomName != "general" || currentRoom != "general") {
 					fmt.Printf(colorYellow+"\n[%s] "+colorBold+"%s: "+colorReset+"%s\n", // Starts with \n
 						message.RoomName, message.Sender, message.Content)
 				} else if message.Sender == "Server" {
@@ -172,10 +453,44 @@ func main() {
 					fmt.Printf(colorCyan+"\n%s: "+colorReset+"%s\n", message.Sender, message.Content) // Starts with \n
 				}
 
+			case "history":
+				// Past messages replayed on join or requested with /history
+				timestamp := ""
+				if message.Time != 0 {
+					timestamp = time.UnixMilli(message.Time).Format("Jan 2 15:04") + " "
+				}
+				fmt.Printf(colorWhite+"\n%s[%s] %s: %s\n"+colorReset,
+					timestamp, message.RoomName, message.Sender, message.Content)
+
+			case "presence":
+				// Someone sharing a room with us went away, got busy or came back
+				if !fileTransfer.active {
+					fmt.Printf(colorWhite+"\n* %s\n"+colorReset, message.Content)
+				}
+
+			case "private":
+				// Private messages are echoed back to the sender by the server
+				if message.Sender == username {
+					fmt.Printf(colorPurple+colorBold+"\n[DM -> %s] "+colorReset+"%s\n",
+						message.Target, message.Content)
+				} else {
+					lastDMSender = message.Sender
+					// Messages kept while we were offline show when they were sent
+					sent := ""
+					if message.Time != 0 && time.Since(time.UnixMilli(message.Time)) > time.Minute {
+						sent = time.UnixMilli(message.Time).Format("Jan 2 15:04") + " "
+					}
+					fmt.Printf(colorPurple+colorBold+"\n%s[DM from %s] "+colorReset+"%s\n",
+						sent, message.Sender, message.Content)
+				}
+
 			case "file-request":
 				fmt.Printf(colorPurple+"\n%s wants to send file: %s\nType /accept or /reject\n"+colorReset, // Starts with \n
 					message.Sender, message.FileName)
 
+				// The file is created once the user accepts
+				downloads.offer(message.Sender, message.FileName)
+
 			case "file-accepted":
 				fmt.Printf(colorGreen+"\nFile transfer accepted by %s. Starting transfer...\n"+colorReset,
 					message.Sender)
@@ -190,11 +505,41 @@ func main() {
 				fileTransfer.active = false
 
 			case "file-complete":
-				fmt.Printf(colorGreen+"\nFile transfer to %s completed successfully!\n"+colorReset, message.Sender)
-				fileTransfer.active = false
+				if download, ok := downloads.take(downloadKey(message.Sender, message.FileName)); ok {
+					if err := download.finish(); err != nil {
+						fmt.Printf(colorRed+"\nError saving file %s: %v\n"+colorReset, download.fileName, err)
+					} else {
+						fmt.Printf(colorGreen+"\nReceived %s from %s (%.2f KB), saved to %s\n"+colorReset,
+							download.fileName, download.sender, float64(download.received)/1024, download.path)
+					}
+				} else {
+					fmt.Printf(colorGreen+"\nFile transfer to %s completed successfully!\n"+colorReset, message.Sender)
+					fileTransfer.active = false
+				}
 
 			case "file-chunk":
-				fmt.Printf(colorBlue+"\nReceived chunk of file: %s\n"+colorReset, message.FileName) // Starts with \n
+				key := downloadKey(message.Sender, message.FileName)
+				download, ok := downloads.get(key)
+				if !ok {
+					// Not a transfer we accepted, or one that was already aborted
+					continue
+				}
+				if download.received == 0 {
+					fmt.Printf(colorBlue+"\nReceiving file %s from %s...\n"+colorReset, download.fileName, download.sender)
+				}
+
+				if err := download.write(message.FileData); err != nil {
+					fmt.Printf(colorRed+"\nError writing file %s: %v\n"+colorReset, download.fileName, err)
+					downloads.forget(message.Sender, message.FileName)
+					break
+				}
+				// Avoid redrawing the prompt for every chunk
+				continue
+
+			case "file-aborted":
+				// Rejected, failed or cancelled, the partial file is removed
+				downloads.forget(message.Sender, message.FileName)
+				fmt.Printf(colorRed+"\n%s\n"+colorReset, message.Content)
 
 			default:
 				fmt.Printf("\n%s: %s\n", message.Sender, message.Content) // Starts with \n
@@ -206,13 +551,7 @@ func main() {
 				drawProgressBar(fileTransfer.lastPercent, 50, false)
 			} else {
 				// Otherwise show the input prompt
-				prompt := colorGreen + "You > " + colorReset
-				if loggedIn && currentRoom != "general" {
-					prompt = colorGreen + "[" + currentRoom + "] You > " + colorReset
-				} else if loggedIn {
-					prompt = colorGreen + "You > " + colorReset
-				}
-				fmt.Print(prompt + currentInput)
+				fmt.Print(promptText(loggedIn, currentRoom, unread) + currentInput)
 			}
 		}
 	}()
@@ -221,13 +560,7 @@ func main() {
 	go func() {
 		scanner := bufio.NewScanner(os.Stdin)
 		// Initial prompt
-		initialPrompt := colorGreen + "You > " + colorReset
-		if loggedIn && currentRoom != "general" {
-			initialPrompt = colorGreen + "[" + currentRoom + "] You > " + colorReset
-		} else if loggedIn {
-			initialPrompt = colorGreen + "You > " + colorReset
-		}
-		fmt.Print(initialPrompt)
+		printPrompt(loggedIn, currentRoom, unread)
 
 		for scanner.Scan() {
 			// Check if we should quit
@@ -250,7 +583,7 @@ func main() {
 			}
 
 			// Provide feedback for sent messages
-			if text != "" && !strings.HasPrefix(text, "/") && loggedIn {
+			if text != "" && !strings.HasPrefix(text, "/") && loggedIn && currentRoom != "" {
 				// For normal chat messages, show them in the UI immediately
 				// Clear the line first, then print message, then print prompt
 				fmt.Print("\r\033[K")
@@ -265,16 +598,8 @@ func main() {
 			// Send to processing channel
 			inputChan <- text
 
-			// Update prompt based on room
-			prompt := colorGreen + "You > " + colorReset
-			if loggedIn && currentRoom != "general" {
-				prompt = colorGreen + "[" + currentRoom + "] You > " + colorReset
-			} else if loggedIn {
-				prompt = colorGreen + "You > " + colorReset
-			}
-
 			// Print the prompt for next input
-			fmt.Print(prompt)
+			printPrompt(loggedIn, currentRoom, unread)
 			currentInput = ""
 		}
 
@@ -293,7 +618,7 @@ func main() {
 		if strings.HasPrefix(text, "/quit") {
 			fmt.Println(colorYellow + "Exiting..." + colorReset)
 			// Send goodbye message to server if connected
-			conn.Write([]byte("/quit\n"))
+			conn.sendLine("/quit")
 			// Close connection cleanly
 			conn.Close()
 			// Signal all goroutines to stop
@@ -307,23 +632,34 @@ func main() {
 		} else if strings.HasPrefix(text, "/clear") {
 			clearScreen()
 			continue
-		} else if strings.HasPrefix(text, "/join") {
-			// Track room changes locally for better UI
+		} else if text == "/r" || strings.HasPrefix(text, "/r ") {
+			// Reply to the last user who sent us a private message
 			parts := strings.Fields(text)
-			if len(parts) > 1 {
-				// Will be confirmed by server message
-				currentRoom = parts[1]
+			if len(parts) < 2 {
+				fmt.Print("\r\033[K")
+				fmt.Println(colorRed + "Usage: /r <message>" + colorReset)
+				printPrompt(loggedIn, currentRoom, unread)
+				continue
+			}
+			if lastDMSender == "" {
+				fmt.Print("\r\033[K")
+				fmt.Println(colorRed + "No private message to reply to" + colorReset)
+				printPrompt(loggedIn, currentRoom, unread)
+				continue
 			}
+			text = "/msg " + lastDMSender + " " + strings.Join(parts[1:], " ")
 		} else if strings.HasPrefix(text, "/sendfile") {
 			parts := strings.Fields(text)
 			if len(parts) < 3 {
 				fmt.Print("\r\033[K") // Clear line before printing error
-				fmt.Println(colorRed + "Usage: /sendfile <username> <filepath>" + colorReset)
-				printPrompt(loggedIn, currentRoom)
+				fmt.Println(colorRed + "Usage: /sendfile <username>[#session] <filepath>" + colorReset)
+				printPrompt(loggedIn, currentRoom, unread)
 				continue
 			}
 
+			// alice#3 sends to one particular session of alice
 			recipient := parts[1]
+			recipientUser, _, _ := strings.Cut(recipient, "#")
 			filePath := parts[2]
 
 			// Read the file
@@ -331,7 +667,7 @@ func main() {
 			if err != nil {
 				fmt.Print("\r\033[K")
 				fmt.Println(colorRed+"Error opening file:"+colorReset, err)
-				printPrompt(loggedIn, currentRoom)
+				printPrompt(loggedIn, currentRoom, unread)
 				continue
 			}
 
@@ -341,7 +677,7 @@ func main() {
 				fmt.Print("\r\033[K")
 				fmt.Println(colorRed+"Error getting file info:"+colorReset, err)
 				file.Close()
-				printPrompt(loggedIn, currentRoom)
+				printPrompt(loggedIn, currentRoom, unread)
 				continue
 			}
 
@@ -352,7 +688,7 @@ func main() {
 			// Set up file transfer state
 			fileTransfer = fileTransferState{
 				active:      true,
-				recipient:   recipient,
+				recipient:   recipientUser,
 				filePath:    filePath,
 				fileName:    fileName,
 				fileSize:    fileSize,
@@ -364,20 +700,34 @@ func main() {
 			fmt.Print("\r\033[K") // Clear line before printing status
 			fmt.Printf(colorBlue+"Initiating file transfer: %s (%.2f KB)\n"+colorReset,
 				fileName, float64(fileSize)/1024)
-			_, err = conn.Write([]byte(fmt.Sprintf("/sendfile %s %s %d\n",
-				recipient, fileName, fileSize)))
+			err = conn.sendLine(fmt.Sprintf("/sendfile %s %s %d", recipient, fileName, fileSize))
 
 			if err != nil {
 				fmt.Print("\r\033[K")
 				fmt.Println(colorRed+"Error sending file transfer request:"+colorReset, err)
 				fileTransfer.active = false
-				printPrompt(loggedIn, currentRoom)
+				printPrompt(loggedIn, currentRoom, unread)
 			}
 			continue
 		} else if strings.HasPrefix(text, "/accept") || strings.HasPrefix(text, "/reject") {
-			// Add explicit handling for accept/reject commands
-			// Just pass these commands through to the server
-			_, err := conn.Write([]byte(text + "\n"))
+			// Create the file before accepting, naming the sender so the
+			// server accepts the same offer
+			if fields := strings.Fields(text); fields[0] == "/accept" {
+				sender := ""
+				if len(fields) > 1 {
+					sender = fields[1]
+				}
+				sender, err := downloads.accept(*downloadsDir, sender)
+				if err != nil {
+					fmt.Printf(colorRed+"Error creating file from %s: %v\n"+colorReset, sender, err)
+					printPrompt(loggedIn, currentRoom, unread)
+					continue
+				}
+				if sender != "" {
+					text = "/accept " + sender
+				}
+			}
+			err := conn.sendLine(text)
 			if err != nil {
 				fmt.Println(colorRed+"Error sending command:"+colorReset, err)
 				break
@@ -386,7 +736,11 @@ func main() {
 		}
 
 		// Send the message to the server
-		_, err := conn.Write([]byte(text + "\n"))
+		err := conn.sendLine(text)
+		if err != nil && conn.reconnecting.Load() {
+			fmt.Println(colorRed + "Not connected, reconnecting..." + colorReset)
+			continue
+		}
 		if err != nil {
 			fmt.Println(colorRed+"Error sending message:"+colorReset, err)
 			break
@@ -427,10 +781,34 @@ func printHelp() {
 	help := `
 ` + colorBold + colorCyan + `AVAILABLE COMMANDS:` + colorReset + `
   ` + colorGreen + `/login <username> <password>` + colorReset + ` - Log in to the server
-  ` + colorGreen + `/join <roomname>` + colorReset + `          - Join a chat room
+  ` + colorGreen + `/register <username> <password> [invite]` + colorReset + ` - Create an account
+  ` + colorGreen + `/join <roomname> [password]` + colorReset + ` - Join a chat room
+  ` + colorGreen + `/part [roomname]` + colorReset + `          - Leave a room (the current one by default)
+  ` + colorGreen + `/switch <roomname>` + colorReset + `        - Send plain messages to another room you are in
+  ` + colorGreen + `/say <roomname> <message>` + colorReset + ` - Post to a room you are in without switching
   ` + colorGreen + `/rooms` + colorReset + `                   - List available rooms
+  ` + colorGreen + `/roominfo [roomname]` + colorReset + `      - Show a room's topic, owner, creation time and members
+  ` + colorGreen + `/topic [text]` + colorReset + `             - Show or (operators) set the topic, "-" clears it
+  ` + colorGreen + `/describe [text]` + colorReset + `          - Show or (operators) set the description
+  ` + colorGreen + `/persist on|off` + colorReset + `           - (room owner) Keep the room while it is empty
+  ` + colorGreen + `/deleteroom [roomname]` + colorReset + `    - (room owner) Delete a room and its messages
+  ` + colorGreen + `/history [count]` + colorReset + `          - Show earlier messages in the current room
   ` + colorGreen + `/users` + colorReset + `                   - List users in current room
-  ` + colorGreen + `/sendfile <username> <filepath>` + colorReset + ` - Send a file to a user
+  ` + colorGreen + `/op <username>` + colorReset + `            - (room owner) Make a user an operator of the current room
+  ` + colorGreen + `/deop <username>` + colorReset + `          - (room owner) Take operator status away
+  ` + colorGreen + `/kick <username> [reason]` + colorReset + ` - (operators) Remove a user from the current room
+  ` + colorGreen + `/ban <username> [reason]` + colorReset + `  - (operators) Remove a user and keep them out
+  ` + colorGreen + `/unban <username>` + colorReset + `         - (operators) Lift a ban
+  ` + colorGreen + `/invite <username>` + colorReset + `        - (operators) Let a user into the current room
+  ` + colorGreen + `/mode <mode> [password]` + colorReset + `   - (room owner) Make the room public, private, invite-only or password
+  ` + colorGreen + `/away [reason]` + colorReset + `            - Mark yourself away
+  ` + colorGreen + `/busy [reason]` + colorReset + `            - Mark yourself busy
+  ` + colorGreen + `/back` + colorReset + `                    - Mark yourself online again
+  ` + colorGreen + `/whois <username>` + colorReset + `         - Show a user's status, rooms and when they were last seen
+  ` + colorGreen + `/msg <username> <message>` + colorReset + `  - Send a private message to a user
+  ` + colorGreen + `/r <message>` + colorReset + `               - Reply to the last private message
+  ` + colorGreen + `/sendfile <username> <filepath>` + colorReset + ` - Send a file to a user (username#session for one session)
+  ` + colorGreen + `/sessions [logout #<id>|others]` + colorReset + ` - List your sessions or log them out
   ` + colorGreen + `/accept` + colorReset + `                  - Accept an incoming file transfer
   ` + colorGreen + `/reject` + colorReset + `                  - Reject an incoming file transfer
   ` + colorGreen + `/clear` + colorReset + `                   - Clear the screen
@@ -438,23 +816,53 @@ func printHelp() {
   ` + colorGreen + `/quit` + colorReset + `                    - Exit the client
 
 Type your message and press Enter to send it to the current room.
+Unread messages in your other rooms are counted in the prompt.
 `
 	fmt.Println(help)
 }
 
 // Helper to print the appropriate prompt
-func printPrompt(loggedIn bool, currentRoom string) {
-	prompt := colorGreen + "You > " + colorReset
-	if loggedIn && currentRoom != "general" {
-		prompt = colorGreen + "[" + currentRoom + "] You > " + colorReset
-	} else if loggedIn {
-		prompt = colorGreen + "You > " + colorReset
+func printPrompt(loggedIn bool, currentRoom string, unread *unreadCounts) {
+	fmt.Print(promptText(loggedIn, currentRoom, unread))
+}
+
+// promptText shows the current room and, when logged in, unread messages in other rooms
+func promptText(loggedIn bool, currentRoom string, unread *unreadCounts) string {
+	if !loggedIn {
+		return colorGreen + "You > " + colorReset
+	}
+	prompt := ""
+	if counts := unread.String(); counts != "" {
+		prompt = colorYellow + "(" + counts + ") " + colorReset
+	}
+	if currentRoom != "general" && currentRoom != "" {
+		prompt += colorGreen + "[" + currentRoom + "] " + colorReset
+	}
+	return prompt + colorGreen + "You > " + colorReset
+}
+
+// reconnect dials the server again, waiting twice as long after each failed attempt
+func reconnect(redial func() (net.Conn, error)) (net.Conn, error) {
+	backoff := time.Second
+	var err error
+	for attempt := 1; attempt <= maxReconnectAttempts; attempt++ {
+		fmt.Printf(colorYellow+"Reconnecting in %v (attempt %d of %d)...\n"+colorReset, backoff, attempt, maxReconnectAttempts)
+		time.Sleep(backoff)
+
+		var conn net.Conn
+		if conn, err = redial(); err == nil {
+			return conn, nil
+		}
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
 	}
-	fmt.Print(prompt)
+	return nil, err
 }
 
 // Send file in chunks as a separate goroutine
-func sendFileInChunks(conn net.Conn, filePath string, fileName string, state *fileTransferState) {
+func sendFileInChunks(conn *serverConn, filePath string, fileName string, state *fileTransferState) {
 	// Create a copy of the state to avoid race conditions
 	fileSize := state.fileSize
 
@@ -485,22 +893,7 @@ func sendFileInChunks(conn net.Conn, filePath string, fileName string, state *fi
 		}
 
 		// Send chunk
-		fileMessage := Message{
-			Type:     "file-chunk",
-			FileName: fileName,
-			FileData: buffer[:n],
-		}
-
-		jsonFileMsg, err := json.Marshal(fileMessage)
-		if err != nil {
-			fmt.Print("\r\033[K") // Clear progress bar line
-			fmt.Println(colorRed+"Error marshaling file message:"+colorReset, err)
-			state.active = false
-			return
-		}
-
-		jsonFileMsg = append(jsonFileMsg, '\n')
-		_, err = conn.Write(jsonFileMsg)
+		err = conn.sendFileChunk(state.recipient, fileName, buffer[:n])
 		if err != nil {
 			fmt.Print("\r\033[K") // Clear progress bar line
 			fmt.Println(colorRed+"Error sending file chunk:"+colorReset, err)
@@ -521,8 +914,9 @@ func sendFileInChunks(conn net.Conn, filePath string, fileName string, state *fi
 			drawProgressBar(progress, 50, false)
 		}
 
-		// Small sleep to avoid flooding the network
-		time.Sleep(5 * time.Millisecond)
+		// The server counts every chunk against its flood limit, by default
+		// 5 messages a second
+		time.Sleep(200 * time.Millisecond)
 	}
 
 	// File transfer complete
@@ -533,7 +927,69 @@ func sendFileInChunks(conn net.Conn, filePath string, fileName string, state *fi
 
 	// Allow time for the final chunks to be processed
 	time.Sleep(500 * time.Millisecond)
-	printPrompt(true, "general") // Default prompt after transfer
+	printPrompt(true, "general", nil) // Default prompt after transfer
+}
+
+// sanitizeFileName strips any directory components from a remote file name
+// so that a malicious sender cannot write outside the downloads directory
+func sanitizeFileName(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = filepath.Base(filepath.Clean("/" + name))
+	if name == "/" || name == "." || name == ".." || name == "" {
+		return "file"
+	}
+	return name
+}
+
+// downloadKey identifies a transfer, two senders may send files with the same name
+func downloadKey(sender, fileName string) string {
+	return sender + "/" + fileName
+}
+
+// openDownload creates the destination file for an incoming transfer.
+// The name is prefixed with a timestamp and the sender to avoid overwriting
+// earlier downloads.
+func openDownload(dir, sender, fileName string) (*incomingFile, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	safeName := sanitizeFileName(fileName)
+	path := filepath.Join(dir, time.Now().Format("20060102-150405")+"_"+sanitizeFileName(sender)+"_"+safeName)
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &incomingFile{
+		sender:   sender,
+		fileName: safeName,
+		path:     path,
+		file:     file,
+	}, nil
+}
+
+// write appends a chunk of data to the download
+func (d *incomingFile) write(data []byte) error {
+	n, err := d.file.Write(data)
+	d.received += int64(n)
+	return err
+}
+
+// finish flushes the file to disk and closes it
+func (d *incomingFile) finish() error {
+	if err := d.file.Sync(); err != nil {
+		d.file.Close()
+		return err
+	}
+	return d.file.Close()
+}
+
+// abort closes and removes a partially received file
+func (d *incomingFile) abort() {
+	d.file.Close()
+	os.Remove(d.path)
 }
 
 // Improved progress bar that's more resilient to interference
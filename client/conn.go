@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/abdeljalil/GoChatServer/server"
+)
+
+const (
+	protocolV2 = 2
+
+	// Binary file frames, encoded with the server's codec
+	featureBinaryFiles = "binary-files"
+)
+
+// Frame is the v2 envelope around every message on the wire
+type Frame struct {
+	V       int             `json:"v"`
+	ID      uint64          `json:"id,omitempty"`
+	TS      int64           `json:"ts"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Hello is the payload of the handshake frame
+type Hello struct {
+	Versions []int    `json:"versions,omitempty"`
+	Version  int      `json:"version,omitempty"`
+	Agent    string   `json:"agent,omitempty"`
+	Features []string `json:"features,omitempty"`
+}
+
+// serverConn wraps the connection to the server and speaks whichever
+// protocol version was negotiated. Until the server answers the hello
+// frame it falls back to legacy text lines.
+type serverConn struct {
+	net.Conn
+	v2           atomic.Bool
+	binaryFiles  atomic.Bool
+	reconnecting atomic.Bool // Set while a dropped connection is being replaced
+	writeMutex   sync.Mutex  // Also guards replacing Conn
+}
+
+// dial connects to the server, optionally over TLS
+func dial(addr string, useTLS bool, caFile string, insecure bool, certFile, keyFile string) (net.Conn, error) {
+	if !useTLS {
+		return net.Dial("tcp", addr)
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: insecure,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pemData, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return tls.Dial("tcp", addr, config)
+}
+
+func newServerConn(conn net.Conn) *serverConn {
+	return &serverConn{Conn: conn}
+}
+
+// swap replaces a dropped connection with a new one. The protocol has to be
+// negotiated again, so it starts in legacy mode. Only the reader may call it.
+func (s *serverConn) swap(conn net.Conn) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	s.Conn.Close()
+	s.Conn = conn
+	s.v2.Store(false)
+	s.binaryFiles.Store(false)
+}
+
+// Close closes the current connection
+func (s *serverConn) Close() error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	return s.Conn.Close()
+}
+
+// writeRaw sends one newline-terminated line, serializing concurrent writers
+func (s *serverConn) writeRaw(data []byte) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	_, err := s.Conn.Write(append(data, '\n'))
+	return err
+}
+
+// sendHello offers protocol v2 to the server
+func (s *serverConn) sendHello() error {
+	payload, err := json.Marshal(Hello{
+		Versions: []int{protocolV2},
+		Agent:    "GoChatClient",
+		Features: []string{featureBinaryFiles},
+	})
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(Frame{V: protocolV2, TS: time.Now().UnixMilli(), Type: "hello", Payload: payload})
+	if err != nil {
+		return err
+	}
+	return s.writeRaw(data)
+}
+
+// sendFrame sends a message as a v2 frame, or as a legacy JSON line if v2
+// has not been negotiated
+func (s *serverConn) sendFrame(frameType string, message Message) error {
+	message.Type = frameType
+	if !s.v2.Load() {
+		data, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		return s.writeRaw(data)
+	}
+
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(Frame{V: protocolV2, TS: time.Now().UnixMilli(), Type: frameType, Payload: payload})
+	if err != nil {
+		return err
+	}
+	return s.writeRaw(data)
+}
+
+// sendLine sends a line typed by the user, either a command or chat text
+func (s *serverConn) sendLine(text string) error {
+	if !s.v2.Load() {
+		return s.writeRaw([]byte(text))
+	}
+	if strings.HasPrefix(text, "/") {
+		return s.sendFrame("command", Message{Content: text})
+	}
+	return s.sendFrame("text", Message{Content: text})
+}
+
+// decode parses a line from the server, which is either a v2 frame or a
+// legacy JSON message. The handshake reply switches the connection to v2
+// and is reported with handshake set.
+func (s *serverConn) decode(line []byte) (message Message, handshake bool, err error) {
+	var frame Frame
+	if err := json.Unmarshal(line, &frame); err == nil && frame.V != 0 {
+		if frame.Type == "hello" {
+			var hello Hello
+			json.Unmarshal(frame.Payload, &hello)
+			if hello.Version == protocolV2 {
+				s.v2.Store(true)
+			}
+			for _, feature := range hello.Features {
+				if feature == featureBinaryFiles {
+					s.binaryFiles.Store(true)
+				}
+			}
+			return Message{}, true, nil
+		}
+
+		if err := json.Unmarshal(frame.Payload, &message); err != nil {
+			return Message{}, false, err
+		}
+		message.Type = frame.Type
+		if message.ID == 0 {
+			message.ID = frame.ID
+		}
+		if message.Time == 0 {
+			message.Time = frame.TS
+		}
+		return message, false, nil
+	}
+
+	err = json.Unmarshal(line, &message)
+	return message, false, err
+}
+
+// sendFileChunk sends a chunk of a file for recipient, as a binary frame
+// when the server supports it and as a JSON file-chunk message otherwise
+func (s *serverConn) sendFileChunk(recipient, fileName string, data []byte) error {
+	if !s.binaryFiles.Load() {
+		return s.sendFrame("file-chunk", Message{FileName: fileName, FileData: data, Target: recipient})
+	}
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	// Towards the server the name in the frame is that of the recipient
+	return server.WriteFileFrame(s.Conn, server.FileFrame{Sender: recipient, FileName: fileName, Data: data})
+}
+
+// isBinaryFrame reports whether the next byte from the server starts a binary frame
+func isBinaryFrame(r *bufio.Reader) bool {
+	return server.IsBinaryFrame(r)
+}
+
+// readFileFrame decodes a binary file frame into a file-chunk message
+func readFileFrame(r *bufio.Reader) (Message, error) {
+	frame, err := server.ReadFileFrame(r)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Type:     "file-chunk",
+		Sender:   frame.Sender,
+		FileName: frame.FileName,
+		FileData: frame.Data,
+	}, nil
+}
@@ -1,17 +1,62 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/abdeljalil/GoChatServer/server"
 )
 
 func main() {
-	port := flag.Int("port", 8080, "Port to listen on")
+	port := flag.Int("port", 8080, "Port to listen on for plaintext connections (0 disables plaintext when TLS is enabled)")
 	verbose := flag.Bool("v", false, "Enable verbose logging")
+	kdfIterations := flag.Int("kdf-iterations", server.DefaultPasswordIterations, "PBKDF2 iterations used when hashing passwords")
+	usersDB := flag.String("users-db", "", "Path to the user database file (accounts are kept in memory if empty)")
+	openRegistration := flag.Bool("open-registration", true, "Allow anyone to /register without an invite code")
+	admins := flag.String("admins", "", "Comma-separated list of admin usernames")
+	historySize := flag.Int("history-size", 200, "Number of messages kept per room")
+	historyReplay := flag.Int("history-replay", 20, "Number of past messages replayed when joining a room")
+	roomIdleTimeout := flag.Duration("room-idle-timeout", 24*time.Hour, "Delete rooms that have been empty for this long, except general and persistent rooms (0 keeps them)")
+	autoAway := flag.Duration("auto-away", 10*time.Minute, "Mark users away after this long without sending anything (0 disables it)")
+	maxSessions := flag.Int("max-sessions", 5, "Connections one user may be logged in with at once (0 allows any number)")
+	sessionPolicyName := flag.String("session-policy", "refuse", "What to do with a login beyond -max-sessions: refuse or kick-oldest")
+	resumeGrace := flag.Duration("resume-grace", 2*time.Minute, "How long a dropped session can be resumed with its token (0 disables session tokens)")
+	mailboxSize := flag.Int("mailbox-size", 100, "Messages kept for each offline user")
+	mailboxTTL := flag.Duration("mailbox-ttl", 7*24*time.Hour, "How long messages for offline users are kept")
+	messageLogDir := flag.String("message-log", "", "Directory for the on-disk message log (messages are not persisted if empty)")
+	segmentSize := flag.Int64("segment-size", 4*1024*1024, "Size in bytes after which message log segments are rotated")
+	syncWrites := flag.Bool("sync-writes", false, "Fsync the message log after every message")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file (enables TLS)")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	tlsPort := flag.Int("tls-port", 8443, "Port to listen on for TLS connections")
+	tlsSelfSigned := flag.Bool("tls-self-signed", false, "Generate a self-signed certificate for development if the cert/key files do not exist")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA file used to verify client certificates; the certificate common name is used as username")
+	tlsRequireClientCert := flag.Bool("tls-require-client-cert", false, "Reject TLS clients without a valid client certificate")
+	wsPort := flag.Int("ws-port", 0, "Port for the WebSocket gateway at /ws (disabled if 0)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for file transfers to finish on shutdown")
+	sendQueue := flag.Int("send-queue", 256, "Outgoing messages buffered per client")
+	writeTimeout := flag.Duration("write-timeout", 10*time.Second, "Disconnect clients that do not accept data for this long")
+	slowConsumer := flag.String("slow-consumer", "drop-oldest", "What to do when a client's send queue is full: drop-oldest, disconnect or lag")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", 10, "Concurrent connections allowed per IP address (-1 for no limit)")
+	maxLineLength := flag.Int("max-line-length", 64*1024, "Longest line accepted from a client, in bytes")
+	messageRate := flag.Float64("rate", 5, "Chat messages and commands allowed per second per user, or per IP before login (-1 for no limit)")
+	messageBurst := flag.Int("burst", 20, "Messages a client may send at once before -rate applies")
+	muteAfter := flag.Int("mute-after", 3, "Flood violations before a client is muted (-1 to never mute)")
+	muteDuration := flag.Duration("mute-duration", 30*time.Second, "How long a flood mute lasts")
+	disconnectAfter := flag.Int("disconnect-after", 6, "Flood violations before a client is disconnected (-1 to never disconnect)")
+	banAfter := flag.Int("ban-after", 3, "Flood disconnects from one IP within 10 minutes before it is banned (-1 to never ban)")
+	banDuration := flag.Duration("ban-duration", 10*time.Minute, "How long a flood IP ban lasts")
+	loginMaxFailures := flag.Int("login-max-failures", 5, "Failed logins before an account is locked (-1 to never lock)")
+	loginMaxFailuresPerIP := flag.Int("login-max-failures-per-ip", 20, "Failed logins from one IP address before it is locked out (-1 to never lock)")
+	loginBackoff := flag.Duration("login-backoff", time.Second, "Wait after a failed login, doubled after each further failure (0 disables)")
+	loginLockout := flag.Duration("login-lockout", 15*time.Minute, "How long a login lockout lasts")
 	flag.Parse()
 
 	// Set up logging
@@ -22,9 +67,122 @@ func main() {
 		log.SetFlags(log.Ldate | log.Ltime)
 	}
 
+	// A low cost would make stored hashes cheap to crack, and 0 unusable
+	if *kdfIterations < server.MinPasswordIterations {
+		log.Fatalf("-kdf-iterations must be at least %d", server.MinPasswordIterations)
+	}
+
+	slowConsumerPolicy, err := server.ParseSlowConsumerPolicy(*slowConsumer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sessionPolicy, err := server.ParseSessionPolicy(*sessionPolicyName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Build the server configuration from the flags
+	config := server.Config{
+		HistorySize:           *historySize,
+		HistoryReplay:         *historyReplay,
+		RoomIdleTimeout:       *roomIdleTimeout,
+		AutoAwayAfter:         *autoAway,
+		MailboxSize:           *mailboxSize,
+		MailboxTTL:            *mailboxTTL,
+		MaxSessions:           *maxSessions,
+		SessionPolicy:         sessionPolicy,
+		ResumeGrace:           *resumeGrace,
+		ShutdownTimeout:       *shutdownTimeout,
+		InviteOnly:            !*openRegistration,
+		PasswordIterations:    *kdfIterations,
+		SendQueueSize:         *sendQueue,
+		WriteTimeout:          *writeTimeout,
+		SlowConsumerPolicy:    slowConsumerPolicy,
+		MaxConnsPerIP:         *maxConnsPerIP,
+		MaxLineLength:         *maxLineLength,
+		MessageRate:           *messageRate,
+		MessageBurst:          *messageBurst,
+		MuteAfter:             *muteAfter,
+		MuteDuration:          *muteDuration,
+		DisconnectAfter:       *disconnectAfter,
+		BanAfter:              *banAfter,
+		BanDuration:           *banDuration,
+		LoginMaxFailures:      *loginMaxFailures,
+		LoginMaxFailuresPerIP: *loginMaxFailuresPerIP,
+		LoginBackoff:          *loginBackoff,
+		LoginLockout:          *loginLockout,
+	}
+	if *port > 0 {
+		config.Addr = fmt.Sprintf(":%d", *port)
+	}
+	if *historyReplay == 0 {
+		config.HistoryReplay = -1 // No replay
+	}
+	if *roomIdleTimeout == 0 {
+		config.RoomIdleTimeout = -1 // Keep empty rooms
+	}
+	if *resumeGrace == 0 {
+		config.ResumeGrace = -1 // No session tokens
+	}
+	if *maxSessions == 0 {
+		config.MaxSessions = -1 // No limit
+	}
+	if *autoAway == 0 {
+		config.AutoAwayAfter = -1 // No auto-away
+	}
+	if *loginBackoff == 0 {
+		config.LoginBackoff = -1 // No backoff
+	}
+	if *tlsSelfSigned {
+		if *tlsCert == "" {
+			*tlsCert = "cert.pem"
+		}
+		if *tlsKey == "" {
+			*tlsKey = "key.pem"
+		}
+		if _, err := os.Stat(*tlsCert); os.IsNotExist(err) {
+			if err := server.GenerateSelfSignedCert(*tlsCert, *tlsKey, []string{"localhost", "127.0.0.1", "::1"}); err != nil {
+				log.Fatalf("Error generating self-signed certificate: %v", err)
+			}
+			fmt.Printf("Generated self-signed certificate %s (use it as -ca on the client)\n", *tlsCert)
+		}
+	}
+	if *tlsCert != "" {
+		tlsConfig, err := server.LoadTLSConfig(*tlsCert, *tlsKey, *tlsClientCA, *tlsRequireClientCert)
+		if err != nil {
+			log.Fatalf("Error setting up TLS: %v", err)
+		}
+		config.TLSConfig = tlsConfig
+		config.TLSAddr = fmt.Sprintf(":%d", *tlsPort)
+		fmt.Printf("TLS enabled on port %d\n", *tlsPort)
+	}
+	if *usersDB != "" {
+		store, err := server.NewFileUserStore(*usersDB)
+		if err != nil {
+			log.Fatalf("Error opening user database %s: %v", *usersDB, err)
+		}
+		config.Users = store
+	}
+	if *messageLogDir != "" {
+		messageLog, err := server.OpenMessageLog(*messageLogDir, *segmentSize, *syncWrites)
+		if err != nil {
+			log.Fatalf("Error opening message log %s: %v", *messageLogDir, err)
+		}
+		config.MessageLog = messageLog
+	}
+	if *admins != "" {
+		config.Admins = strings.Split(*admins, ",")
+	}
+	if *wsPort > 0 {
+		config.WebSocketAddr = fmt.Sprintf(":%d", *wsPort)
+		fmt.Printf("WebSocket gateway on port %d at /ws\n", *wsPort)
+	}
+	if *port > 0 {
+		fmt.Printf("Chat server running on port %d\n", *port)
+	}
+
 	// Create and start the server
-	s := server.NewServer(*port)
-	fmt.Printf("Chat server running on port %d\n", *port)
+	s := server.NewServerWithConfig(config)
 	fmt.Println("Press Ctrl+C to stop the server")
 
 	// Log to both console and file
@@ -34,5 +192,30 @@ func main() {
 		defer logFile.Close()
 	}
 
-	log.Fatal(s.Run())
+	// Stop gracefully on Ctrl+C or SIGTERM
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- s.Run()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case err := <-runErr:
+		log.Fatal(err)
+	case sig := <-signals:
+		fmt.Printf("Received %s, shutting down...\n", sig)
+		log.Printf("Received %s, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: %v", err)
+	}
+	if err := <-runErr; err != nil && err != server.ErrServerClosed {
+		log.Printf("Server error: %v", err)
+	}
+	fmt.Println("Server stopped")
 }
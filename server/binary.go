@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Binary file frames carry raw chunk bytes on the same connection as the
+// newline-delimited JSON/text stream, avoiding the base64 overhead and JSON
+// decoding of file-chunk messages. They are only used once both sides listed
+// featureBinaryFiles in the v2 hello handshake. Layout:
+//
+//	magic    uint8  0xFB, never the first byte of a UTF-8 text line
+//	type     uint8  binaryFileChunk
+//	senderLen uint8
+//	nameLen  uint16
+//	dataLen  uint32
+//	sender   [senderLen]byte (empty when sent by a client)
+//	name     [nameLen]byte
+//	data     [dataLen]byte
+//
+// All integers are big endian.
+const (
+	binaryFrameMagic      = 0xFB
+	binaryFileChunk       = 1
+	binaryFrameHeaderSize = 9
+	maxBinaryFrameData    = 16 * 1024 * 1024
+
+	featureBinaryFiles = "binary-files"
+)
+
+var errBadBinaryFrame = errors.New("malformed binary frame")
+
+// FileFrame is a chunk of a file transfer sent as a binary frame
+type FileFrame struct {
+	Sender   string // The receiver in frames sent to the server
+	FileName string
+	Data     []byte
+}
+
+// WriteFileFrame encodes a file chunk as a binary frame. The frame is written
+// with a single Write call so it never interleaves with other messages.
+func WriteFileFrame(w io.Writer, frame FileFrame) error {
+	if len(frame.Sender) > 0xFF || len(frame.FileName) > 0xFFFF || len(frame.Data) > maxBinaryFrameData {
+		return fmt.Errorf("%w: field too large", errBadBinaryFrame)
+	}
+
+	buf := make([]byte, binaryFrameHeaderSize+len(frame.Sender)+len(frame.FileName)+len(frame.Data))
+	buf[0] = binaryFrameMagic
+	buf[1] = binaryFileChunk
+	buf[2] = uint8(len(frame.Sender))
+	binary.BigEndian.PutUint16(buf[3:5], uint16(len(frame.FileName)))
+	binary.BigEndian.PutUint32(buf[5:9], uint32(len(frame.Data)))
+
+	offset := binaryFrameHeaderSize
+	offset += copy(buf[offset:], frame.Sender)
+	offset += copy(buf[offset:], frame.FileName)
+	copy(buf[offset:], frame.Data)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// IsBinaryFrame reports whether the next byte in r starts a binary frame
+func IsBinaryFrame(r *bufio.Reader) bool {
+	b, err := r.Peek(1)
+	return err == nil && b[0] == binaryFrameMagic
+}
+
+// ReadFileFrame decodes a binary frame. The caller must have checked
+// IsBinaryFrame first.
+func ReadFileFrame(r *bufio.Reader) (FileFrame, error) {
+	return readFileFrame(r, maxBinaryFrameData)
+}
+
+// readFileFrame is ReadFileFrame refusing frames with more than maxData
+// bytes of data
+func readFileFrame(r *bufio.Reader, maxData int) (FileFrame, error) {
+	header := make([]byte, binaryFrameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return FileFrame{}, err
+	}
+	if header[0] != binaryFrameMagic || header[1] != binaryFileChunk {
+		return FileFrame{}, errBadBinaryFrame
+	}
+
+	senderLen := int(header[2])
+	nameLen := int(binary.BigEndian.Uint16(header[3:5]))
+	dataLen := int(binary.BigEndian.Uint32(header[5:9]))
+	if dataLen > maxData {
+		return FileFrame{}, fmt.Errorf("%w: chunk of %d bytes is too large", errBadBinaryFrame, dataLen)
+	}
+
+	body := make([]byte, senderLen+nameLen+dataLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return FileFrame{}, err
+	}
+
+	return FileFrame{
+		Sender:   string(body[:senderLen]),
+		FileName: string(body[senderLen : senderLen+nameLen]),
+		Data:     body[senderLen+nameLen:],
+	}, nil
+}
+
+// sendFileChunk delivers a chunk to the client, as a binary frame if it
+// negotiated support for them and as a JSON file-chunk message otherwise
+func (c *Client) sendFileChunk(sender, fileName string, data []byte) error {
+	if !c.binaryFiles.Load() {
+		frame, err := c.encode(Message{
+			Sender:   sender,
+			FileName: fileName,
+			FileData: data,
+			Type:     "file-chunk",
+		})
+		if err != nil {
+			return err
+		}
+		return c.queueReliable(frame)
+	}
+
+	var frame bytes.Buffer
+	if err := WriteFileFrame(&frame, FileFrame{Sender: sender, FileName: fileName, Data: data}); err != nil {
+		return err
+	}
+	return c.queueReliable(frame.Bytes())
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestFileFrameRoundTrip(t *testing.T) {
+	frames := []FileFrame{
+		{Sender: "alice", FileName: "report.pdf", Data: []byte("hello")},
+		{FileName: "empty.txt"},
+		{Sender: "bob", FileName: "big.bin", Data: bytes.Repeat([]byte{0xFB, '\n', 0}, 10000)},
+	}
+
+	var buf bytes.Buffer
+	for _, frame := range frames {
+		if err := WriteFileFrame(&buf, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Text lines interleave with frames on the same stream
+	buf.WriteString("{\"Type\":\"text\"}\n")
+
+	reader := bufio.NewReader(&buf)
+	for _, want := range frames {
+		if !IsBinaryFrame(reader) {
+			t.Fatal("frame not recognised")
+		}
+		got, err := ReadFileFrame(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Sender != want.Sender || got.FileName != want.FileName || !bytes.Equal(got.Data, want.Data) {
+			t.Fatalf("got frame %q/%q with %d bytes, want %q/%q with %d bytes",
+				got.Sender, got.FileName, len(got.Data), want.Sender, want.FileName, len(want.Data))
+		}
+	}
+	if IsBinaryFrame(reader) {
+		t.Fatal("text line taken for a frame")
+	}
+}
+
+func TestFileFrameLimits(t *testing.T) {
+	var buf bytes.Buffer
+	tooBig := FileFrame{FileName: "f", Data: make([]byte, maxBinaryFrameData+1)}
+	if err := WriteFileFrame(&buf, tooBig); !errors.Is(err, errBadBinaryFrame) {
+		t.Fatalf("oversized chunk gave %v", err)
+	}
+
+	// A header announcing too much data is refused before reading it
+	header := []byte{binaryFrameMagic, binaryFileChunk, 0, 0, 1, 0xFF, 0xFF, 0xFF, 0xFF}
+	if _, err := ReadFileFrame(bufio.NewReader(bytes.NewReader(header))); !errors.Is(err, errBadBinaryFrame) {
+		t.Fatalf("oversized header gave %v", err)
+	}
+	header = []byte{binaryFrameMagic, 7, 0, 0, 0, 0, 0, 0, 0}
+	if _, err := ReadFileFrame(bufio.NewReader(bytes.NewReader(header))); !errors.Is(err, errBadBinaryFrame) {
+		t.Fatalf("unknown frame type gave %v", err)
+	}
+}
+
+// benchmarkChunkSizes covers the 8KB chunks of the bundled client and larger ones
+var benchmarkChunkSizes = []int{chunkSize, 64 * 1024}
+
+func benchmarkChunk(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return data
+}
+
+// BenchmarkFileChunkJSON sends file-chunk messages as v2 frames, the data
+// base64 encoded in JSON, and decodes them as the server does
+func BenchmarkFileChunkJSON(b *testing.B) {
+	for _, size := range benchmarkChunkSizes {
+		b.Run(fmt.Sprintf("%dKB", size/1024), func(b *testing.B) {
+			data := benchmarkChunk(size)
+			var buf bytes.Buffer
+			reader := bufio.NewReaderSize(&buf, 2*size)
+			var wire int64
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				line, err := encodeFrame(Message{FileName: "bench.bin", FileData: data, Type: "file-chunk"})
+				if err != nil {
+					b.Fatal(err)
+				}
+				buf.Write(append(line, '\n'))
+				wire += int64(len(line) + 1)
+
+				received, err := reader.ReadString('\n')
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, message, err := decodeFrame(received)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(message.FileData) != size {
+					b.Fatalf("got %d bytes, want %d", len(message.FileData), size)
+				}
+			}
+			b.ReportMetric(float64(wire)/float64(b.N)/float64(size), "wire/payload")
+		})
+	}
+}
+
+// BenchmarkFileChunkBinary sends the same chunks as binary file frames
+func BenchmarkFileChunkBinary(b *testing.B) {
+	for _, size := range benchmarkChunkSizes {
+		b.Run(fmt.Sprintf("%dKB", size/1024), func(b *testing.B) {
+			data := benchmarkChunk(size)
+			var buf bytes.Buffer
+			reader := bufio.NewReaderSize(&buf, 2*size)
+			var wire int64
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				before := buf.Len()
+				if err := WriteFileFrame(&buf, FileFrame{FileName: "bench.bin", Data: data}); err != nil {
+					b.Fatal(err)
+				}
+				wire += int64(buf.Len() - before)
+
+				if !IsBinaryFrame(reader) {
+					b.Fatal("frame not recognised")
+				}
+				frame, err := ReadFileFrame(reader)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(frame.Data) != size {
+					b.Fatalf("got %d bytes, want %d", len(frame.Data), size)
+				}
+			}
+			b.ReportMetric(float64(wire)/float64(b.N)/float64(size), "wire/payload")
+		})
+	}
+}
@@ -4,18 +4,29 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Client is one connection. It can be in several rooms at once; currentRoom
+// is where plain chat text goes. username and authenticated are only written
+// by the client's own read goroutine, which holds mutex while doing so; other
+// goroutines must use the accessors. currentRoom also changes when a moderator
+// removes the client from it, so it is always read with CurrentRoom.
 type Client struct {
 	conn          net.Conn
 	server        *Server
-	send          chan Message
+	send          *sendQueue
+	writerDone    chan struct{} // Closed when writePump has exited
+	mutex         sync.Mutex
 	username      string
 	currentRoom   string
 	authenticated bool
@@ -24,46 +35,163 @@ type Client struct {
 	fileSize      int64
 	receivedSize  int64
 	fileName      string
+	historyPos    map[string]int // Position of the oldest message shown per room, used to page /history
+	protocol      atomic.Int32
+	binaryFiles   atomic.Bool // Negotiated binary file frames
+
+	// Presence, guarded by mutex
+	presence       Presence
+	presenceReason string
+	autoAway       bool // Set away by the server rather than the user
+	lastActive     time.Time
+	connectedAt    time.Time
+	resumeToken    string // Lets the user resume this session after a dropped connection
+
+	sessionID uint64 // Set once by NewClient
+
+	// Flood protection, only used by the read goroutine. The rate limit and
+	// mutes are kept per user and address, see flood.
+	ip     string
+	kicked bool
 }
 
 func NewClient(conn net.Conn, server *Server) *Client {
-	return &Client{
+	client := &Client{
 		conn:          conn,
 		server:        server,
-		send:          make(chan Message, 10),
+		send:          newSendQueue(server.sendQueueSize),
+		writerDone:    make(chan struct{}),
 		currentRoom:   "general", // Default room
 		authenticated: false,
 		fileBuffer:    new(bytes.Buffer),
 		receivingFile: false,
+		historyPos:    make(map[string]int),
+		ip:            remoteIP(conn.RemoteAddr()),
+		lastActive:    time.Now(),
+		connectedAt:   time.Now(),
+		sessionID:     server.lastSessionID.Add(1),
 	}
+	client.protocol.Store(protocolLegacy)
+	return client
+}
+
+// Username returns the name the client is logged in as
+func (c *Client) Username() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.username
+}
+
+// CurrentRoom returns the name of the room plain chat text goes to
+func (c *Client) CurrentRoom() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.currentRoom
+}
+
+// IsAuthenticated reports whether the client has logged in
+func (c *Client) IsAuthenticated() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.authenticated
+}
+
+// setRoom changes the room plain chat text goes to
+func (c *Client) setRoom(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.currentRoom = name
 }
 
 func (c *Client) Handle() {
+	// Finish the TLS handshake first, a verified client certificate logs the user in
+	certUser, err := handshake(c.conn, c.server.handshakeTimeout)
+	if err != nil {
+		c.server.logger.Printf("TLS handshake with %s failed: %v", c.conn.RemoteAddr().String(), err)
+		c.conn.Close()
+		c.server.conns.release(c.ip)
+		return
+	}
+
 	// Register client
 	c.server.register <- c
 
+	if certUser != "" {
+		// The CA vouches for the name, the account must exist all the same
+		if err := ValidateUsername(certUser); err != nil {
+			c.server.securityEvent(EventCertRejected, certUser, c.ip, err.Error())
+		} else if _, err := c.server.users.Get(certUser); err != nil {
+			c.server.securityEvent(EventCertRejected, certUser, c.ip, err.Error())
+		} else if c.completeLogin(certUser, "Login successful! Authenticated as "+certUser+" with a client certificate", nil) {
+			c.server.securityEvent(EventLoginSuccess, certUser, c.ip, "client certificate")
+			c.server.logger.Printf("User %s logged in with a client certificate", certUser)
+		}
+	}
+
 	// Start goroutines for reading and writing
 	go c.readPump()
 	go c.writePump()
 
 	// Send welcome message
-	c.send <- Message{
-		Sender:  "Server",
-		Content: "Welcome to the chat server! Please log in with /login username password",
-		Type:    "text",
+	if !c.IsAuthenticated() {
+		c.deliver(Message{
+			Sender:  "Server",
+			Content: "Welcome to the chat server! Please log in with /login username password or create an account with /register username password",
+			Type:    "text",
+		})
 	}
 }
 
 func (c *Client) readPump() {
 	defer func() {
+		// Keep what is needed to resume the session, then leave all rooms
+		// so nobody keeps sending to a closed connection
+		rooms := c.server.roomsOf(c)
+		if c.IsAuthenticated() {
+			c.suspend(rooms)
+		}
+		for _, room := range rooms {
+			room.RemoveClient(c)
+		}
+		abortClientTransfers(c)
+		if c.IsAuthenticated() && c.server.removeSession(c) == 0 {
+			c.server.recordLastSeen(c.Username())
+		}
 		c.server.unregister <- c
-		c.conn.Close()
+		// writePump closes the connection, after flushing if the client was kicked
+		c.disconnect()
+		c.server.conns.release(c.ip)
 	}()
 
-	reader := bufio.NewReader(c.conn)
+	// The buffer size bounds the length of a line
+	reader := bufio.NewReaderSize(c.conn, c.server.limits.maxLineLength)
+	firstLine := true
 
 	for {
-		message, err := reader.ReadString('\n')
+		// Binary file frames may be interleaved with text lines, and carry
+		// no more than a line may
+		if c.binaryFiles.Load() && IsBinaryFrame(reader) {
+			frame, err := readFileFrame(reader, c.server.limits.maxLineLength)
+			if err != nil {
+				fmt.Println("Error reading binary frame from client:", err)
+				break
+			}
+			// From a client the name in the frame is that of the receiver
+			c.handleFileChunk(Message{Target: frame.Sender, FileName: frame.FileName, FileData: frame.Data})
+			if c.kicked {
+				break
+			}
+			continue
+		}
+
+		line, err := readLine(reader)
+		if err == errLineTooLong {
+			c.violation(fmt.Sprintf("lines may be at most %d bytes", c.server.limits.maxLineLength))
+			if c.kicked {
+				break
+			}
+			continue
+		}
 		if err != nil {
 			if err != io.EOF {
 				fmt.Println("Error reading from client:", err)
@@ -71,107 +199,504 @@ func (c *Client) readPump() {
 			break
 		}
 
-		message = strings.TrimSpace(message)
-		fmt.Printf("Received from %s: %s\n", c.username, message)
-
-		// Check for JSON messages (likely file chunks)
-		if strings.HasPrefix(message, "{") && strings.HasSuffix(message, "}") {
-			var jsonMsg Message
-			if err := json.Unmarshal([]byte(message), &jsonMsg); err == nil {
-				// This is a JSON message, likely a file chunk
-				if jsonMsg.Type == "file-chunk" {
-					// Process file chunk
-					isLastChunk := false
-
-					// Check active transfers to determine if this is the last chunk
-					for _, transfer := range activeTransfers {
-						if transfer.Sender == c && transfer.Status == "accepted" {
-							// Calculate if this is potentially the last chunk
-							newSize := transfer.ReceivedSize + int64(len(jsonMsg.FileData))
-							if newSize >= transfer.FileSize {
-								isLastChunk = true
-							}
-							break
-						}
-					}
-
-					c.ProcessFileTransfer(jsonMsg.FileData, jsonMsg.FileName, isLastChunk)
-				}
+		line = strings.TrimSpace(line)
+
+		// A v2 client announces itself with a hello frame as its first line
+		if firstLine {
+			firstLine = false
+			if hello, ok := parseHello(line); ok {
+				c.negotiate(hello)
 				continue
 			}
 		}
 
-		// Handle special commands
-		if strings.HasPrefix(message, "/") {
-			c.handleCommand(message)
-			continue
+		if c.protocol.Load() == protocolV2 {
+			c.handleFrame(line)
+		} else {
+			c.handleLine(line)
 		}
+		if c.kicked {
+			break
+		}
+	}
+}
 
-		// If not authenticated, don't allow sending messages
-		if !c.authenticated {
-			// Send directly to avoid channel issues
-			response := Message{
-				Sender:  "Server",
-				Content: "You must log in first with /login username password",
-				Type:    "text",
+// negotiate picks the protocol version from the versions offered in a hello frame
+func (c *Client) negotiate(hello Hello) {
+	for _, version := range hello.Versions {
+		if version == protocolV2 {
+			var features []string
+			for _, feature := range hello.Features {
+				if feature == featureBinaryFiles {
+					features = append(features, feature)
+				}
 			}
-			c.directSend(response)
-			continue
+
+			c.protocol.Store(protocolV2)
+			c.writeFrame("hello", Hello{Version: protocolV2, Agent: "GoChatServer", Features: features})
+			// Only switch to binary frames once the client has seen the reply
+			c.binaryFiles.Store(len(features) > 0)
+			c.server.logger.Printf("Client %s negotiated protocol v%d (%s)", c.conn.RemoteAddr().String(), protocolV2, hello.Agent)
+			return
 		}
+	}
 
-		// Broadcast the message to the current room
-		c.server.broadcast <- Message{
-			Sender:   c.username,
-			RoomName: c.currentRoom,
-			Content:  message,
-			Type:     "text",
+	c.writeFrame("error", Message{
+		Sender:  "Server",
+		Content: fmt.Sprintf("Unsupported protocol versions %v, using legacy mode", hello.Versions),
+		Type:    "error",
+	})
+}
+
+// writeFrame sends a v2 control frame directly on the connection
+func (c *Client) writeFrame(frameType string, payload interface{}) {
+	data, err := encodeControlFrame(c.server.nextID(), frameType, payload)
+	if err != nil {
+		fmt.Println("Error encoding frame:", err)
+		return
+	}
+	if err := c.queueReliable(append(data, '\n')); err != nil {
+		fmt.Println("Error sending frame:", err)
+	}
+}
+
+// handleLine processes one line from a legacy (v1) client
+func (c *Client) handleLine(message string) {
+	// Check for JSON messages (likely file chunks)
+	if strings.HasPrefix(message, "{") && strings.HasSuffix(message, "}") {
+		var jsonMsg Message
+		if err := json.Unmarshal([]byte(message), &jsonMsg); err == nil {
+			// This is a JSON message, likely a file chunk
+			if jsonMsg.Type == "file-chunk" {
+				c.handleFileChunk(jsonMsg)
+			}
+			return
 		}
 	}
+
+	// Handle special commands
+	if strings.HasPrefix(message, "/") {
+		c.handleCommand(message)
+		return
+	}
+
+	c.handleChat(message)
 }
 
-// directSend immediately sends a message to the client without using channels
-func (c *Client) directSend(message Message) {
-	jsonMsg, err := json.Marshal(message)
+// handleFrame processes one v2 frame
+func (c *Client) handleFrame(line string) {
+	// Tolerate plain text lines typed before the handshake reply arrived
+	if !strings.HasPrefix(line, "{") {
+		c.handleLine(line)
+		return
+	}
+
+	_, message, err := decodeFrame(line)
+	if err != nil {
+		c.deliver(Message{Sender: "Server", Content: "Malformed frame", Type: "error"})
+		return
+	}
+
+	switch message.Type {
+	case "text":
+		c.handleChat(message.Content)
+	case "command":
+		c.handleCommand(message.Content)
+	case "file-chunk":
+		c.handleFileChunk(message)
+	default:
+		c.deliver(Message{Sender: "Server", Content: "Unknown frame type: " + message.Type, Type: "error"})
+	}
+}
+
+// handleFileChunk forwards a chunk of an accepted file transfer
+func (c *Client) handleFileChunk(chunk Message) {
+	// Each chunk counts as a message, and a lost one spoils the file
+	if !c.allowMessage() {
+		c.abortSentTransfer(chunk.Target, chunk.FileName, "sending too fast")
+		return
+	}
+	if !c.authenticated {
+		c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+		return
+	}
+
+	isLastChunk := completesTransfer(c, chunk.Target, chunk.FileName, len(chunk.FileData))
+	c.ProcessFileTransfer(chunk.FileData, chunk.Target, chunk.FileName, isLastChunk)
+}
+
+// handleChat posts a chat message to the client's current room
+func (c *Client) handleChat(content string) {
+	if !c.allowMessage() {
+		return
+	}
+	c.touch()
+
+	// If not authenticated, don't allow sending messages
+	if !c.authenticated {
+		response := Message{
+			Sender:  "Server",
+			Content: "You must log in first with /login username password",
+			Type:    "text",
+		}
+		c.deliver(response)
+		return
+	}
+
+	if c.muted() {
+		return
+	}
+
+	current := c.CurrentRoom()
+	if current == "" {
+		c.deliver(Message{Sender: "Server", Content: "You are not in any room, use /join roomname", Type: "text"})
+		return
+	}
+	if c.server.getRoom(current) == nil {
+		// Deleted while we were talking there
+		c.deliver(Message{Sender: "Server", Content: "Room " + current + " no longer exists, message not sent", Type: "text"})
+		c.switchAway()
+		return
+	}
+	c.post(current, content)
+}
+
+// post broadcasts a chat message to a room the client is in
+func (c *Client) post(roomName, content string) {
+	// Kicked and banned users are no longer in the room
+	if room := c.server.getRoom(roomName); room == nil || !room.HasClient(c) {
+		c.deliver(Message{Sender: "Server", Content: "You are not in " + roomName + ", use /join " + roomName, Type: "text"})
+		return
+	}
+
+	c.server.broadcast <- Message{
+		ID:       c.server.nextID(),
+		Sender:   c.username,
+		RoomName: roomName,
+		Content:  content,
+		Type:     "text",
+		Time:     time.Now().UnixMilli(),
+	}
+}
+
+// encode serializes a message for the wire in the client's protocol version
+func (c *Client) encode(message Message) ([]byte, error) {
+	if message.ID == 0 {
+		message.ID = c.server.nextID()
+	}
+	if message.Time == 0 {
+		message.Time = time.Now().UnixMilli()
+	}
+
+	var data []byte
+	var err error
+	if c.protocol.Load() == protocolV2 {
+		data, err = encodeFrame(message)
+	} else {
+		data, err = json.Marshal(message)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Add newline character for message separation
+	return append(data, '\n'), nil
+}
+
+// reliableTypes are the messages a file transfer cannot do without: the
+// answer the sender waits for and the end of the receiver's download. A file
+// request is an invitation like any other message and may be dropped.
+var reliableTypes = map[string]bool{
+	"file-accepted": true,
+	"file-rejected": true,
+	"file-complete": true,
+	"file-aborted":  true,
+}
+
+// deliver queues a message for the client. Chat messages may be dropped if
+// the client does not keep up, reliableTypes are never dropped. Neither
+// waits, so a slow recipient cannot hold up the client delivering to it.
+func (c *Client) deliver(message Message) {
+	data, err := c.encode(message)
 	if err != nil {
 		fmt.Println("Error marshaling message:", err)
 		return
 	}
 
-	jsonMsg = append(jsonMsg, '\n')
+	if message.Type == "session" {
+		// The token is a credential
+		fmt.Printf("Sending session token to %s\n", c.Username())
+	} else {
+		fmt.Printf("Sending to %s: %s\n", c.Username(), string(data))
+	}
+
+	if reliableTypes[message.Type] {
+		if err := c.send.pushControl(data); err != nil {
+			c.server.logger.Printf("Could not queue %s message for %s: %v", message.Type, c.Username(), err)
+		}
+		return
+	}
+	c.queue(data)
+}
 
-	fmt.Printf("Direct sending to %s: %s\n", c.username, string(jsonMsg))
-	_, err = c.conn.Write(jsonMsg)
+// queue adds an encoded frame to the send queue, applying the slow consumer
+// policy when it is full
+func (c *Client) queue(data []byte) {
+	missed, err := c.send.push(data, c.server.slowConsumerPolicy)
 	if err != nil {
-		fmt.Println("Error direct sending message:", err)
+		c.server.metrics.slowConsumers.Add(1)
+		c.server.metrics.slowConsumerKicks.Add(1)
+		c.server.logger.Printf("Disconnecting slow client %s: %v", c.Username(), err)
+		c.revokeResume()
+		c.disconnect()
+		return
+	}
+	if missed > 0 {
+		c.server.metrics.messagesDropped.Add(1)
+		if missed == 1 {
+			c.server.metrics.slowConsumers.Add(1)
+			c.server.logger.Printf("Client %s is not keeping up, dropping messages (%s)", c.Username(), c.server.slowConsumerPolicy)
+		}
 	}
 }
 
+// queueReliable adds a frame that must not be dropped, waiting for room in
+// the send queue for up to the write timeout
+func (c *Client) queueReliable(data []byte) error {
+	return c.send.pushReliable(data, c.server.writeTimeout)
+}
+
+// disconnect stops sending to the client and closes its connection
+func (c *Client) disconnect() {
+	c.send.close(false)
+}
+
+// kick closes the connection once the messages already queued, such as the
+// reason for the kick, have been written. The session cannot be resumed.
+func (c *Client) kick() {
+	c.kicked = true
+	c.revokeResume()
+	c.send.close(true)
+}
+
+// writePump is the only writer of the connection. It drains the send queue
+// until the client disconnects.
 func (c *Client) writePump() {
-	defer c.conn.Close()
+	defer func() {
+		c.conn.Close()
+		close(c.writerDone)
+	}()
 
-	for message := range c.send {
-		// Convert message to JSON
-		jsonMsg, err := json.Marshal(message)
-		if err != nil {
-			log.Println("Error marshaling message:", err)
-			continue
+	for {
+		data, ok := c.send.pop()
+		if !ok {
+			return
+		}
+		if err := c.write(data); err != nil {
+			return
+		}
+
+		// Tell a lagging client what it missed once it has caught up
+		if missed := c.send.caughtUp(); missed > 0 {
+			notice, err := c.encode(Message{
+				Sender:  "Server",
+				Content: fmt.Sprintf("You were not keeping up and missed %d messages", missed),
+				Type:    "text",
+			})
+			if err == nil && c.write(notice) != nil {
+				return
+			}
+		}
+	}
+}
+
+// write sends one frame, giving up after the write timeout
+func (c *Client) write(data []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(c.server.writeTimeout))
+	_, err := c.conn.Write(data)
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			c.server.metrics.writeTimeouts.Add(1)
+			c.server.logger.Printf("Write to %s timed out, disconnecting", c.Username())
+		} else {
+			c.server.logger.Println("Error sending message to client:", err)
 		}
+		c.disconnect()
+	}
+	return err
+}
+
+// completeLogin starts a session for username, joins the default room, or
+// the rooms of the resumed session, and the rooms the user's other sessions
+// are in, and hands over the messages that arrived while the user was
+// offline. It reports false if the session limit refused the login.
+func (c *Client) completeLogin(username, greeting string, resumed *resumable) bool {
+	oldest, err := c.server.addSession(c, username)
+	if err != nil {
+		c.deliver(Message{Sender: "Server", Content: "Login refused: " + err.Error(), Type: "text"})
+		c.server.logger.Printf("Refused login of %s from %s: %v", username, c.ip, err)
+		return false
+	}
+	if oldest != nil {
+		oldest.logout(fmt.Sprintf("Logged out: %s logged in from %s and the session limit is %d", username, c.ip, c.server.maxSessions))
+		c.server.logger.Printf("Logged out the oldest session of %s to make room", username)
+	}
 
-		// Add newline character for message separation
-		jsonMsg = append(jsonMsg, '\n')
+	// The sessions staying logged in, read after the session limit was applied
+	var others []*Client
+	for _, session := range c.server.sessionsOf(username) {
+		if session != c && session != oldest {
+			others = append(others, session)
+		}
+	}
 
-		fmt.Printf("Sending to client %s: %s\n", c.username, string(jsonMsg))
+	// Share the presence of the sessions already logged in
+	presence, reason, auto := PresenceOnline, "", false
+	if len(others) > 0 {
+		others[0].mutex.Lock()
+		presence, reason, auto = others[0].presence, others[0].presenceReason, others[0].autoAway
+		others[0].mutex.Unlock()
+	}
 
-		// Send message to client
-		_, err = c.conn.Write(jsonMsg)
-		if err != nil {
-			log.Println("Error sending message to client:", err)
-			break
+	c.mutex.Lock()
+	c.username = username
+	c.authenticated = true
+	c.presence, c.presenceReason, c.autoAway = presence, reason, auto
+	c.mutex.Unlock()
+
+	// Once authenticated, new messages are delivered directly
+	mail := c.server.takeMail(username)
+
+	c.deliver(Message{Sender: "Server", Content: greeting + mailNotice(len(mail)), Type: "text"})
+	if resumed != nil {
+		c.restoreRooms(resumed)
+	} else {
+		room := c.server.getRoom(c.CurrentRoom())
+		if room.IsBanned(username) {
+			c.deliver(Message{Sender: "Server", Content: "You are banned from " + room.name + ", use /join to enter another room", Type: "text"})
+		} else {
+			room.addClient(c, func() { c.replayHistory(room) })
 		}
+	}
 
-		// Debug log for sent messages
-		log.Printf("Message sent to %s: %s", c.username, message.Content)
+	if len(others) > 0 {
+		var rooms []string
+		for _, other := range others {
+			for _, joined := range c.server.roomsOf(other) {
+				if joined.HasClient(c) {
+					continue
+				}
+				added := joined.addClient(c, func() {
+					// The other sessions have seen the history, /history pages back from here
+					_, c.historyPos[joined.name] = joined.RecentHistory(0)
+				})
+				if added {
+					rooms = append(rooms, joined.name)
+				}
+			}
+		}
+		content := fmt.Sprintf("You are also logged in from %d other session(s), see /sessions", len(others))
+		if len(rooms) > 0 {
+			content += ". They are in " + strings.Join(rooms, ", ") + ", which you joined too"
+		}
+		c.deliver(Message{Sender: "Server", Content: content, Type: "text"})
+	}
+
+	for _, message := range mail {
+		c.deliver(message)
 	}
+	c.issueResumeToken()
+	return true
+}
+
+// replayHistory sends the most recent messages of a room to a user who just joined
+func (c *Client) replayHistory(room *Room) {
+	messages, pos := room.RecentHistory(c.server.historyReplay)
+	c.historyPos[room.name] = pos
+	c.sendHistory(messages)
+}
+
+// switchRoom makes roomName, which the client is in, the target of plain chat text
+func (c *Client) switchRoom(roomName string) {
+	c.setRoom(roomName)
+	c.deliver(Message{Sender: "Server", Content: "You have switched to room: " + roomName, Type: "text"})
+}
+
+// part leaves a room. If it was the current room, the client switches to
+// another of its rooms.
+func (c *Client) part(roomName string) {
+	room := c.server.getRoom(roomName)
+	if room == nil || !room.HasClient(c) {
+		c.deliver(Message{Sender: "Server", Content: "You are not in " + roomName, Type: "text"})
+		return
+	}
+
+	room.RemoveClient(c)
+	delete(c.historyPos, roomName)
+	c.deliver(Message{Sender: "Server", Content: "You have left room: " + roomName, Type: "text"})
+	fmt.Printf("Client %s left room %s\n", c.username, roomName)
+
+	if roomName == c.CurrentRoom() {
+		c.switchAway()
+	}
+}
+
+// switchAway picks a new current room after leaving the current one,
+// preferring general
+func (c *Client) switchAway() {
+	rooms := c.server.roomsOf(c)
+	if len(rooms) == 0 {
+		c.setRoom("")
+		c.deliver(Message{Sender: "Server", Content: "You are not in any room, use /join roomname", Type: "text"})
+		return
+	}
+	next := rooms[0]
+	for _, r := range rooms {
+		if r.name == "general" {
+			next = r
+		}
+	}
+	c.switchRoom(next.name)
+}
+
+// removedFrom moves the client to another of its rooms if it was kicked or
+// banned from its current one
+func (c *Client) removedFrom(roomName string) {
+	if c.CurrentRoom() == roomName {
+		c.switchAway()
+	}
+}
+
+// sendHistory delivers past messages marked with the "history" type
+func (c *Client) sendHistory(messages []Message) {
+	for _, message := range messages {
+		message.Type = "history"
+		c.deliver(message)
+	}
+}
+
+// secretCommands take credentials as arguments, which are not logged. Each
+// maps to the number of leading arguments that are safe to log.
+var secretCommands = map[string]int{
+	"/login":    0,
+	"/register": 0,
+	"/resume":   0,
+	"/join":     1, // The room password
+	"/mode":     1,
+}
+
+// loggedCommand returns cmd as it may be logged, with any secret arguments
+// left out
+func loggedCommand(cmd string) string {
+	parts := strings.Fields(cmd)
+	if len(parts) == 0 {
+		return cmd
+	}
+	shown, ok := secretCommands[parts[0]]
+	if !ok || len(parts) <= 1+shown {
+		return cmd
+	}
+	return strings.Join(parts[:1+shown], " ") + " [redacted]"
 }
 
 func (c *Client) handleCommand(cmd string) {
@@ -180,168 +705,448 @@ func (c *Client) handleCommand(cmd string) {
 		return
 	}
 
-	fmt.Printf("Command received from %s: %s\n", c.username, cmd)
+	if !c.allowMessage() {
+		return
+	}
+	c.touch()
+
+	fmt.Printf("Command received from %s: %s\n", c.username, loggedCommand(cmd))
 
-	log.Printf("Client %s executing command: %s", c.conn.RemoteAddr().String(), cmd)
+	c.server.logger.Printf("Client %s executing command: %s", c.conn.RemoteAddr().String(), loggedCommand(cmd))
 
 	switch parts[0] {
 	case "/login":
+		if c.authenticated {
+			c.deliver(Message{Sender: "Server", Content: "You are already logged in as " + c.username, Type: "text"})
+			return
+		}
+
 		if len(parts) != 3 {
-			c.directSend(Message{Sender: "Server", Content: "Usage: /login username password", Type: "text"})
+			c.deliver(Message{Sender: "Server", Content: "Usage: /login username password", Type: "text"})
 			return
 		}
 		username, password := parts[1], parts[2]
 
-		// Try to authenticate
-		if c.server.AuthenticateUser(username, password) {
-			c.username = username
-			c.authenticated = true
-			c.directSend(Message{Sender: "Server", Content: "Login successful!", Type: "text"})
-			// Join the default room
-			c.server.rooms["general"].AddClient(c)
-			log.Printf("User %s logged in successfully", username)
-		} else {
-			// Try to register if authentication fails
-			if c.server.RegisterUser(username, password) {
-				c.username = username
-				c.authenticated = true
-				c.directSend(Message{Sender: "Server", Content: "Registered and logged in!", Type: "text"})
-				// Join the default room
-				c.server.rooms["general"].AddClient(c)
-				log.Printf("User %s registered and logged in", username)
+		if err := c.server.AuthenticateUser(username, password, c.ip); err != nil {
+			content := "Login refused: " + err.Error()
+			if err == ErrInvalidCredentials {
+				content = "Invalid credentials"
+				if left := c.server.logins.remaining(username); left > 0 && left <= 2 {
+					content += fmt.Sprintf(" (%d more failed attempts will lock the account)", left)
+				}
+			}
+			c.deliver(Message{Sender: "Server", Content: content, Type: "text"})
+			c.server.logger.Printf("Failed login attempt for user %s from %s: %v", username, c.ip, err)
+			return
+		}
+
+		if !c.completeLogin(username, "Login successful!", nil) {
+			return
+		}
+		c.server.logger.Printf("User %s logged in successfully", username)
+
+	case "/register":
+		if c.authenticated {
+			c.deliver(Message{Sender: "Server", Content: "You are already logged in as " + c.username, Type: "text"})
+			return
+		}
+
+		if len(parts) != 3 && len(parts) != 4 {
+			c.deliver(Message{Sender: "Server", Content: "Usage: /register username password [invitecode]", Type: "text"})
+			return
+		}
+		username, password := parts[1], parts[2]
+		inviteCode := ""
+		if len(parts) == 4 {
+			inviteCode = parts[3]
+		}
+
+		if err := c.server.RegisterUser(username, password, inviteCode); err != nil {
+			content := "Registration failed: " + err.Error()
+			if err == ErrUserExists {
+				content = "Registration failed: username " + username + " is already taken"
+			}
+			c.deliver(Message{Sender: "Server", Content: content, Type: "text"})
+			c.server.logger.Printf("Failed registration for user %s: %v", username, err)
+			return
+		}
+
+		if !c.completeLogin(username, "Registered and logged in!", nil) {
+			return
+		}
+		c.server.logger.Printf("User %s registered and logged in", username)
+
+	case "/invitecode":
+		if !c.authenticated {
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			return
+		}
+
+		if !c.server.IsAdmin(c.username) {
+			c.deliver(Message{Sender: "Server", Content: "Only admins can generate invite codes", Type: "text"})
+			return
+		}
+
+		code, err := c.server.GenerateInvite()
+		if err != nil {
+			c.deliver(Message{Sender: "Server", Content: "Error generating invite code", Type: "text"})
+			c.server.logger.Printf("Error generating invite code: %v", err)
+			return
+		}
+
+		c.deliver(Message{Sender: "Server", Content: "Invite code (single use, valid 24h): " + code, Type: "text"})
+		c.server.logger.Printf("Admin %s generated an invite code", c.username)
+
+	case "/security":
+		if !c.authenticated {
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			return
+		}
+
+		if !c.server.IsAdmin(c.username) {
+			c.deliver(Message{Sender: "Server", Content: "Only admins can view security events", Type: "text"})
+			return
+		}
+
+		count, filter := 20, ""
+		for _, arg := range parts[1:] {
+			if n, err := strconv.Atoi(arg); err == nil && n > 0 {
+				count = n
 			} else {
-				c.directSend(Message{Sender: "Server", Content: "Invalid credentials", Type: "text"})
-				log.Printf("Failed login attempt for user %s", username)
+				filter = arg
 			}
 		}
 
+		events := c.server.SecurityEvents(count, filter)
+		if len(events) == 0 {
+			c.deliver(Message{Sender: "Server", Content: "No security events", Type: "text"})
+			return
+		}
+		lines := make([]string, len(events))
+		for i, event := range events {
+			lines[i] = event.String()
+		}
+		c.deliver(Message{Sender: "Server", Content: "Security events:\n" + strings.Join(lines, "\n"), Type: "text"})
+
 	case "/join":
 		if !c.authenticated {
-			c.directSend(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
 			return
 		}
 
-		if len(parts) != 2 {
-			c.directSend(Message{Sender: "Server", Content: "Usage: /join roomname", Type: "text"})
+		if len(parts) != 2 && len(parts) != 3 {
+			c.deliver(Message{Sender: "Server", Content: "Usage: /join roomname [password]", Type: "text"})
 			return
 		}
 
 		roomName := parts[1]
-
-		// Create room if it doesn't exist
-		c.server.mutex.Lock()
-		if _, exists := c.server.rooms[roomName]; !exists {
-			c.server.rooms[roomName] = NewRoom(roomName)
-			fmt.Printf("Created new room: %s\n", roomName)
+		password := ""
+		if len(parts) == 3 {
+			password = parts[2]
 		}
-		c.server.mutex.Unlock()
 
-		// Leave current room
-		if c.currentRoom != "" {
-			if room, exists := c.server.rooms[c.currentRoom]; exists {
-				room.RemoveClient(c)
-				fmt.Printf("Client %s left room %s\n", c.username, c.currentRoom)
+		// Create room if it doesn't exist, owned by whoever created it. A
+		// password given for a new room protects it.
+		room, created := c.server.getOrCreateRoom(roomName, c.username)
+		if created {
+			fmt.Printf("Created new room: %s\n", roomName)
+			if password != "" {
+				room.SetMode(ModePassword, hashPassword(password, c.server.passwordIterations))
 			}
+			c.server.saveRoom(room)
+		} else if room.HasClient(c) {
+			// Already a member, just talk there from now on
+			c.switchRoom(roomName)
+			return
+		} else if !c.mayJoin(room, password) {
+			return
 		}
 
-		// Join new room
-		c.currentRoom = roomName
-		if room, exists := c.server.rooms[roomName]; exists {
-			room.AddClient(c)
-			fmt.Printf("Client %s joined room %s\n", c.username, roomName)
+		// Join the new room, staying in the others. The history is taken while
+		// joining so nothing arrives twice, and sent after the confirmation.
+		var history []Message
+		added := room.addClient(c, func() {
+			history, c.historyPos[roomName] = room.RecentHistory(c.server.historyReplay)
+		})
+		if !added {
+			c.deliver(Message{Sender: "Server", Content: "Room " + roomName + " was just deleted, try again", Type: "text"})
+			return
 		}
+		c.setRoom(roomName)
+		fmt.Printf("Client %s joined room %s\n", c.username, roomName)
 
 		// Send confirmation directly to the client
-		directMsg := Message{
+		c.deliver(Message{
 			Sender:  "Server",
 			Content: "You have joined room: " + roomName,
 			Type:    "text",
+		})
+		if topic := room.Topic(); topic != "" {
+			c.deliver(Message{Sender: "Server", RoomName: roomName, Content: "Topic: " + topic, Type: "text"})
 		}
+		c.sendHistory(history)
 
-		// Ensure the message is actually sent
-		select {
-		case c.send <- directMsg:
-			fmt.Printf("Sent room join confirmation to %s\n", c.username)
-		default:
-			fmt.Printf("Failed to send room join confirmation to %s\n", c.username)
+	case "/part":
+		if !c.authenticated {
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			return
+		}
+
+		if len(parts) > 2 {
+			c.deliver(Message{Sender: "Server", Content: "Usage: /part [roomname]", Type: "text"})
+			return
+		}
+
+		roomName := c.CurrentRoom()
+		if len(parts) == 2 {
+			roomName = parts[1]
+		}
+		c.part(roomName)
+
+	case "/switch":
+		if !c.authenticated {
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			return
+		}
+
+		if len(parts) != 2 {
+			c.deliver(Message{Sender: "Server", Content: "Usage: /switch roomname", Type: "text"})
+			return
+		}
+
+		if room := c.server.getRoom(parts[1]); room == nil || !room.HasClient(c) {
+			c.deliver(Message{Sender: "Server", Content: "You are not in " + parts[1] + ", use /join " + parts[1], Type: "text"})
+			return
+		}
+		c.switchRoom(parts[1])
+
+	case "/say":
+		if !c.authenticated {
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			return
 		}
 
+		if len(parts) < 3 {
+			c.deliver(Message{Sender: "Server", Content: "Usage: /say roomname message", Type: "text"})
+			return
+		}
+
+		if c.muted() {
+			return
+		}
+
+		c.post(parts[1], strings.Join(parts[2:], " "))
+
+	case "/history":
+		if !c.authenticated {
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			return
+		}
+
+		// Page by the replay size, or the default one if replay is disabled
+		n := c.server.historyReplay
+		if n <= 0 {
+			n = defaultHistoryReplay
+		}
+		if len(parts) > 1 {
+			var err error
+			n, err = strconv.Atoi(parts[1])
+			if err != nil || n <= 0 {
+				c.deliver(Message{Sender: "Server", Content: "Usage: /history [count]", Type: "text"})
+				return
+			}
+		}
+
+		room := c.server.getRoom(c.CurrentRoom())
+		if room == nil {
+			c.deliver(Message{Sender: "Server", Content: "Room not found", Type: "text"})
+			return
+		}
+
+		// Page further back from what the user has already seen
+		messages := room.HistoryBefore(c.historyPos[room.name], n)
+		if len(messages) == 0 {
+			c.deliver(Message{Sender: "Server", Content: "No earlier messages in " + room.name, Type: "text"})
+			return
+		}
+		c.historyPos[room.name] -= len(messages)
+		c.sendHistory(messages)
+
 	case "/rooms":
 		if !c.authenticated {
-			c.directSend(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
 			return
 		}
 
-		c.server.mutex.Lock()
 		roomList := "Available rooms:\n"
-		for name := range c.server.rooms {
-			roomList += "- " + name + "\n"
+		for _, name := range c.server.roomNames() {
+			room := c.server.getRoom(name)
+			if room == nil || !c.server.roomVisibleTo(room, c) {
+				continue
+			}
+			line := fmt.Sprintf("%s (%d users", name, room.MemberCount())
+			if mode := room.Mode(); mode != ModePublic {
+				line += ", " + mode.String()
+			}
+			line += ")"
+			if room.HasClient(c) {
+				if room.name == c.CurrentRoom() {
+					line += " [current]"
+				} else {
+					line += " [joined]"
+				}
+			}
+			if topic := room.Topic(); topic != "" {
+				line += ": " + topic
+			}
+			roomList += "- " + line + "\n"
 		}
-		c.server.mutex.Unlock()
 
 		fmt.Printf("Sending room list to client %s\n", c.username)
-		c.directSend(Message{Sender: "Server", Content: roomList, Type: "text"})
+		c.deliver(Message{Sender: "Server", Content: roomList, Type: "text"})
 
 	case "/users":
 		if !c.authenticated {
-			c.directSend(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
 			return
 		}
 
-		if c.currentRoom == "" {
-			c.directSend(Message{Sender: "Server", Content: "You are not in any room", Type: "text"})
+		current := c.CurrentRoom()
+		if current == "" {
+			c.deliver(Message{Sender: "Server", Content: "You are not in any room", Type: "text"})
 			return
 		}
 
-		room, exists := c.server.rooms[c.currentRoom]
-		if !exists {
-			c.directSend(Message{Sender: "Server", Content: "Room not found", Type: "text"})
+		room := c.server.getRoom(current)
+		if room == nil {
+			c.deliver(Message{Sender: "Server", Content: "Room not found", Type: "text"})
 			return
 		}
 
-		userList := fmt.Sprintf("Users in room %s:\n", c.currentRoom)
-
-		room.mutex.Lock()
-		for client := range room.clients {
-			userList += "- " + client.username + "\n"
+		userList := fmt.Sprintf("Users in room %s:\n", current)
+		for _, username := range room.Usernames() {
+			line := username
+			if role := room.Role(username); role != RoleMember {
+				line += " (" + role.String() + ")"
+			}
+			if client := c.server.FindClient(username); client != nil {
+				if presence, _ := client.Presence(); presence != PresenceOnline {
+					line += " [" + presence.String() + "]"
+				}
+			}
+			userList += "- " + line + "\n"
 		}
-		room.mutex.Unlock()
 
 		fmt.Printf("Sending user list to client %s\n", c.username)
-		c.directSend(Message{Sender: "Server", Content: userList, Type: "text"})
+		c.deliver(Message{Sender: "Server", Content: userList, Type: "text"})
+
+	case "/msg", "/dm":
+		if !c.authenticated {
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			return
+		}
+
+		if len(parts) < 3 {
+			c.deliver(Message{Sender: "Server", Content: "Usage: /msg username message", Type: "text"})
+			return
+		}
+
+		if c.muted() {
+			return
+		}
+
+		targetUser := parts[1]
+		text := strings.Join(parts[2:], " ")
+
+		privateMsg := Message{
+			ID:      c.server.nextID(),
+			Sender:  c.username,
+			Target:  targetUser,
+			Content: text,
+			Type:    "private",
+			Time:    time.Now().UnixMilli(),
+		}
+
+		// Deliver to the recipient's sessions, or their mailbox if they are offline
+		recipients, err := c.server.sendOrStore(targetUser, privateMsg)
+		switch {
+		case err == ErrUserNotFound:
+			c.deliver(Message{Sender: "Server", Content: "No such user: " + targetUser, Type: "text"})
+			return
+		case err == ErrMailboxFull:
+			c.deliver(Message{Sender: "Server", Content: targetUser + " is offline and their mailbox is full", Type: "text"})
+			return
+		case err != nil:
+			c.deliver(Message{Sender: "Server", Content: "Could not send message to " + targetUser, Type: "text"})
+			c.server.logger.Printf("Error sending private message to %s: %v", targetUser, err)
+			return
+		}
+
+		// Echo back to all sessions of the sender
+		if targetUser != c.username {
+			for _, session := range c.server.sessionsOf(c.username) {
+				session.deliver(privateMsg)
+			}
+		}
+		if recipients == nil {
+			c.deliver(Message{Sender: "Server", Content: targetUser + " is offline, they will get your message when they log in", Type: "text"})
+			c.server.logger.Printf("Private message from %s to %s stored until they log in", c.username, targetUser)
+			return
+		}
+		c.server.logger.Printf("Private message from %s to %s", c.username, targetUser)
 
 	case "/sendfile":
 		if !c.authenticated {
-			c.directSend(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
 			return
 		}
 
 		if len(parts) < 4 {
-			c.directSend(Message{Sender: "Server", Content: "Usage: /sendfile username filename filesize", Type: "text"})
+			c.deliver(Message{Sender: "Server", Content: "Usage: /sendfile username filename filesize", Type: "text"})
 			return
 		}
 
-		targetUser := parts[1]
+		if c.server.closing.Load() {
+			c.deliver(Message{Sender: "Server", Content: "Server is shutting down, no new file transfers", Type: "text"})
+			return
+		}
+
+		targetUser, sessionID, err := parseSessionTarget(parts[1])
+		if err != nil {
+			c.deliver(Message{Sender: "Server", Content: "Usage: /sendfile username[#session] filename filesize", Type: "text"})
+			return
+		}
 		fileName := parts[2]
 		fileSize, err := strconv.ParseInt(parts[3], 10, 64)
 		if err != nil {
-			c.directSend(Message{Sender: "Server", Content: "Invalid file size", Type: "text"})
+			c.deliver(Message{Sender: "Server", Content: "Invalid file size", Type: "text"})
 			return
 		}
 
-		// Find the target user
-		c.server.mutex.Lock()
+		// A given session, otherwise the one the user was last active in
 		var recipient *Client
-		for client := range c.server.clients {
-			if client.username == targetUser && client.authenticated {
-				recipient = client
-				break
+		if sessionID != 0 {
+			recipient = c.server.findSession(targetUser, sessionID)
+			if recipient == nil {
+				c.deliver(Message{Sender: "Server", Content: fmt.Sprintf("%s has no session #%d, see /whois %s", targetUser, sessionID, targetUser), Type: "text"})
+				return
 			}
+		} else {
+			recipient = c.server.FindClient(targetUser)
 		}
-		c.server.mutex.Unlock()
 
 		if recipient == nil {
-			c.directSend(Message{Sender: "Server", Content: "User not found or not online", Type: "text"})
+			// Files need both ends online, but the recipient hears about the attempt
+			notice := Message{
+				Sender:  "Server",
+				Content: fmt.Sprintf("%s tried to send you %s (%.2f KB) while you were offline", c.username, fileName, float64(fileSize)/1024),
+				Type:    "text",
+			}
+			if _, err := c.server.sendOrStore(targetUser, notice); err != nil {
+				c.deliver(Message{Sender: "Server", Content: "User not found or not online", Type: "text"})
+				return
+			}
+			c.deliver(Message{Sender: "Server", Content: targetUser + " is not online, they will be told you tried to send " + fileName, Type: "text"})
 			return
 		}
 
@@ -349,12 +1154,12 @@ func (c *Client) handleCommand(cmd string) {
 		transfer := InitiateFileTransfer(c, recipient, fileName, fileSize)
 
 		if transfer == nil {
-			c.directSend(Message{Sender: "Server", Content: "Error creating file transfer", Type: "text"})
+			c.deliver(Message{Sender: "Server", Content: "Error creating file transfer", Type: "text"})
 			return
 		}
 
 		// Notify recipient about incoming file
-		recipient.directSend(Message{
+		recipient.deliver(Message{
 			Sender: c.username,
 			Content: fmt.Sprintf("Incoming file: %s (%.2f KB). Type /accept %s or /reject %s",
 				fileName, float64(fileSize)/1024, c.username, c.username),
@@ -362,7 +1167,7 @@ func (c *Client) handleCommand(cmd string) {
 			FileName: fileName,
 		})
 
-		c.directSend(Message{
+		c.deliver(Message{
 			Sender:  "Server",
 			Content: "File transfer request sent. Waiting for " + targetUser + " to accept...",
 			Type:    "text",
@@ -370,24 +1175,25 @@ func (c *Client) handleCommand(cmd string) {
 
 	case "/accept":
 		if !c.authenticated {
-			c.directSend(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
 			return
 		}
 
 		var senderUsername string
 		if len(parts) < 2 {
 			// Find any pending transfer for this user
-			transferMutex.Lock()
-			for _, t := range activeTransfers {
+			transfers := c.server.transfers
+			transfers.mutex.Lock()
+			for _, t := range transfers.active {
 				if t.Receiver == c && t.Status == "pending" {
 					senderUsername = t.Sender.username
 					break
 				}
 			}
-			transferMutex.Unlock()
+			transfers.mutex.Unlock()
 
 			if senderUsername == "" {
-				c.directSend(Message{Sender: "Server", Content: "No pending file transfers. Usage: /accept username", Type: "text"})
+				c.deliver(Message{Sender: "Server", Content: "No pending file transfers. Usage: /accept username", Type: "text"})
 				return
 			}
 		} else {
@@ -398,19 +1204,266 @@ func (c *Client) handleCommand(cmd string) {
 
 	case "/reject":
 		if !c.authenticated {
-			c.directSend(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
 			return
 		}
 
 		if len(parts) < 2 {
-			c.directSend(Message{Sender: "Server", Content: "Usage: /reject username", Type: "text"})
+			c.deliver(Message{Sender: "Server", Content: "Usage: /reject username", Type: "text"})
 			return
 		}
 
 		senderUsername := parts[1]
 		c.RejectFileTransfer(senderUsername)
 
+	case "/topic", "/describe":
+		if !c.authenticated {
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			return
+		}
+
+		description := parts[0] == "/describe"
+		if len(parts) == 1 {
+			room := c.server.getRoom(c.CurrentRoom())
+			if room == nil {
+				c.deliver(Message{Sender: "Server", Content: "You are not in any room", Type: "text"})
+				return
+			}
+			text, what := room.Topic(), "topic"
+			if description {
+				text, what = room.Description(), "description"
+			}
+			if text == "" {
+				text = "(none)"
+			}
+			c.deliver(Message{Sender: "Server", Content: "The " + what + " of " + room.name + " is: " + text, Type: "text"})
+			return
+		}
+
+		// "-" clears it
+		text := strings.Join(parts[1:], " ")
+		if text == "-" {
+			text = ""
+		}
+		c.setTopic(text, description)
+
+	case "/roominfo":
+		if !c.authenticated {
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			return
+		}
+
+		roomName := c.CurrentRoom()
+		if len(parts) > 1 {
+			roomName = parts[1]
+		}
+		room := c.server.getRoom(roomName)
+		if room == nil || !c.server.roomVisibleTo(room, c) {
+			c.deliver(Message{Sender: "Server", Content: "Room not found: " + roomName, Type: "text"})
+			return
+		}
+		c.deliver(Message{Sender: "Server", Content: c.server.roomInfo(room), Type: "text"})
+
+	case "/deleteroom":
+		if !c.authenticated {
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			return
+		}
+
+		if len(parts) > 2 {
+			c.deliver(Message{Sender: "Server", Content: "Usage: /deleteroom [roomname]", Type: "text"})
+			return
+		}
+
+		roomName := c.CurrentRoom()
+		if len(parts) == 2 {
+			roomName = parts[1]
+		}
+		c.deleteRoomCommand(roomName)
+
+	case "/persist":
+		if !c.authenticated {
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			return
+		}
+
+		if len(parts) != 2 || (parts[1] != "on" && parts[1] != "off") {
+			c.deliver(Message{Sender: "Server", Content: "Usage: /persist on|off", Type: "text"})
+			return
+		}
+		c.setPersistent(parts[1] == "on")
+
+	case "/op", "/deop":
+		if !c.authenticated {
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			return
+		}
+
+		if len(parts) != 2 {
+			c.deliver(Message{Sender: "Server", Content: "Usage: " + parts[0] + " username", Type: "text"})
+			return
+		}
+
+		c.setOperator(parts[1], parts[0] == "/op")
+
+	case "/kick", "/ban":
+		if !c.authenticated {
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			return
+		}
+
+		if len(parts) < 2 {
+			c.deliver(Message{Sender: "Server", Content: "Usage: " + parts[0] + " username [reason]", Type: "text"})
+			return
+		}
+
+		reason := strings.Join(parts[2:], " ")
+		if parts[0] == "/kick" {
+			c.kickUser(parts[1], reason)
+		} else {
+			c.banUser(parts[1], reason)
+		}
+
+	case "/mode":
+		if !c.authenticated {
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			return
+		}
+
+		if len(parts) == 1 {
+			if room := c.server.getRoom(c.CurrentRoom()); room != nil {
+				c.deliver(Message{Sender: "Server", Content: room.name + " is " + room.Mode().String(), Type: "text"})
+			}
+			return
+		}
+
+		mode, err := ParseRoomMode(parts[1])
+		if err != nil || (mode == ModePassword) != (len(parts) == 3) || len(parts) > 3 {
+			c.deliver(Message{Sender: "Server", Content: "Usage: /mode public|private|invite-only|password <password>", Type: "text"})
+			return
+		}
+
+		password := ""
+		if mode == ModePassword {
+			password = parts[2]
+		}
+		c.setRoomMode(mode, password)
+
+	case "/invite":
+		if !c.authenticated {
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			return
+		}
+
+		if len(parts) != 2 {
+			c.deliver(Message{Sender: "Server", Content: "Usage: /invite username", Type: "text"})
+			return
+		}
+
+		c.inviteUser(parts[1])
+
+	case "/unban":
+		if !c.authenticated {
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			return
+		}
+
+		if len(parts) != 2 {
+			c.deliver(Message{Sender: "Server", Content: "Usage: /unban username", Type: "text"})
+			return
+		}
+
+		c.unbanUser(parts[1])
+
+	case "/sessions":
+		if !c.authenticated {
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			return
+		}
+
+		switch {
+		case len(parts) == 1:
+			c.listSessions()
+		case len(parts) == 3 && parts[1] == "logout":
+			c.logoutSessions(parts[2])
+		default:
+			c.deliver(Message{Sender: "Server", Content: "Usage: /sessions [logout #<id>|others]", Type: "text"})
+		}
+
+	case "/resume":
+		if c.authenticated {
+			c.deliver(Message{Sender: "Server", Content: "You are already logged in as " + c.username, Type: "text"})
+			return
+		}
+
+		var lastID uint64
+		var err error
+		if len(parts) == 3 {
+			lastID, err = strconv.ParseUint(parts[2], 10, 64)
+		}
+		if len(parts) < 2 || len(parts) > 3 || err != nil {
+			c.deliver(Message{Sender: "Server", Content: "Usage: /resume token [last message ID]", Type: "text"})
+			return
+		}
+		c.resumeSession(parts[1], lastID)
+
+	case "/quit":
+		c.deliver(Message{Sender: "Server", Content: "Goodbye", Type: "text"})
+		c.kick()
+
+	case "/away", "/busy":
+		if !c.authenticated {
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			return
+		}
+
+		presence := PresenceAway
+		if parts[0] == "/busy" {
+			presence = PresenceBusy
+		}
+		reason := strings.Join(parts[1:], " ")
+		if len(reason) > maxTopicLength {
+			c.deliver(Message{Sender: "Server", Content: fmt.Sprintf("Reason too long, at most %d characters", maxTopicLength), Type: "text"})
+			return
+		}
+		c.setPresence(presence, reason, false)
+		content := "You are now " + presence.String()
+		if reason != "" {
+			content += ": " + reason
+		}
+		c.deliver(Message{Sender: "Server", Content: content, Type: "text"})
+
+	case "/back":
+		if !c.authenticated {
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			return
+		}
+
+		if !c.setPresence(PresenceOnline, "", false) {
+			c.deliver(Message{Sender: "Server", Content: "You are already online", Type: "text"})
+			return
+		}
+		c.deliver(Message{Sender: "Server", Content: "You are back online", Type: "text"})
+
+	case "/whois":
+		if !c.authenticated {
+			c.deliver(Message{Sender: "Server", Content: "You must log in first", Type: "text"})
+			return
+		}
+
+		if len(parts) != 2 {
+			c.deliver(Message{Sender: "Server", Content: "Usage: /whois username", Type: "text"})
+			return
+		}
+
+		info, err := c.server.whois(c, parts[1])
+		if err != nil {
+			c.deliver(Message{Sender: "Server", Content: "No such user: " + parts[1], Type: "text"})
+			return
+		}
+		c.deliver(Message{Sender: "Server", Content: info, Type: "text"})
+
 	default:
-		c.directSend(Message{Sender: "Server", Content: "Unknown command: " + parts[0], Type: "text"})
+		c.deliver(Message{Sender: "Server", Content: "Unknown command: " + parts[0], Type: "text"})
 	}
 }
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	defaultHandshakeTimeout = 10 * time.Second
+	defaultShutdownTimeout  = 10 * time.Second
+)
+
+// Config describes how a Server listens and what it uses for storage.
+// Zero values select the defaults.
+type Config struct {
+	// Listen addresses used by Run. An empty Addr or WebSocketAddr disables
+	// that listener; TLSAddr is only used when TLSConfig is set.
+	Addr          string // Plaintext listener, e.g. ":8080"
+	TLSAddr       string
+	TLSConfig     *tls.Config
+	WebSocketAddr string // WebSocket gateway, served at /ws
+
+	// Limits
+	HistorySize   int // Messages kept per room by the default history
+	HistoryReplay int // Past messages replayed on /join, negative disables replay
+	SendQueueSize int // Outgoing messages buffered per client
+
+	// RoomIdleTimeout is how long a room may stay empty before it is
+	// deleted, unless it is "general" or marked persistent. Negative keeps
+	// empty rooms forever.
+	RoomIdleTimeout time.Duration
+
+	// AutoAwayAfter is how long a user may send nothing before being
+	// marked away. Negative disables auto-away.
+	AutoAwayAfter time.Duration
+
+	// Messages sent to offline users wait in a mailbox of at most
+	// MailboxSize messages for up to MailboxTTL
+	MailboxSize int
+	MailboxTTL  time.Duration
+
+	// MaxSessions is how many connections one user may be logged in with,
+	// negative allows any number. SessionPolicy decides what happens to a
+	// login beyond that; the default refuses it.
+	MaxSessions   int
+	SessionPolicy SessionPolicy
+
+	// ResumeGrace is how long after a dropped connection the session can be
+	// resumed with its token. Negative disables session tokens.
+	ResumeGrace time.Duration
+
+	// SlowConsumerPolicy decides what happens to a client whose send queue
+	// is full. The default is DropOldest.
+	SlowConsumerPolicy SlowConsumerPolicy
+
+	// Flood protection. Negative values disable a limit or penalty.
+	MaxConnsPerIP   int           // Concurrent connections per IP address
+	MaxLineLength   int           // Longest line accepted from a client, in bytes
+	MessageRate     float64       // Chat messages and commands per second per user, or per IP before login
+	MessageBurst    int           // Messages allowed at once before MessageRate applies
+	MuteAfter       int           // Violations before a client is muted
+	MuteDuration    time.Duration // How long a mute lasts
+	DisconnectAfter int           // Violations before a client is disconnected
+	BanAfter        int           // Flood disconnects from one IP before it is banned
+	BanDuration     time.Duration // How long an IP ban lasts
+
+	// Login protection. Every failed login for a username doubles the wait
+	// before it may try again, starting at LoginBackoff (negative disables
+	// the backoff). Negative failure counts disable that lockout.
+	LoginMaxFailures      int           // Failed logins before an account is locked
+	LoginMaxFailuresPerIP int           // Failed logins from one IP address before it is locked out
+	LoginBackoff          time.Duration // Wait after the first failed login
+	LoginLockout          time.Duration // How long a lockout lasts
+
+	// Timeouts
+	HandshakeTimeout time.Duration // TLS handshake of new connections
+	ShutdownTimeout  time.Duration // File transfer drain when a Serve context is cancelled
+	WriteTimeout     time.Duration // A client not accepting data for this long is disconnected
+
+	// Accounts
+	InviteOnly bool     // Require an invite code to /register
+	Admins     []string // Usernames allowed to run admin commands
+
+	// PasswordIterations is the PBKDF2 cost of new password hashes. Stored
+	// hashes with a lower cost are upgraded on the next successful login.
+	PasswordIterations int
+
+	// Storage
+	Users      UserStore      // Defaults to an in-memory store
+	History    HistoryFactory // Defaults to an in-memory ring buffer per room
+	MessageLog *MessageLog    // Optional on-disk persistence of room messages
+
+	Logger *log.Logger // Defaults to the standard logger
+}
+
+// NewServerWithConfig creates a server from config. Nothing listens until
+// Run or Serve is called.
+func NewServerWithConfig(config Config) *Server {
+	s := &Server{
+		addr:               config.Addr,
+		tlsAddr:            config.TLSAddr,
+		tlsConfig:          config.TLSConfig,
+		wsAddr:             config.WebSocketAddr,
+		clients:            make(map[*Client]bool),
+		sessions:           make(map[string][]*Client),
+		maxSessions:        config.MaxSessions,
+		sessionPolicy:      config.SessionPolicy,
+		rooms:              make(map[string]*Room),
+		users:              config.Users,
+		openRegistration:   !config.InviteOnly,
+		passwordIterations: config.PasswordIterations,
+		invites:            newInviteCodes(),
+		transfers:          newFileTransfers(),
+		historyFactory:     config.History,
+		historySize:        config.HistorySize,
+		historyReplay:      config.HistoryReplay,
+		roomIdleTimeout:    config.RoomIdleTimeout,
+		autoAwayAfter:      config.AutoAwayAfter,
+		messageLog:         config.MessageLog,
+		handshakeTimeout:   config.HandshakeTimeout,
+		shutdownTimeout:    config.ShutdownTimeout,
+		writeTimeout:       config.WriteTimeout,
+		sendQueueSize:      config.SendQueueSize,
+		slowConsumerPolicy: config.SlowConsumerPolicy,
+		limits:             newFloodLimits(config),
+		conns:              newConnTracker(),
+		floods:             newFloodTracker(),
+		logins:             newLoginGuard(config),
+		roomLogins:         newLoginGuard(config),
+		security:           newSecurityLog(securityEventBuffer),
+		mail:               newMailboxes(config.MailboxSize, config.MailboxTTL),
+		resume:             newResumeTokens(config.ResumeGrace),
+		logger:             config.Logger,
+		stopped:            make(chan struct{}),
+		broadcast:          make(chan Message),
+		register:           make(chan *Client),
+		unregister:         make(chan *Client),
+	}
+	s.SetAdmins(config.Admins)
+
+	if s.users == nil {
+		s.users = NewMemoryUserStore()
+	}
+	if s.passwordIterations <= 0 {
+		s.passwordIterations = DefaultPasswordIterations
+	}
+	if s.historySize <= 0 {
+		s.historySize = defaultHistorySize
+	}
+	if s.historyReplay == 0 {
+		s.historyReplay = defaultHistoryReplay
+	}
+	if s.roomIdleTimeout == 0 {
+		s.roomIdleTimeout = defaultRoomIdleTimeout
+	}
+	if s.autoAwayAfter == 0 {
+		s.autoAwayAfter = defaultAutoAwayAfter
+	}
+	if s.resume.grace == 0 {
+		s.resume.grace = defaultResumeGrace
+	}
+	if s.maxSessions == 0 {
+		s.maxSessions = defaultMaxSessions
+	}
+	if s.mail.size <= 0 {
+		s.mail.size = defaultMailboxSize
+	}
+	if s.mail.ttl <= 0 {
+		s.mail.ttl = defaultMailboxTTL
+	}
+	if s.handshakeTimeout <= 0 {
+		s.handshakeTimeout = defaultHandshakeTimeout
+	}
+	if s.shutdownTimeout <= 0 {
+		s.shutdownTimeout = defaultShutdownTimeout
+	}
+	if s.writeTimeout <= 0 {
+		s.writeTimeout = defaultWriteTimeout
+	}
+	if s.sendQueueSize <= 0 {
+		s.sendQueueSize = defaultSendQueueSize
+	}
+	if s.logger == nil {
+		s.logger = log.Default()
+	}
+	if s.messageLog != nil {
+		s.messageLog.logger = s.logger
+	}
+
+	// Seed IDs from the clock so they keep increasing across restarts while
+	// staying below 2^53 for JavaScript clients
+	s.lastID.Store(uint64(time.Now().UnixMicro()))
+	return s
+}
+
+// Addr returns the address of the first listener the server accepts
+// connections on, or nil if it is not listening yet. Useful when listening
+// on port 0.
+func (s *Server) Addr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.listeners) == 0 {
+		return nil
+	}
+	return s.listeners[0].Addr()
+}
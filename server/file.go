@@ -19,13 +19,22 @@ type FileTransfer struct {
 	ReceivedSize int64
 	Status       string // "pending", "accepted", "rejected", "complete", "failed"
 	StartTime    time.Time
+	key          string // Key in fileTransfers.active
 }
 
-// Global map to track file transfers
-var (
-	activeTransfers = make(map[string]*FileTransfer) // Key is Sender.username + "_" + Receiver.username + "_" + FileName
-	transferMutex   sync.Mutex
-)
+// fileTransfers tracks the file transfers of a server. The fields of a
+// FileTransfer that change (Status, FileSize, ReceivedSize, StartTime) are
+// guarded by mutex.
+type fileTransfers struct {
+	active map[string]*FileTransfer // Key is built by transferKey
+	mutex  sync.Mutex
+}
+
+func newFileTransfers() *fileTransfers {
+	return &fileTransfers{
+		active: make(map[string]*FileTransfer),
+	}
+}
 
 // InitiateFileTransfer sets up a new file transfer
 func InitiateFileTransfer(sender, receiver *Client, fileName string, fileSize int64) *FileTransfer {
@@ -33,13 +42,14 @@ func InitiateFileTransfer(sender, receiver *Client, fileName string, fileSize in
 		return nil
 	}
 
-	transferMutex.Lock()
-	defer transferMutex.Unlock()
+	transfers := sender.server.transfers
+	transfers.mutex.Lock()
+	defer transfers.mutex.Unlock()
 
-	key := fmt.Sprintf("%s_%s_%s", sender.username, receiver.username, fileName)
+	key := transferKey(sender, receiver, fileName)
 
 	// Check if transfer already exists
-	if existing, found := activeTransfers[key]; found {
+	if existing, found := transfers.active[key]; found {
 		if existing.Status == "pending" {
 			// Already have a pending transfer, update it
 			existing.FileSize = fileSize
@@ -47,7 +57,7 @@ func InitiateFileTransfer(sender, receiver *Client, fileName string, fileSize in
 			return existing
 		}
 		// Otherwise, clean up old transfer first
-		delete(activeTransfers, key)
+		delete(transfers.active, key)
 	}
 
 	transfer := &FileTransfer{
@@ -58,30 +68,39 @@ func InitiateFileTransfer(sender, receiver *Client, fileName string, fileSize in
 		ReceivedSize: 0,
 		Status:       "pending",
 		StartTime:    time.Now(),
+		key:          key,
 	}
 
-	activeTransfers[key] = transfer
+	transfers.active[key] = transfer
 
 	return transfer
 }
 
 // GetActiveTransfer retrieves an active transfer if it exists
 func GetActiveTransfer(sender, receiver *Client, fileName string) *FileTransfer {
-	transferMutex.Lock()
-	defer transferMutex.Unlock()
+	transfers := sender.server.transfers
+	transfers.mutex.Lock()
+	defer transfers.mutex.Unlock()
 
-	key := fmt.Sprintf("%s_%s_%s", sender.username, receiver.username, fileName)
-	return activeTransfers[key]
+	return transfers.active[transferKey(sender, receiver, fileName)]
+}
+
+// transferKey builds the fileTransfers.active key of a transfer
+func transferKey(sender, receiver *Client, fileName string) string {
+	return fmt.Sprintf("%s#%d_%s#%d_%s", sender.Username(), sender.sessionID, receiver.Username(), receiver.sessionID, fileName)
 }
 
 // UpdateTransferStatus changes the status of a transfer
 func UpdateTransferStatus(transfer *FileTransfer, status string) {
-	transferMutex.Lock()
-	defer transferMutex.Unlock()
-
-	if transfer != nil {
-		transfer.Status = status
+	if transfer == nil {
+		return
 	}
+
+	transfers := transfer.Sender.server.transfers
+	transfers.mutex.Lock()
+	defer transfers.mutex.Unlock()
+
+	transfer.Status = status
 }
 
 // RemoveTransfer removes a completed transfer
@@ -90,44 +109,44 @@ func RemoveTransfer(transfer *FileTransfer) {
 		return
 	}
 
-	transferMutex.Lock()
-	defer transferMutex.Unlock()
+	transfers := transfer.Sender.server.transfers
+	transfers.mutex.Lock()
+	defer transfers.mutex.Unlock()
 
-	key := fmt.Sprintf("%s_%s_%s",
-		transfer.Sender.username,
-		transfer.Receiver.username,
-		transfer.FileName)
-
-	delete(activeTransfers, key)
+	// Only remove it if it has not been replaced by a newer transfer
+	if transfers.active[transfer.key] == transfer {
+		delete(transfers.active, transfer.key)
+	}
 }
 
 // AcceptFileTransfer marks a transfer as accepted
 func (c *Client) AcceptFileTransfer(senderUsername string) {
+	transfers := c.server.transfers
 	// Find the pending transfer
 	var transfer *FileTransfer
 
-	transferMutex.Lock()
-	for k, t := range activeTransfers {
-		if t.Receiver == c && t.Sender.username == senderUsername && t.Status == "pending" {
+	transfers.mutex.Lock()
+	for k, t := range transfers.active {
+		if t.Receiver == c && t.Sender.Username() == senderUsername && t.Status == "pending" {
 			transfer = t
 			transfer.Status = "accepted"
 			fmt.Printf("File transfer accepted: %s\n", k) // Fixed: using k from the loop now
 			break
 		}
 	}
-	transferMutex.Unlock()
+	transfers.mutex.Unlock()
 
 	if transfer == nil {
 		// Debug: List all active transfers
 		fmt.Printf("No file transfer found for %s from %s. Active transfers:\n", c.username, senderUsername)
-		transferMutex.Lock()
-		for k, t := range activeTransfers {
+		transfers.mutex.Lock()
+		for k, t := range transfers.active {
 			fmt.Printf("- Transfer %s: sender=%s, receiver=%s, status=%s\n",
-				k, t.Sender.username, t.Receiver.username, t.Status)
+				k, t.Sender.Username(), t.Receiver.Username(), t.Status)
 		}
-		transferMutex.Unlock()
+		transfers.mutex.Unlock()
 
-		c.directSend(Message{
+		c.deliver(Message{
 			Sender:  "Server",
 			Content: "No pending file transfer from " + senderUsername,
 			Type:    "text",
@@ -136,13 +155,13 @@ func (c *Client) AcceptFileTransfer(senderUsername string) {
 	}
 
 	// Notify the sender that the transfer was accepted
-	transfer.Sender.directSend(Message{
-		Sender:  transfer.Receiver.username,
+	transfer.Sender.deliver(Message{
+		Sender:  transfer.Receiver.Username(),
 		Content: fmt.Sprintf("File transfer request for %s accepted", transfer.FileName),
 		Type:    "file-accepted",
 	})
 
-	c.directSend(Message{
+	c.deliver(Message{
 		Sender:  "Server",
 		Content: "File transfer accepted. Receiving file...",
 		Type:    "text",
@@ -151,31 +170,32 @@ func (c *Client) AcceptFileTransfer(senderUsername string) {
 
 // RejectFileTransfer marks a transfer as rejected
 func (c *Client) RejectFileTransfer(senderUsername string) {
+	transfers := c.server.transfers
 	// Find the pending transfer
 	var transfer *FileTransfer
 
-	transferMutex.Lock()
-	for k, t := range activeTransfers {
-		if t.Receiver == c && t.Sender.username == senderUsername && t.Status == "pending" {
+	transfers.mutex.Lock()
+	for k, t := range transfers.active {
+		if t.Receiver == c && t.Sender.Username() == senderUsername && t.Status == "pending" {
 			transfer = t
 			transfer.Status = "rejected"
 			fmt.Printf("File transfer rejected: %s\n", k) // Debug logging
 			break
 		}
 	}
-	transferMutex.Unlock()
+	transfers.mutex.Unlock()
 
 	if transfer == nil {
 		// Debug: List all active transfers
 		fmt.Printf("No file transfer found for %s from %s to reject. Active transfers:\n", c.username, senderUsername)
-		transferMutex.Lock()
-		for k, t := range activeTransfers {
+		transfers.mutex.Lock()
+		for k, t := range transfers.active {
 			fmt.Printf("- Transfer %s: sender=%s, receiver=%s, status=%s\n",
-				k, t.Sender.username, t.Receiver.username, t.Status)
+				k, t.Sender.Username(), t.Receiver.Username(), t.Status)
 		}
-		transferMutex.Unlock()
+		transfers.mutex.Unlock()
 
-		c.directSend(Message{
+		c.deliver(Message{
 			Sender:  "Server",
 			Content: "No pending file transfer from " + senderUsername,
 			Type:    "text",
@@ -184,39 +204,65 @@ func (c *Client) RejectFileTransfer(senderUsername string) {
 	}
 
 	// Notify the sender that the transfer was rejected
-	transfer.Sender.directSend(Message{
-		Sender:  transfer.Receiver.username,
+	transfer.Sender.deliver(Message{
+		Sender:  transfer.Receiver.Username(),
 		Content: fmt.Sprintf("File transfer request for %s rejected", transfer.FileName),
 		Type:    "file-rejected",
 	})
 
-	c.directSend(Message{
-		Sender:  "Server",
-		Content: "File transfer rejected.",
-		Type:    "text",
+	// The receiving client drops the file it had opened for the transfer
+	c.deliver(Message{
+		Sender:   transfer.Sender.Username(),
+		Content:  "File transfer rejected.",
+		Type:     "file-aborted",
+		FileName: transfer.FileName,
 	})
 
 	// Clean up
 	RemoveTransfer(transfer)
 }
 
-// ProcessFileTransfer handles file data reception
-func (c *Client) ProcessFileTransfer(data []byte, fileName string, isLastChunk bool) {
-	// First check if this is part of an active transfer
-	var transfer *FileTransfer
+// sentTransfer returns the accepted transfer of fileName from c to receiver,
+// a username with an optional #session. A chunk that does not name its
+// receiver, from an older client, only matches a file sent to one receiver.
+// transfers.mutex must be held.
+func (c *Client) sentTransfer(receiver, fileName string) *FileTransfer {
+	username, sessionID, err := parseSessionTarget(receiver)
+	if err != nil {
+		return nil
+	}
 
-	transferMutex.Lock()
-	for _, t := range activeTransfers {
-		if t.Sender == c && t.FileName == fileName && t.Status == "accepted" {
-			transfer = t
-			break
+	var found *FileTransfer
+	for _, t := range c.server.transfers.active {
+		if t.Sender != c || t.FileName != fileName || t.Status != "accepted" {
+			continue
 		}
+		if username != "" && t.Receiver.Username() != username {
+			continue
+		}
+		if sessionID != 0 && t.Receiver.sessionID != sessionID {
+			continue
+		}
+		if found != nil {
+			// Ambiguous
+			return nil
+		}
+		found = t
 	}
-	transferMutex.Unlock()
+	return found
+}
+
+// ProcessFileTransfer handles file data reception
+func (c *Client) ProcessFileTransfer(data []byte, receiver, fileName string, isLastChunk bool) {
+	transfers := c.server.transfers
+	// First check if this is part of an active transfer
+	transfers.mutex.Lock()
+	transfer := c.sentTransfer(receiver, fileName)
+	transfers.mutex.Unlock()
 
 	if transfer == nil {
 		// No active accepted transfer found
-		c.directSend(Message{
+		c.deliver(Message{
 			Sender:  "Server",
 			Content: "No active file transfer found. Recipient may not have accepted yet.",
 			Type:    "text",
@@ -224,23 +270,38 @@ func (c *Client) ProcessFileTransfer(data []byte, fileName string, isLastChunk b
 		return
 	}
 
-	// Write data to recipient
-	transfer.Receiver.directSend(Message{
-		Sender:   c.username,
-		FileName: fileName,
-		FileData: data,
-		Type:     "file-chunk",
-	})
+	// Write data to recipient, waiting if it is behind
+	if err := transfer.Receiver.sendFileChunk(c.username, fileName, data); err != nil {
+		UpdateTransferStatus(transfer, "failed")
+		RemoveTransfer(transfer)
+		if err == errSlowConsumer {
+			c.server.metrics.stalledTransfers.Add(1)
+		}
+		c.server.logger.Printf("File transfer of %s to %s failed: %v", fileName, transfer.Receiver.Username(), err)
+		transfer.Receiver.deliver(Message{
+			Sender:   c.username,
+			Content:  fmt.Sprintf("File transfer of %s failed", fileName),
+			Type:     "file-aborted",
+			FileName: fileName,
+		})
+		c.deliver(Message{
+			Sender:  "Server",
+			Content: fmt.Sprintf("File transfer of %s failed: %s is not receiving", fileName, transfer.Receiver.Username()),
+			Type:    "text",
+		})
+		return
+	}
 
 	// Update progress
-	transferMutex.Lock()
+	transfers.mutex.Lock()
 	transfer.ReceivedSize += int64(len(data))
-	progress := float64(transfer.ReceivedSize) / float64(transfer.FileSize) * 100
-	transferMutex.Unlock()
+	received, fileSize := transfer.ReceivedSize, transfer.FileSize
+	transfers.mutex.Unlock()
+	progress := float64(received) / float64(fileSize) * 100
 
 	// Notify sender of progress periodically
-	if transfer.ReceivedSize%(transfer.FileSize/10+1) == 0 || isLastChunk {
-		c.directSend(Message{
+	if received%(fileSize/10+1) == 0 || isLastChunk {
+		c.deliver(Message{
 			Sender:  "Server",
 			Content: fmt.Sprintf("Transfer progress: %.1f%%", progress),
 			Type:    "text",
@@ -248,26 +309,121 @@ func (c *Client) ProcessFileTransfer(data []byte, fileName string, isLastChunk b
 	}
 
 	// If complete, notify both parties
-	if isLastChunk || transfer.ReceivedSize >= transfer.FileSize {
+	if isLastChunk || received >= fileSize {
 		// Mark as complete
 		UpdateTransferStatus(transfer, "complete")
 
 		// Notify sender and receiver
-		c.directSend(Message{
+		c.deliver(Message{
 			Sender: "Server",
 			Content: fmt.Sprintf("File %s transferred successfully to %s",
-				fileName, transfer.Receiver.username),
+				fileName, transfer.Receiver.Username()),
 			Type: "text",
 		})
 
-		transfer.Receiver.directSend(Message{
-			Sender: "Server",
+		transfer.Receiver.deliver(Message{
+			Sender: c.username,
 			Content: fmt.Sprintf("File %s received successfully from %s",
 				fileName, c.username),
-			Type: "file-complete",
+			Type:     "file-complete",
+			FileName: fileName,
 		})
 
 		// Clean up
 		RemoveTransfer(transfer)
 	}
 }
+
+// completesTransfer reports whether n more bytes finish the accepted
+// transfer of fileName by sender to receiver
+func completesTransfer(sender *Client, receiver, fileName string, n int) bool {
+	transfers := sender.server.transfers
+	transfers.mutex.Lock()
+	defer transfers.mutex.Unlock()
+
+	if t := sender.sentTransfer(receiver, fileName); t != nil {
+		return t.ReceivedSize+int64(n) >= t.FileSize
+	}
+	return false
+}
+
+// countTransfers returns how many transfers have the given status
+func (s *Server) countTransfers(status string) int {
+	s.transfers.mutex.Lock()
+	defer s.transfers.mutex.Unlock()
+
+	count := 0
+	for _, t := range s.transfers.active {
+		if t.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// abortTransfers cancels every unfinished transfer, notifying both parties,
+// and returns how many were aborted
+func (s *Server) abortTransfers(reason string) int {
+	s.transfers.mutex.Lock()
+	var aborted []*FileTransfer
+	for key, t := range s.transfers.active {
+		if t.Status == "pending" || t.Status == "accepted" {
+			t.Status = "failed"
+			aborted = append(aborted, t)
+		}
+		delete(s.transfers.active, key)
+	}
+	s.transfers.mutex.Unlock()
+
+	for _, t := range aborted {
+		notifyAborted(t, reason)
+	}
+	return len(aborted)
+}
+
+// abortClientTransfers cancels the unfinished transfers c sends or receives,
+// for when its connection goes away
+func abortClientTransfers(c *Client) {
+	transfers := c.server.transfers
+	transfers.mutex.Lock()
+	var aborted []*FileTransfer
+	for key, t := range transfers.active {
+		if t.Sender != c && t.Receiver != c {
+			continue
+		}
+		if t.Status == "pending" || t.Status == "accepted" {
+			t.Status = "failed"
+			aborted = append(aborted, t)
+		}
+		delete(transfers.active, key)
+	}
+	transfers.mutex.Unlock()
+
+	for _, t := range aborted {
+		notifyAborted(t, c.Username()+" disconnected")
+	}
+}
+
+// abortSentTransfer cancels the accepted transfer of fileName by c to receiver
+func (c *Client) abortSentTransfer(receiver, fileName, reason string) {
+	transfers := c.server.transfers
+	transfers.mutex.Lock()
+	aborted := c.sentTransfer(receiver, fileName)
+	if aborted != nil {
+		aborted.Status = "failed"
+		delete(transfers.active, aborted.key)
+	}
+	transfers.mutex.Unlock()
+
+	if aborted != nil {
+		notifyAborted(aborted, reason)
+	}
+}
+
+// notifyAborted tells both parties that a transfer was cancelled. The
+// receiver gets a file-aborted message so it can drop the partial file.
+func notifyAborted(t *FileTransfer, reason string) {
+	content := fmt.Sprintf("File transfer of %s aborted: %s", t.FileName, reason)
+	t.Sender.deliver(Message{Sender: "Server", Content: content, Type: "text"})
+	t.Receiver.deliver(Message{Sender: t.Sender.Username(), Content: content, Type: "file-aborted", FileName: t.FileName})
+}
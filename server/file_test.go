@@ -0,0 +1,54 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestChunksGoToNamedReceiver(t *testing.T) {
+	_, addr := startServer(t, Config{Logger: testLogger()})
+	alice := loginClient(t, addr, "alice")
+	receivers := map[string]*testClient{"bob": loginClient(t, addr, "bob"), "carol": loginClient(t, addr, "carol")}
+
+	// The same file offered to both
+	for name, receiver := range receivers {
+		alice.mustSend(t, "/sendfile "+name+" notes.txt 4")
+		if _, err := receiver.waitFor("file-request", func(m Message) bool { return m.Type == "file-request" }); err != nil {
+			t.Fatal(err)
+		}
+		receiver.mustSend(t, "/accept alice")
+		if _, err := alice.waitFor("file-accepted", func(m Message) bool { return m.Type == "file-accepted" && m.Sender == name }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send := func(target, data string) {
+		t.Helper()
+		line, err := json.Marshal(Message{Type: "file-chunk", FileName: "notes.txt", FileData: []byte(data), Target: target})
+		if err != nil {
+			t.Fatal(err)
+		}
+		alice.mustSend(t, string(line))
+	}
+
+	// Without a receiver the chunk could be for either
+	send("", "????")
+	alice.mustWaitForContent(t, "No active file transfer found")
+
+	send("carol", "ccc!")
+	send("bob", "bbb!")
+	for name, receiver := range receivers {
+		var received []byte
+		_, err := receiver.waitFor("file-complete", func(m Message) bool {
+			if m.Type == "file-chunk" {
+				received = append(received, m.FileData...)
+			}
+			return m.Type == "file-complete"
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := name[:1] + name[:1] + name[:1] + "!"; string(received) != want {
+			t.Fatalf("%s received %q, want %q", name, received, want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import "sync"
+
+const (
+	defaultHistorySize   = 200 // Messages kept per room
+	defaultHistoryReplay = 20  // Messages replayed on /join
+)
+
+// History stores the past messages of a single room. Every message gets an
+// absolute position (0 for the first message ever added) so callers can page
+// backwards even while new messages arrive.
+type History interface {
+	// Add records a message. Implementations may drop the oldest entries.
+	Add(message Message)
+	// Before returns up to n messages positioned before pos, oldest first
+	Before(pos, n int) []Message
+	// Total returns the number of messages ever added, i.e. the next position
+	Total() int
+}
+
+// HistoryFactory creates the history backend for a newly created room
+type HistoryFactory func(roomName string) History
+
+// RingHistory keeps the last messages of a room in a fixed-size ring buffer
+type RingHistory struct {
+	messages []Message
+	start    int // Index of the oldest message
+	count    int
+	total    int
+	mutex    sync.Mutex
+}
+
+func NewRingHistory(size int) *RingHistory {
+	if size <= 0 {
+		size = defaultHistorySize
+	}
+	return &RingHistory{
+		messages: make([]Message, size),
+	}
+}
+
+func (h *RingHistory) Add(message Message) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.total++
+	if h.count < len(h.messages) {
+		h.messages[(h.start+h.count)%len(h.messages)] = message
+		h.count++
+		return
+	}
+
+	// Buffer is full, overwrite the oldest message
+	h.messages[h.start] = message
+	h.start = (h.start + 1) % len(h.messages)
+}
+
+func (h *RingHistory) Before(pos, n int) []Message {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// Translate absolute positions to offsets in the buffer
+	oldest := h.total - h.count
+	end := pos - oldest
+	if end > h.count {
+		end = h.count
+	}
+	if end <= 0 || n <= 0 {
+		return nil
+	}
+	begin := end - n
+	if begin < 0 {
+		begin = 0
+	}
+
+	result := make([]Message, 0, end-begin)
+	for i := begin; i < end; i++ {
+		result = append(result, h.messages[(h.start+i)%len(h.messages)])
+	}
+	return result
+}
+
+func (h *RingHistory) Total() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.total
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+const inviteTTL = 24 * time.Hour
+
+var (
+	ErrRegistrationClosed = errors.New("registration is closed, an invite code is required")
+	ErrInvalidInvite      = errors.New("invalid or expired invite code")
+)
+
+// inviteCodes holds single-use registration codes generated by admins
+type inviteCodes struct {
+	codes map[string]time.Time // code -> expiry
+	mutex sync.Mutex
+}
+
+func newInviteCodes() *inviteCodes {
+	return &inviteCodes{
+		codes: make(map[string]time.Time),
+	}
+}
+
+// Generate creates a new invite code valid for inviteTTL
+func (i *inviteCodes) Generate() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	code := hex.EncodeToString(buf)
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.codes[code] = time.Now().Add(inviteTTL)
+	return code, nil
+}
+
+// Consume removes the code and reports whether it was valid
+func (i *inviteCodes) Consume(code string) bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	// Drop expired codes while we hold the lock
+	now := time.Now()
+	for c, expiry := range i.codes {
+		if now.After(expiry) {
+			delete(i.codes, c)
+		}
+	}
+
+	if _, ok := i.codes[code]; !ok {
+		return false
+	}
+	delete(i.codes, code)
+	return true
+}
+
+// Restore puts back a code whose registration failed for another reason
+func (i *inviteCodes) Restore(code string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.codes[code] = time.Now().Add(inviteTTL)
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRoomIdleTimeout = 24 * time.Hour
+
+	// Longest topic or description accepted
+	maxTopicLength = 300
+)
+
+// Topic returns the room's topic
+func (r *Room) Topic() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.topic
+}
+
+// SetTopic changes the room's topic, empty clears it
+func (r *Room) SetTopic(topic string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.topic = topic
+}
+
+// Description returns the room's description
+func (r *Room) Description() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.description
+}
+
+// SetDescription changes the room's description, empty clears it
+func (r *Room) SetDescription(description string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.description = description
+}
+
+// Created returns when the room was created, zero if unknown
+func (r *Room) Created() time.Time {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.created
+}
+
+// Persistent reports whether the room is kept while empty
+func (r *Room) Persistent() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.persistent
+}
+
+// SetPersistent controls whether the room is kept while empty
+func (r *Room) SetPersistent(persistent bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.persistent = persistent
+}
+
+// MemberCount returns the number of users in the room
+func (r *Room) MemberCount() int {
+	return len(r.Usernames())
+}
+
+// expire marks the room deleted if it is empty, not persistent and has been
+// idle for longer than timeout, and reports whether it did
+func (r *Room) expire(timeout time.Duration) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.persistent || len(r.clients) > 0 || time.Since(r.lastActive) < timeout {
+		return false
+	}
+	r.deleted = true
+	return true
+}
+
+// close marks the room deleted and removes everyone, returning the clients
+// that were in it
+func (r *Room) close() []*Client {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.deleted = true
+	clients := make([]*Client, 0, len(r.clients))
+	for client := range r.clients {
+		clients = append(clients, client)
+		delete(r.clients, client)
+	}
+	return clients
+}
+
+// deleteRoom removes room and its message log, telling everyone in it
+// notice and moving them to another of their rooms. It reports false if the
+// room was already gone.
+func (s *Server) deleteRoom(room *Room, notice string) bool {
+	s.mutex.Lock()
+	if s.rooms[room.name] != room {
+		s.mutex.Unlock()
+		return false
+	}
+	delete(s.rooms, room.name)
+	s.mutex.Unlock()
+
+	for _, client := range room.close() {
+		client.deliver(Message{Sender: "Server", Content: notice, Type: "text"})
+		client.removedFrom(room.name)
+	}
+	s.dropRoomLog(room.name)
+	return true
+}
+
+// dropRoomLog deletes the messages and state of a room from the message log
+func (s *Server) dropRoomLog(name string) {
+	if s.messageLog == nil {
+		return
+	}
+	if err := s.messageLog.DeleteRoom(name); err != nil {
+		s.logger.Printf("Error deleting room %s from the message log: %v", name, err)
+	}
+}
+
+// expireRooms deletes the rooms that have been empty for longer than the idle timeout
+func (s *Server) expireRooms() {
+	var expired []string
+	s.mutex.Lock()
+	for name, room := range s.rooms {
+		if name != "general" && room.expire(s.roomIdleTimeout) {
+			delete(s.rooms, name)
+			expired = append(expired, name)
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, name := range expired {
+		s.dropRoomLog(name)
+		s.logger.Printf("Room %s expired after being empty for %v", name, s.roomIdleTimeout)
+	}
+}
+
+// expireRoomsLoop periodically expires idle rooms until the server shuts down
+func (s *Server) expireRoomsLoop() {
+	interval := s.roomIdleTimeout / 4
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if s.closing.Load() {
+				return
+			}
+			s.expireRooms()
+		case <-s.stopped:
+			return
+		}
+	}
+}
+
+// roomInfo describes a room for /roominfo
+func (s *Server) roomInfo(room *Room) string {
+	var info strings.Builder
+	fmt.Fprintf(&info, "Room %s (%s)\n", room.name, room.Mode())
+	if topic := room.Topic(); topic != "" {
+		fmt.Fprintf(&info, "Topic: %s\n", topic)
+	}
+	if description := room.Description(); description != "" {
+		fmt.Fprintf(&info, "Description: %s\n", description)
+	}
+	owner := room.Owner()
+	if owner == "" {
+		owner = "the server"
+	}
+	fmt.Fprintf(&info, "Created by: %s\n", owner)
+	if created := room.Created(); !created.IsZero() {
+		fmt.Fprintf(&info, "Created: %s\n", created.Format("2006-01-02 15:04"))
+	}
+	fmt.Fprintf(&info, "Members: %d\n", room.MemberCount())
+	if room.name == "general" || room.Persistent() {
+		info.WriteString("Kept while empty\n")
+	} else if s.roomIdleTimeout > 0 {
+		fmt.Fprintf(&info, "Deleted after being empty for %v\n", s.roomIdleTimeout)
+	}
+	return info.String()
+}
+
+// setTopic changes the topic or description of the client's current room
+func (c *Client) setTopic(text string, description bool) {
+	room := c.moderatedRoom(PermSetTopic)
+	if room == nil {
+		return
+	}
+	if len(text) > maxTopicLength {
+		c.deliver(Message{Sender: "Server", Content: fmt.Sprintf("Too long, at most %d characters", maxTopicLength), Type: "text"})
+		return
+	}
+
+	what := "topic"
+	if description {
+		what = "description"
+		room.SetDescription(text)
+	} else {
+		room.SetTopic(text)
+	}
+	c.server.saveRoom(room)
+
+	if text == "" {
+		room.Announce(c.username + " cleared the " + what)
+	} else {
+		room.Announce(c.username + " changed the " + what + " to: " + text)
+	}
+}
+
+// setPersistent controls whether the client's current room is kept while empty
+func (c *Client) setPersistent(persistent bool) {
+	room := c.moderatedRoom(PermDeleteRoom)
+	if room == nil {
+		return
+	}
+
+	room.SetPersistent(persistent)
+	c.server.saveRoom(room)
+
+	content := room.name + " is kept while empty"
+	if !persistent {
+		content = room.name + " is deleted once it has been empty for a while"
+	}
+	c.deliver(Message{Sender: "Server", Content: content, Type: "text"})
+}
+
+// deleteRoomCommand deletes a room the client owns
+func (c *Client) deleteRoomCommand(roomName string) {
+	room := c.server.getRoom(roomName)
+	if room == nil {
+		c.deliver(Message{Sender: "Server", Content: "Room not found: " + roomName, Type: "text"})
+		return
+	}
+	if roomName == "general" {
+		c.deliver(Message{Sender: "Server", Content: "general cannot be deleted", Type: "text"})
+		return
+	}
+	if !c.server.roomRole(room, c.username).Can(PermDeleteRoom) {
+		c.deliver(Message{Sender: "Server", Content: "You do not have permission to do that in " + roomName, Type: "text"})
+		return
+	}
+
+	member := room.HasClient(c)
+	if !c.server.deleteRoom(room, "Room "+roomName+" was deleted by "+c.username) {
+		c.deliver(Message{Sender: "Server", Content: "Room not found: " + roomName, Type: "text"})
+		return
+	}
+	if !member {
+		c.deliver(Message{Sender: "Server", Content: "Deleted room " + roomName, Type: "text"})
+	}
+	c.server.logger.Printf("%s deleted room %s", c.username, roomName)
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoomExpiry(t *testing.T) {
+	s := NewServerWithConfig(Config{RoomIdleTimeout: time.Minute, Logger: testLogger()})
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	client := NewClient(conn, s)
+	client.username, client.authenticated = "alice", true
+
+	rooms := make(map[string]*Room)
+	for _, name := range []string{"general", "idle", "occupied", "kept", "recent"} {
+		rooms[name], _ = s.getOrCreateRoom(name, "alice")
+	}
+	rooms["occupied"].AddClient(client)
+	rooms["kept"].SetPersistent(true)
+	for name, room := range rooms {
+		if name != "recent" {
+			room.lastActive = time.Now().Add(-2 * time.Minute)
+		}
+	}
+
+	s.expireRooms()
+	for name, room := range rooms {
+		want := name != "idle"
+		if got := s.getRoom(name) != nil; got != want {
+			t.Errorf("room %s kept = %v, want %v", name, got, want)
+		}
+		// Nobody can join a room on its way out
+		if !want && room.AddClient(client) {
+			t.Errorf("joined %s after it expired", name)
+		}
+	}
+
+	// Once empty the room starts its wait over
+	rooms["occupied"].RemoveClient(client)
+	s.expireRooms()
+	if s.getRoom("occupied") == nil {
+		t.Fatal("room expired as soon as it was left")
+	}
+}
+
+func TestDeleteRoom(t *testing.T) {
+	s, addr := startServer(t, Config{Logger: testLogger()})
+	alice := loginClient(t, addr, "alice")
+	bob := loginClient(t, addr, "bob")
+	for _, c := range []*testClient{alice, bob} {
+		c.mustSend(t, "/join den")
+		c.mustWaitForContent(t, "You have joined room: den")
+	}
+
+	bob.mustSend(t, "/deleteroom den")
+	bob.mustWaitForContent(t, "You do not have permission to do that in den")
+	alice.mustSend(t, "/deleteroom general")
+	alice.mustWaitForContent(t, "general cannot be deleted")
+
+	alice.mustSend(t, "/deleteroom")
+	for _, c := range []*testClient{alice, bob} {
+		c.mustWaitForContent(t, "Room den was deleted by alice")
+		c.mustWaitForContent(t, "You have switched to room: general")
+	}
+	if s.getRoom("den") != nil {
+		t.Fatal("den still exists")
+	}
+
+	// Plain text goes to general now
+	bob.mustSend(t, "still here")
+	message, err := bob.waitFor("bob's message", func(m Message) bool { return m.Sender == "bob" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.RoomName != "general" {
+		t.Fatalf("bob's message went to %q", message.RoomName)
+	}
+	alice.mustSend(t, "/rooms")
+	if list := alice.mustWaitForContent(t, "Available rooms"); strings.Contains(list.Content, "den") {
+		t.Fatalf("deleted room still listed:\n%s", list.Content)
+	}
+	alice.mustSend(t, "/deleteroom den")
+	alice.mustWaitForContent(t, "Room not found: den")
+}
@@ -0,0 +1,406 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxConnsPerIP   = 10
+	defaultMaxLineLength   = 64 * 1024
+	defaultMessageRate     = 5
+	defaultMessageBurst    = 20
+	defaultMuteAfter       = 3
+	defaultMuteDuration    = 30 * time.Second
+	defaultDisconnectAfter = 6
+	defaultBanAfter        = 3
+	defaultBanDuration     = 10 * time.Minute
+
+	// A client that behaves for this long starts over with a clean record
+	violationDecay = 5 * time.Minute
+	// Flood disconnects older than this do not count towards a ban
+	banWindow = 10 * time.Minute
+)
+
+var (
+	errLineTooLong        = errors.New("line too long")
+	errTooManyConnections = errors.New("too many connections from your address")
+	errAddressBanned      = errors.New("your address is temporarily banned")
+)
+
+// floodLimits holds the flood protection settings of a server
+type floodLimits struct {
+	maxConnsPerIP   int
+	maxLineLength   int
+	messageRate     float64
+	messageBurst    int
+	muteAfter       int
+	muteDuration    time.Duration
+	disconnectAfter int
+	banAfter        int
+	banDuration     time.Duration
+}
+
+// newFloodLimits takes the settings from config, filling in defaults
+func newFloodLimits(config Config) floodLimits {
+	limits := floodLimits{
+		maxConnsPerIP:   config.MaxConnsPerIP,
+		maxLineLength:   config.MaxLineLength,
+		messageRate:     config.MessageRate,
+		messageBurst:    config.MessageBurst,
+		muteAfter:       config.MuteAfter,
+		muteDuration:    config.MuteDuration,
+		disconnectAfter: config.DisconnectAfter,
+		banAfter:        config.BanAfter,
+		banDuration:     config.BanDuration,
+	}
+	if limits.maxConnsPerIP == 0 {
+		limits.maxConnsPerIP = defaultMaxConnsPerIP
+	}
+	if limits.maxLineLength <= 0 {
+		limits.maxLineLength = defaultMaxLineLength
+	}
+	if limits.messageRate == 0 {
+		limits.messageRate = defaultMessageRate
+	}
+	if limits.messageBurst <= 0 {
+		limits.messageBurst = defaultMessageBurst
+	}
+	if limits.muteAfter == 0 {
+		limits.muteAfter = defaultMuteAfter
+	}
+	if limits.muteDuration <= 0 {
+		limits.muteDuration = defaultMuteDuration
+	}
+	if limits.disconnectAfter == 0 {
+		limits.disconnectAfter = defaultDisconnectAfter
+	}
+	if limits.banAfter == 0 {
+		limits.banAfter = defaultBanAfter
+	}
+	if limits.banDuration <= 0 {
+		limits.banDuration = defaultBanDuration
+	}
+	return limits
+}
+
+// connTracker counts open connections per IP address and keeps temporary bans
+type connTracker struct {
+	mutex  sync.Mutex
+	open   map[string]int
+	kicks  map[string][]time.Time // Recent flood disconnects
+	banned map[string]time.Time   // Banned until
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		open:   make(map[string]int),
+		kicks:  make(map[string][]time.Time),
+		banned: make(map[string]time.Time),
+	}
+}
+
+// acquire reserves a connection slot for ip. A negative max means no limit.
+func (t *connTracker) acquire(ip string, max int) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if until, ok := t.banned[ip]; ok {
+		if time.Now().Before(until) {
+			return errAddressBanned
+		}
+		delete(t.banned, ip)
+	}
+	if max > 0 && t.open[ip] >= max {
+		return errTooManyConnections
+	}
+	t.open[ip]++
+	return nil
+}
+
+// release frees a slot reserved with acquire
+func (t *connTracker) release(ip string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.open[ip] <= 1 {
+		delete(t.open, ip)
+	} else {
+		t.open[ip]--
+	}
+}
+
+// recordKick notes a flood disconnect from ip and bans it once it has been
+// kicked banAfter times within banWindow. It reports whether ip was banned.
+func (t *connTracker) recordKick(ip string, banAfter int, banDuration time.Duration) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	recent := t.kicks[ip][:0]
+	for _, kick := range t.kicks[ip] {
+		if now.Sub(kick) < banWindow {
+			recent = append(recent, kick)
+		}
+	}
+	recent = append(recent, now)
+
+	if banAfter > 0 && len(recent) >= banAfter {
+		delete(t.kicks, ip)
+		t.banned[ip] = now.Add(banDuration)
+		return true
+	}
+	t.kicks[ip] = recent
+	return false
+}
+
+// remoteIP returns the IP address of a connection's peer
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// admit reserves a connection slot for conn, or tells the peer why it is
+// refused and closes the connection
+func (s *Server) admit(conn net.Conn) bool {
+	ip := remoteIP(conn.RemoteAddr())
+	err := s.conns.acquire(ip, s.limits.maxConnsPerIP)
+	if err == nil {
+		return true
+	}
+
+	s.securityEvent(EventConnectionRefused, "", ip, err.Error())
+	go func() {
+		// The protocol is not negotiated yet, legacy JSON is understood by all clients
+		data, _ := json.Marshal(Message{Sender: "Server", Content: "Connection refused: " + err.Error(), Type: "error"})
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		conn.Write(append(data, '\n'))
+		conn.Close()
+	}()
+	return false
+}
+
+// tokenBucket limits the rate of messages. It is guarded by the floodState
+// holding it.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token if one is available
+func (b *tokenBucket) allow(rate float64, burst int) bool {
+	if rate < 0 {
+		return true
+	}
+
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// floodState is the flood record of a user, or of an address before login.
+// All connections of the user share it, so reconnecting or opening another
+// session does not bring a full bucket or a clean record.
+type floodState struct {
+	mutex         sync.Mutex
+	bucket        tokenBucket
+	violations    int
+	lastViolation time.Time
+	mutedUntil    time.Time
+	lastUsed      time.Time
+}
+
+// allow takes a token from the bucket if one is available
+func (f *floodState) allow(rate float64, burst int) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.lastUsed = time.Now()
+	return f.bucket.allow(rate, burst)
+}
+
+// record counts a violation and returns how many there have been, starting
+// over after violationDecay without one
+func (f *floodState) record() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(f.lastViolation) > violationDecay {
+		f.violations = 0
+	}
+	f.violations++
+	f.lastViolation = now
+	f.lastUsed = now
+	return f.violations
+}
+
+// mute mutes for d unless already muted, reporting whether it did
+func (f *floodState) mute(d time.Duration) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	now := time.Now()
+	if now.Before(f.mutedUntil) {
+		return false
+	}
+	f.mutedUntil = now.Add(d)
+	return true
+}
+
+// mutedFor returns how long the mute has left to run
+func (f *floodState) mutedFor() time.Duration {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return time.Until(f.mutedUntil)
+}
+
+// idle reports whether the state has nothing left to remember: unused for
+// violationDecay, by when the bucket is full again, and not muted
+func (f *floodState) idle(now time.Time) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return now.Sub(f.lastUsed) > violationDecay && now.After(f.mutedUntil)
+}
+
+// floodTracker keeps the flood state of each user and address
+type floodTracker struct {
+	mutex     sync.Mutex
+	states    map[string]*floodState
+	lastSweep time.Time
+}
+
+func newFloodTracker() *floodTracker {
+	return &floodTracker{states: make(map[string]*floodState), lastSweep: time.Now()}
+}
+
+// get returns the state kept under key, creating it on first use. Idle
+// states are forgotten every violationDecay.
+func (t *floodTracker) get(key string) *floodState {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(t.lastSweep) > violationDecay {
+		for k, state := range t.states {
+			if state.idle(now) {
+				delete(t.states, k)
+			}
+		}
+		t.lastSweep = now
+	}
+
+	state, ok := t.states[key]
+	if !ok {
+		state = &floodState{lastUsed: now}
+		t.states[key] = state
+	}
+	return state
+}
+
+// readLine reads one line from reader, whose buffer size is the longest
+// line accepted. Longer lines are skipped and reported with errLineTooLong.
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadSlice('\n')
+	if err != bufio.ErrBufferFull {
+		return string(line), err
+	}
+
+	// Discard the rest of the line
+	for err == bufio.ErrBufferFull {
+		_, err = reader.ReadSlice('\n')
+	}
+	if err != nil {
+		return "", err
+	}
+	return "", errLineTooLong
+}
+
+// flood returns the flood state the client answers to: its user's once
+// logged in and its address's before
+func (c *Client) flood() *floodState {
+	if c.authenticated {
+		return c.server.floods.get("user:" + c.username)
+	}
+	return c.server.floods.get("ip:" + c.ip)
+}
+
+// allowMessage applies the rate limit to a chat message or command. It
+// reports false if the message must be dropped.
+func (c *Client) allowMessage() bool {
+	limits := c.server.limits
+	if c.flood().allow(limits.messageRate, limits.messageBurst) {
+		return true
+	}
+	c.violation("you are sending messages too fast")
+	return false
+}
+
+// muted reports whether the client may not post, telling it so
+func (c *Client) muted() bool {
+	remaining := c.flood().mutedFor()
+	if remaining <= 0 {
+		return false
+	}
+	c.deliver(Message{
+		Sender:  "Server",
+		Content: fmt.Sprintf("You are muted for another %ds", int(remaining.Seconds()+0.5)),
+		Type:    "text",
+	})
+	return true
+}
+
+// violation escalates the penalty for a client breaking the flood limits:
+// a warning first, then a mute, then disconnection, and an IP ban for
+// addresses that keep getting disconnected
+func (c *Client) violation(reason string) {
+	limits := c.server.limits
+	state := c.flood()
+	violations := state.record()
+
+	switch {
+	case limits.disconnectAfter > 0 && violations >= limits.disconnectAfter:
+		c.server.securityEvent(EventFloodDisconnect, c.username, c.ip, reason)
+		content := "Disconnected for flooding: " + reason
+		if c.server.conns.recordKick(c.ip, limits.banAfter, limits.banDuration) {
+			c.server.securityEvent(EventAddressBanned, "", c.ip, fmt.Sprintf("banned for %v", limits.banDuration))
+			content += fmt.Sprintf(". Your address is banned for %v", limits.banDuration)
+		}
+		c.deliver(Message{Sender: "Server", Content: content, Type: "error"})
+		c.kick()
+
+	case limits.muteAfter > 0 && violations >= limits.muteAfter:
+		if !state.mute(limits.muteDuration) {
+			return
+		}
+		c.server.securityEvent(EventFloodMute, c.username, c.ip, fmt.Sprintf("muted for %v: %s", limits.muteDuration, reason))
+		c.deliver(Message{
+			Sender:  "Server",
+			Content: fmt.Sprintf("You are muted for %v: %s", limits.muteDuration, reason),
+			Type:    "text",
+		})
+
+	case violations == 1:
+		c.deliver(Message{Sender: "Server", Content: "Warning: " + reason, Type: "text"})
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFloodStateKeys(t *testing.T) {
+	s := NewServerWithConfig(Config{Logger: testLogger()})
+	newClient := func() *Client {
+		conn, peer := net.Pipe()
+		t.Cleanup(func() { conn.Close(); peer.Close() })
+		return NewClient(conn, s)
+	}
+	a, b := newClient(), newClient()
+
+	// Before login, connections from one address share a record
+	if a.flood() != b.flood() {
+		t.Fatal("connections from the same address have separate flood state")
+	}
+
+	// After it, the record is the user's
+	a.username, a.authenticated = "alice", true
+	if a.flood() == b.flood() {
+		t.Fatal("alice shares flood state with a connection that is not logged in")
+	}
+	b.username, b.authenticated = "alice", true
+	if a.flood() != b.flood() {
+		t.Fatal("two sessions of alice have separate flood state")
+	}
+	b.username = "bob"
+	if a.flood() == b.flood() {
+		t.Fatal("alice and bob share flood state")
+	}
+}
+
+func TestFloodMuteFollowsUser(t *testing.T) {
+	_, addr := startServer(t, Config{
+		MessageRate:     10,
+		MessageBurst:    3,
+		MuteAfter:       1,
+		MuteDuration:    time.Minute,
+		DisconnectAfter: -1,
+		Logger:          testLogger(),
+	})
+
+	first := loginClient(t, addr, "alice")
+	for _, line := range []string{"one", "two", "three", "four"} {
+		first.mustSend(t, line)
+	}
+	first.mustWaitForContent(t, "You are muted for 1m0s")
+
+	// Let the bucket refill so only the mute stops the next messages
+	time.Sleep(300 * time.Millisecond)
+
+	// Another session of the same user is muted too
+	second := dialClient(t, addr)
+	second.mustSend(t, "/login alice password1")
+	second.mustWaitForContent(t, "Login successful!")
+	second.mustSend(t, "hello")
+	second.mustWaitForContent(t, "You are muted for another")
+
+	// And so is a new connection after both are gone
+	first.conn.Close()
+	second.conn.Close()
+	third := dialClient(t, addr)
+	third.mustSend(t, "/login alice password1")
+	third.mustWaitForContent(t, "Login successful!")
+	third.mustSend(t, "hello")
+	third.mustWaitForContent(t, "You are muted for another")
+
+	// Other users from the same address are not
+	bob := loginClient(t, addr, "bob")
+	bob.mustSend(t, "hello from bob")
+	if _, err := bob.waitFor("bob's message", func(m Message) bool {
+		return m.Sender == "bob" && m.Content == "hello from bob"
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBinaryFrameLimits(t *testing.T) {
+	_, addr := startServer(t, Config{
+		MaxLineLength:   1024,
+		MessageRate:     1,
+		MessageBurst:    3,
+		MuteAfter:       -1,
+		DisconnectAfter: -1,
+		Logger:          testLogger(),
+	})
+	chunk := func(c *testClient, size int) {
+		t.Helper()
+		if err := WriteFileFrame(c.conn, FileFrame{FileName: "notes.txt", Data: make([]byte, size)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Not before login
+	stranger, _ := dialV2(t, addr, featureBinaryFiles)
+	chunk(stranger, 10)
+	stranger.mustWaitForContent(t, "You must log in first")
+
+	// Every frame counts as a message, losing one aborts the transfer
+	alice, _ := dialV2(t, addr, featureBinaryFiles)
+	if err := alice.register("alice"); err != nil {
+		t.Fatal(err)
+	}
+	bob := loginClient(t, addr, "bob")
+	alice.mustSend(t, "/sendfile bob notes.txt 5000")
+	if _, err := bob.waitFor("file-request", func(m Message) bool { return m.Type == "file-request" }); err != nil {
+		t.Fatal(err)
+	}
+	bob.mustSend(t, "/accept alice")
+	if _, err := alice.waitFor("file-accepted", func(m Message) bool { return m.Type == "file-accepted" }); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		chunk(alice, 1000)
+	}
+	alice.mustWaitForContent(t, "Warning: you are sending messages too fast")
+	alice.mustWaitForContent(t, "aborted: sending too fast")
+	if _, err := bob.waitFor("file-aborted", func(m Message) bool { return m.Type == "file-aborted" }); err != nil {
+		t.Fatal(err)
+	}
+
+	// No larger than a line
+	chunk(alice, 1025)
+	if _, err := alice.waitFor("disconnect", func(Message) bool { return false }); !errors.Is(err, io.EOF) {
+		t.Fatalf("oversized frame gave %v, want the connection closed", err)
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMailboxSize = 100
+	defaultMailboxTTL  = 7 * 24 * time.Hour
+)
+
+var ErrMailboxFull = errors.New("mailbox is full")
+
+// mailboxes keeps messages for users who are offline, oldest first
+type mailboxes struct {
+	boxes map[string][]Message
+	size  int           // Most messages kept per user
+	ttl   time.Duration // Messages older than this are dropped
+	mutex sync.Mutex
+}
+
+func newMailboxes(size int, ttl time.Duration) *mailboxes {
+	return &mailboxes{
+		boxes: make(map[string][]Message),
+		size:  size,
+		ttl:   ttl,
+	}
+}
+
+// prune drops the expired messages of username and returns what is left.
+// The caller must hold mutex.
+func (m *mailboxes) prune(username string) []Message {
+	messages := m.boxes[username]
+	cutoff := time.Now().Add(-m.ttl).UnixMilli()
+	i := 0
+	for i < len(messages) && messages[i].Time < cutoff {
+		i++
+	}
+	messages = messages[i:]
+	if len(messages) == 0 {
+		delete(m.boxes, username)
+		return nil
+	}
+	m.boxes[username] = messages
+	return messages
+}
+
+// sendOrStore delivers message to every session of username if they are
+// online and otherwise keeps it in their mailbox. It returns the sessions the
+// message was delivered to, or nil if it was stored.
+func (s *Server) sendOrStore(username string, message Message) ([]*Client, error) {
+	// Holding the mailbox lock means a user logging in now either is found
+	// here or collects the message in takeMail
+	s.mail.mutex.Lock()
+	if sessions := s.sessionsOf(username); len(sessions) > 0 {
+		s.mail.mutex.Unlock()
+		for _, session := range sessions {
+			session.deliver(message)
+		}
+		return sessions, nil
+	}
+	defer s.mail.mutex.Unlock()
+
+	if _, err := s.users.Get(username); err != nil {
+		return nil, err
+	}
+	messages := s.mail.prune(username)
+	if len(messages) >= s.mail.size {
+		return nil, ErrMailboxFull
+	}
+	if message.Time == 0 {
+		message.Time = time.Now().UnixMilli()
+	}
+	messages = append(messages, message)
+	s.mail.boxes[username] = messages
+	s.saveMailbox(username, messages)
+	return nil, nil
+}
+
+// takeMail empties the mailbox of username, returning its messages in the
+// order they were sent
+func (s *Server) takeMail(username string) []Message {
+	s.mail.mutex.Lock()
+	defer s.mail.mutex.Unlock()
+
+	messages := s.mail.prune(username)
+	if len(messages) == 0 {
+		return nil
+	}
+	delete(s.mail.boxes, username)
+	s.saveMailbox(username, nil)
+	return messages
+}
+
+// saveMailbox writes a mailbox to the message log, if there is one. The
+// caller must hold the mailbox lock so writes happen in order.
+func (s *Server) saveMailbox(username string, messages []Message) {
+	if s.messageLog == nil {
+		return
+	}
+	if err := s.messageLog.SaveMailbox(username, messages); err != nil {
+		s.logger.Printf("Error saving mailbox of %s: %v", username, err)
+	}
+}
+
+// recoverMail loads the mailboxes saved in the message log
+func (s *Server) recoverMail() error {
+	boxes, err := s.messageLog.LoadMailboxes()
+	if err != nil {
+		return err
+	}
+
+	s.mail.mutex.Lock()
+	defer s.mail.mutex.Unlock()
+
+	for username, messages := range boxes {
+		s.mail.boxes[username] = messages
+		if n := len(s.mail.prune(username)); n > 0 {
+			s.logger.Printf("Recovered %d offline messages for %s", n, username)
+		}
+	}
+	return nil
+}
+
+// mailNotice tells a user logging in how many messages are waiting
+func mailNotice(n int) string {
+	switch n {
+	case 0:
+		return ""
+	case 1:
+		return " You have 1 offline message."
+	}
+	return fmt.Sprintf(" You have %d offline messages.", n)
+}
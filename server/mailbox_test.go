@@ -0,0 +1,61 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMailboxDelivery(t *testing.T) {
+	users := NewMemoryUserStore()
+	users.Create(NewUser("bob", "password1", testPasswordIterations))
+	s, addr := startServer(t, Config{Users: users, MailboxSize: 2, Logger: testLogger()})
+	alice := loginClient(t, addr, "alice")
+
+	for _, text := range []string{"one", "two"} {
+		alice.mustSend(t, "/msg bob "+text)
+		alice.mustWaitForContent(t, "bob is offline, they will get your message when they log in")
+	}
+	alice.mustSend(t, "/msg bob three")
+	alice.mustWaitForContent(t, "bob is offline and their mailbox is full")
+	alice.mustSend(t, "/msg nobody hello")
+	alice.mustWaitForContent(t, "No such user: nobody")
+
+	bob := dialClient(t, addr)
+	bob.mustSend(t, "/login bob password1")
+	bob.mustWaitForContent(t, "Login successful! You have 2 offline messages.")
+	for _, text := range []string{"one", "two"} {
+		message, err := bob.waitFor("private message", func(m Message) bool { return m.Type == "private" })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Sender != "alice" || message.Content != text {
+			t.Fatalf("got %q from %s, want %q from alice", message.Content, message.Sender, text)
+		}
+	}
+	if mail := s.takeMail("bob"); len(mail) != 0 {
+		t.Fatalf("%d messages left in the mailbox after login", len(mail))
+	}
+}
+
+func TestMailboxTTL(t *testing.T) {
+	users := NewMemoryUserStore()
+	users.Create(NewUser("bob", "password1", testPasswordIterations))
+	s := NewServerWithConfig(Config{Users: users, MailboxSize: 1, MailboxTTL: time.Hour, Logger: testLogger()})
+
+	old := Message{Sender: "alice", Content: "old", Type: "private", Time: time.Now().Add(-2 * time.Hour).UnixMilli()}
+	if _, err := s.sendOrStore("bob", old); err != nil {
+		t.Fatal(err)
+	}
+	// An expired message does not count against the cap
+	if _, err := s.sendOrStore("bob", Message{Sender: "alice", Content: "new", Type: "private"}); err != nil {
+		t.Fatalf("storing next to an expired message: %v", err)
+	}
+	if _, err := s.sendOrStore("bob", Message{Sender: "alice", Content: "newer", Type: "private"}); err != ErrMailboxFull {
+		t.Fatalf("storing in a full mailbox returned %v, want %v", err, ErrMailboxFull)
+	}
+
+	mail := s.takeMail("bob")
+	if len(mail) != 1 || mail[0].Content != "new" {
+		t.Fatalf("mailbox held %+v, want only the new message", mail)
+	}
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"fmt"
+)
+
+// RoomMode controls who can see and join a room
+type RoomMode int
+
+const (
+	// ModePublic rooms are listed by /rooms and anyone can join
+	ModePublic RoomMode = iota
+	// ModePrivate rooms are hidden from /rooms but anyone who knows the name can join
+	ModePrivate
+	// ModeInviteOnly rooms can only be joined by users invited with /invite
+	ModeInviteOnly
+	// ModePassword rooms can only be joined with /join room password
+	ModePassword
+)
+
+func (m RoomMode) String() string {
+	switch m {
+	case ModePublic:
+		return "public"
+	case ModePrivate:
+		return "private"
+	case ModeInviteOnly:
+		return "invite-only"
+	case ModePassword:
+		return "password"
+	}
+	return fmt.Sprintf("RoomMode(%d)", int(m))
+}
+
+// ParseRoomMode parses "public", "private", "invite-only" or "password"
+func ParseRoomMode(name string) (RoomMode, error) {
+	for _, m := range []RoomMode{ModePublic, ModePrivate, ModeInviteOnly, ModePassword} {
+		if m.String() == name {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown room mode %q", name)
+}
+
+// Mode returns the room's mode
+func (r *Room) Mode() RoomMode {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.mode
+}
+
+// SetMode changes the room's mode. passwordHash, made by hashPassword, is only
+// kept for ModePassword.
+func (r *Room) SetMode(mode RoomMode, passwordHash string) {
+	if mode != ModePassword {
+		passwordHash = ""
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.mode = mode
+	r.passwordHash = passwordHash
+}
+
+// CheckPassword reports whether password opens a ModePassword room
+func (r *Room) CheckPassword(password string) bool {
+	r.mutex.Lock()
+	hash := r.passwordHash
+	r.mutex.Unlock()
+
+	// Hash outside the lock, it is slow on purpose
+	return hash != "" && checkPassword(hash, password)
+}
+
+// Invite allows username into the room whatever its mode
+func (r *Room) Invite(username string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.invited[username] = true
+}
+
+// IsInvited reports whether username was invited to the room
+func (r *Room) IsInvited(username string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.invited[username]
+}
+
+// roomVisibleTo reports whether /rooms shows the room to client
+func (s *Server) roomVisibleTo(room *Room, client *Client) bool {
+	if room.Mode() != ModePrivate {
+		return true
+	}
+	return room.HasClient(client) || s.roomRole(room, client.Username()) >= RoleOperator
+}
+
+// mayJoin reports whether the client may enter room, telling it why not.
+// Invited users, operators of the room and admins are always let in.
+func (c *Client) mayJoin(room *Room, password string) bool {
+	if room.IsBanned(c.username) {
+		c.deliver(Message{Sender: "Server", Content: "You are banned from " + room.name, Type: "text"})
+		return false
+	}
+	if room.IsInvited(c.username) || c.server.roomRole(room, c.username) >= RoleOperator {
+		return true
+	}
+
+	switch room.Mode() {
+	case ModeInviteOnly:
+		c.deliver(Message{Sender: "Server", Content: room.name + " is invite only", Type: "text"})
+		return false
+	case ModePassword:
+		if password == "" {
+			c.deliver(Message{Sender: "Server", Content: room.name + " needs a password: /join " + room.name + " password", Type: "text"})
+			return false
+		}
+		return c.checkRoomPassword(room, password)
+	}
+	return true
+}
+
+// checkRoomPassword checks a password for a password protected room. Wrong
+// passwords back off and lock out like failed logins, counted per room and
+// user and per address.
+func (c *Client) checkRoomPassword(room *Room, password string) bool {
+	key := room.name + "/" + c.username
+	if err := c.server.roomLogins.check(key, c.ip); err != nil {
+		blocked := err.(*LoginBlockedError)
+		c.server.securityEvent(EventRoomBlocked, c.username, c.ip, room.name+": retry in "+blocked.wait().String())
+		c.deliver(Message{Sender: "Server", Content: fmt.Sprintf("Too many wrong passwords for %s, try again in %v", room.name, blocked.wait()), Type: "text"})
+		return false
+	}
+
+	if !room.CheckPassword(password) {
+		failures, userLocked, addrLocked := c.server.roomLogins.fail(key, c.ip)
+		lockout := c.server.roomLogins.lockout
+		if userLocked {
+			c.server.securityEvent(EventRoomLocked, c.username, c.ip, fmt.Sprintf("%s: locked for %v", room.name, lockout))
+		} else {
+			c.server.securityEvent(EventRoomPassword, c.username, c.ip, fmt.Sprintf("%s: %d consecutive failures", room.name, failures))
+		}
+		if addrLocked {
+			c.server.securityEvent(EventRoomLocked, "", c.ip, fmt.Sprintf("all rooms locked for %v", lockout))
+		}
+		c.deliver(Message{Sender: "Server", Content: "Wrong password for " + room.name, Type: "text"})
+		return false
+	}
+	c.server.roomLogins.succeed(key)
+	return true
+}
+
+// setRoomMode changes the mode of the client's current room
+func (c *Client) setRoomMode(mode RoomMode, password string) {
+	room := c.moderatedRoom(PermSetMode)
+	if room == nil {
+		return
+	}
+	if room.name == "general" {
+		c.deliver(Message{Sender: "Server", Content: "general is always public", Type: "text"})
+		return
+	}
+
+	hash := ""
+	if mode == ModePassword {
+		hash = hashPassword(password, c.server.passwordIterations)
+	}
+	room.SetMode(mode, hash)
+	c.server.saveRoom(room)
+
+	room.Announce(room.name + " is now " + mode.String() + " (set by " + c.username + ")")
+	c.server.logger.Printf("%s set mode of %s to %s", c.username, room.name, mode)
+}
+
+// inviteUser lets target into the client's room and tells target about it
+func (c *Client) inviteUser(target string) {
+	room := c.moderatedRoom(PermInvite)
+	if room == nil {
+		return
+	}
+	if _, err := c.server.users.Get(target); err != nil {
+		c.deliver(Message{Sender: "Server", Content: "No such user: " + target, Type: "text"})
+		return
+	}
+	if room.IsBanned(target) {
+		c.deliver(Message{Sender: "Server", Content: target + " is banned from " + room.name + ", /unban them first", Type: "text"})
+		return
+	}
+
+	room.Invite(target)
+	c.server.saveRoom(room)
+
+	c.deliver(Message{Sender: "Server", Content: "Invited " + target + " to " + room.name, Type: "text"})
+	for _, session := range c.server.sessionsOf(target) {
+		session.deliver(Message{
+			Sender:  "Server",
+			Content: c.username + " invited you to " + room.name + ". Type /join " + room.name,
+			Type:    "text",
+		})
+	}
+	c.server.logger.Printf("%s invited %s to %s", c.username, target, room.name)
+}
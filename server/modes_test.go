@@ -0,0 +1,113 @@
+package server
+
+import (
+	"log"
+	"strings"
+	"testing"
+)
+
+// startModeRoom starts a server where alice owns den with the given mode,
+// and logs in bob to try joining it
+func startModeRoom(t *testing.T, config Config, mode string) (*Server, *testClient, *testClient) {
+	t.Helper()
+	config.Logger = testLogger()
+	s, addr := startServer(t, config)
+	alice := loginClient(t, addr, "alice")
+	bob := loginClient(t, addr, "bob")
+
+	alice.mustSend(t, "/join den")
+	alice.mustWaitForContent(t, "You have joined room: den")
+	alice.mustSend(t, "/mode "+mode)
+	alice.mustWaitForContent(t, "den is now")
+	return s, alice, bob
+}
+
+func TestPrivateRoom(t *testing.T) {
+	_, _, bob := startModeRoom(t, Config{}, "private")
+
+	// Left out of the list, but not closed
+	bob.mustSend(t, "/rooms")
+	if list := bob.mustWaitForContent(t, "Available rooms"); strings.Contains(list.Content, "den") {
+		t.Fatalf("private room listed to a non-member:\n%s", list.Content)
+	}
+	bob.mustSend(t, "/join den")
+	bob.mustWaitForContent(t, "You have joined room: den")
+	bob.mustSend(t, "/rooms")
+	if list := bob.mustWaitForContent(t, "Available rooms"); !strings.Contains(list.Content, "den") {
+		t.Fatalf("private room not listed to a member:\n%s", list.Content)
+	}
+}
+
+func TestInviteOnlyRoom(t *testing.T) {
+	_, alice, bob := startModeRoom(t, Config{}, "invite-only")
+
+	bob.mustSend(t, "/join den")
+	bob.mustWaitForContent(t, "den is invite only")
+
+	alice.mustSend(t, "/invite bob")
+	alice.mustWaitForContent(t, "Invited bob to den")
+	bob.mustWaitForContent(t, "alice invited you to den")
+	bob.mustSend(t, "/join den")
+	bob.mustWaitForContent(t, "You have joined room: den")
+}
+
+func TestPasswordRoom(t *testing.T) {
+	s, _, bob := startModeRoom(t, Config{LoginBackoff: -1, LoginMaxFailures: 3}, "password secret")
+
+	bob.mustSend(t, "/join den")
+	bob.mustWaitForContent(t, "den needs a password")
+	bob.mustSend(t, "/join den wrong")
+	bob.mustWaitForContent(t, "Wrong password for den")
+
+	// The right password clears the failures
+	bob.mustSend(t, "/join den secret")
+	bob.mustWaitForContent(t, "You have joined room: den")
+	bob.mustSend(t, "/part den")
+	bob.mustWaitForContent(t, "You have left room: den")
+
+	// Three wrong passwords in a row lock bob out of den, even with the right one
+	for i := 0; i < 3; i++ {
+		bob.mustSend(t, "/join den wrong")
+		bob.mustWaitForContent(t, "Wrong password for den")
+	}
+	bob.mustSend(t, "/join den secret")
+	bob.mustWaitForContent(t, "Too many wrong passwords for den")
+
+	// Other users are not locked out, nor is bob's account
+	carol := loginClient(t, s.Addr().String(), "carol")
+	carol.mustSend(t, "/join den secret")
+	carol.mustWaitForContent(t, "You have joined room: den")
+	if err := s.AuthenticateUser("bob", "password1", "127.0.0.1"); err != nil {
+		t.Fatalf("bob cannot log in after failing a room password: %v", err)
+	}
+
+	for eventType, want := range map[string]int{
+		EventRoomPassword: 3, // The third failure in a row locks instead
+		EventRoomLocked:   1,
+		EventRoomBlocked:  1,
+	} {
+		if got := len(s.SecurityEvents(100, eventType)); got != want {
+			t.Errorf("%d %s events, want %d", got, eventType, want)
+		}
+	}
+}
+
+func TestRoomPasswordNotLogged(t *testing.T) {
+	var logs syncBuffer
+	_, addr := startServer(t, Config{Logger: log.New(&logs, "", 0)})
+	alice := loginClient(t, addr, "alice")
+	bob := loginClient(t, addr, "bob")
+	alice.mustSend(t, "/join den")
+	alice.mustWaitForContent(t, "You have joined room: den")
+	alice.mustSend(t, "/mode password hunter2")
+	alice.mustWaitForContent(t, "den is now")
+	bob.mustSend(t, "/join den hunter2")
+	bob.mustWaitForContent(t, "You have joined room: den")
+
+	if strings.Contains(logs.String(), "hunter2") {
+		t.Fatalf("room password in the log:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "executing command: /join den [redacted]") {
+		t.Fatalf("join not logged with its room:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,478 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultSegmentSize = 4 * 1024 * 1024 // Rotate segments after 4MB
+	recordHeaderSize   = 8               // 4 byte length + 4 byte CRC32
+	maxRecordSize      = 16 * 1024 * 1024
+	segmentExt         = ".log"
+	roomStateFile      = "room.json"
+	mailboxDir         = ".mailboxes" // Room directories never start with a dot
+)
+
+var (
+	errCorruptRecord = errors.New("corrupt record")
+	errLogClosed     = errors.New("message log is closed")
+)
+
+// MessageLog is an append-only on-disk log of room messages. Each room gets
+// its own directory of numbered segment files. Every record is
+//
+//	[length uint32][crc32 uint32][JSON encoded Message]
+//
+// so a record torn by a crash mid-write is detected and truncated on open,
+// and a record corrupted later is skipped.
+type MessageLog struct {
+	dir         string
+	segmentSize int64
+	sync        bool
+	rooms       map[string]*roomLog
+	closed      bool
+	logger      *log.Logger // The server's logger once it uses the log
+	mutex       sync.Mutex
+}
+
+// roomLog is the segment currently being appended to for one room
+type roomLog struct {
+	dir     string
+	file    *os.File
+	segment int
+	size    int64
+}
+
+// OpenMessageLog opens or creates a message log in dir. segmentSize <= 0 uses
+// the default; if syncWrites is set every record is fsynced before returning.
+func OpenMessageLog(dir string, segmentSize int64, syncWrites bool) (*MessageLog, error) {
+	if segmentSize <= 0 {
+		segmentSize = defaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &MessageLog{
+		dir:         dir,
+		segmentSize: segmentSize,
+		sync:        syncWrites,
+		rooms:       make(map[string]*roomLog),
+		logger:      log.Default(),
+	}, nil
+}
+
+// roomDirName encodes a room name so it is always a single safe path element
+func roomDirName(room string) string {
+	return strings.ReplaceAll(url.PathEscape(room), ".", "%2E")
+}
+
+// Rooms returns the names of all rooms that have a log on disk
+func (l *MessageLog) Rooms() ([]string, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var rooms []string
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == mailboxDir {
+			continue
+		}
+		name, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			l.logger.Printf("Skipping unknown directory in message log: %s", entry.Name())
+			continue
+		}
+		rooms = append(rooms, name)
+	}
+	return rooms, nil
+}
+
+// segments returns the segment numbers of a room in ascending order
+func segments(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var numbers []int
+	for _, entry := range entries {
+		var n int
+		if _, err := fmt.Sscanf(entry.Name(), "%d"+segmentExt, &n); err == nil {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	return numbers, nil
+}
+
+func segmentPath(dir string, segment int) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", segment, segmentExt))
+}
+
+// decodeRecord decodes the record at the start of data and returns its size.
+// It reports false if data does not start with a complete, valid record.
+func decodeRecord(data []byte) (Message, int, bool) {
+	var message Message
+	if len(data) < recordHeaderSize {
+		return message, 0, false
+	}
+	length := binary.BigEndian.Uint32(data[0:4])
+	checksum := binary.BigEndian.Uint32(data[4:8])
+	if length > maxRecordSize || int64(length) > int64(len(data)-recordHeaderSize) {
+		return message, 0, false
+	}
+	payload := data[recordHeaderSize : recordHeaderSize+int(length)]
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return message, 0, false
+	}
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return message, 0, false
+	}
+	return message, recordHeaderSize + int(length), true
+}
+
+// resync returns the offset of the first valid record at or after from, or
+// -1 if there is none
+func resync(data []byte, from int) int {
+	for i := from; i+recordHeaderSize < len(data); i++ {
+		// Every payload is a JSON object, skip the CRC where it cannot be one
+		if data[i+recordHeaderSize] != '{' {
+			continue
+		}
+		if _, _, ok := decodeRecord(data[i:]); ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// readSegment decodes all valid records of a segment. A corrupt record
+// followed by valid ones is skipped. It returns the messages and the offset
+// just after the last valid record, with errCorruptRecord if everything from
+// there to the end of the file is invalid, i.e. the tail was torn.
+func (l *MessageLog) readSegment(path string) ([]Message, int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var messages []Message
+	offset := 0
+	for offset < len(data) {
+		message, size, ok := decodeRecord(data[offset:])
+		if ok {
+			messages = append(messages, message)
+			offset += size
+			continue
+		}
+
+		// Nothing valid after the bad record means the write was torn
+		next := resync(data, offset+1)
+		if next < 0 {
+			return messages, int64(offset), errCorruptRecord
+		}
+		l.logger.Printf("Skipping %d corrupt bytes in %s at offset %d", next-offset, path, offset)
+		offset = next
+	}
+	return messages, int64(offset), nil
+}
+
+// Recover reads back the newest messages of a room, at most limit of them,
+// oldest first. Corrupt records are skipped; a torn tail of the last segment
+// is truncated so that appends continue from a clean tail.
+func (l *MessageLog) Recover(room string, limit int) ([]Message, error) {
+	dir := filepath.Join(l.dir, roomDirName(room))
+	numbers, err := segments(dir)
+	if err != nil || len(numbers) == 0 {
+		return nil, err
+	}
+
+	// Walk segments from the newest until we have enough messages
+	var collected [][]Message
+	count := 0
+	for i := len(numbers) - 1; i >= 0 && count < limit; i-- {
+		path := segmentPath(dir, numbers[i])
+		messages, validSize, err := l.readSegment(path)
+		if err == errCorruptRecord {
+			if i == len(numbers)-1 {
+				l.logger.Printf("Truncating torn record in %s at offset %d", path, validSize)
+				if err := os.Truncate(path, validSize); err != nil {
+					return nil, err
+				}
+			} else {
+				l.logger.Printf("Corrupt tail in %s at offset %d, ignoring it", path, validSize)
+			}
+		} else if err != nil {
+			return nil, err
+		}
+
+		collected = append(collected, messages)
+		count += len(messages)
+	}
+
+	result := make([]Message, 0, count)
+	for i := len(collected) - 1; i >= 0; i-- {
+		result = append(result, collected[i]...)
+	}
+	if len(result) > limit {
+		result = result[len(result)-limit:]
+	}
+	return result, nil
+}
+
+// openRoom returns the current segment of a room, opening it on first use
+func (l *MessageLog) openRoom(room string) (*roomLog, error) {
+	if rl, ok := l.rooms[room]; ok {
+		return rl, nil
+	}
+
+	dir := filepath.Join(l.dir, roomDirName(room))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	numbers, err := segments(dir)
+	if err != nil {
+		return nil, err
+	}
+	segment := 0
+	if len(numbers) > 0 {
+		segment = numbers[len(numbers)-1]
+	}
+
+	file, err := os.OpenFile(segmentPath(dir, segment), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	rl := &roomLog{dir: dir, file: file, segment: segment, size: info.Size()}
+	l.rooms[room] = rl
+	return rl, nil
+}
+
+// rotate closes the current segment and starts the next one
+func (rl *roomLog) rotate() error {
+	if err := rl.file.Sync(); err != nil {
+		return err
+	}
+	if err := rl.file.Close(); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(segmentPath(rl.dir, rl.segment+1), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	rl.file = file
+	rl.segment++
+	rl.size = 0
+	return nil
+}
+
+// Append writes a message to the log of its room
+func (l *MessageLog) Append(message Message) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[recordHeaderSize:], payload)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return errLogClosed
+	}
+
+	rl, err := l.openRoom(message.RoomName)
+	if err != nil {
+		return err
+	}
+
+	if rl.size > 0 && rl.size+int64(len(record)) > l.segmentSize {
+		if err := rl.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := rl.file.Write(record); err != nil {
+		// Drop a partially written record so later appends stay readable
+		rl.file.Truncate(rl.size)
+		return err
+	}
+	rl.size += int64(len(record))
+
+	if l.sync {
+		return rl.file.Sync()
+	}
+	return nil
+}
+
+// SaveRoom stores the state of a room next to its messages, replacing the
+// previous state atomically
+func (l *MessageLog) SaveRoom(room string, state RoomState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return errLogClosed
+	}
+
+	dir := filepath.Join(l.dir, roomDirName(room))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, roomStateFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, roomStateFile))
+}
+
+// LoadRoom reads the state saved with SaveRoom. A room without saved state
+// gets the zero RoomState.
+func (l *MessageLog) LoadRoom(room string) (RoomState, error) {
+	var state RoomState
+	data, err := os.ReadFile(filepath.Join(l.dir, roomDirName(room), roomStateFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+// DeleteRoom removes the messages and state of a room
+func (l *MessageLog) DeleteRoom(room string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return errLogClosed
+	}
+
+	if rl, ok := l.rooms[room]; ok {
+		rl.file.Close()
+		delete(l.rooms, room)
+	}
+	return os.RemoveAll(filepath.Join(l.dir, roomDirName(room)))
+}
+
+// SaveMailbox stores the messages waiting for an offline user, replacing the
+// previous ones atomically. An empty mailbox removes the file.
+func (l *MessageLog) SaveMailbox(username string, messages []Message) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return errLogClosed
+	}
+
+	dir := filepath.Join(l.dir, mailboxDir)
+	path := filepath.Join(dir, roomDirName(username)+".json")
+	if len(messages) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(messages)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadMailboxes reads every mailbox saved with SaveMailbox, keyed by username
+func (l *MessageLog) LoadMailboxes() (map[string][]Message, error) {
+	dir := filepath.Join(l.dir, mailboxDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	mailboxes := make(map[string][]Message)
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if entry.IsDir() || !ok {
+			continue
+		}
+		username, err := url.PathUnescape(name)
+		if err != nil {
+			l.logger.Printf("Skipping unknown file in mailboxes: %s", entry.Name())
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var messages []Message
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return nil, fmt.Errorf("mailbox of %s: %w", username, err)
+		}
+		mailboxes[username] = messages
+	}
+	return mailboxes, nil
+}
+
+// Close flushes and closes all open segments
+func (l *MessageLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.closed = true
+	var firstErr error
+	for room, rl := range l.rooms {
+		if err := rl.file.Sync(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := rl.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(l.rooms, room)
+	}
+	return firstErr
+}
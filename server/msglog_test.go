@@ -0,0 +1,219 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// appendMessages writes n messages to room and returns the segment file
+// size after each one, i.e. the offset where the next record starts
+func appendMessages(t *testing.T, l *MessageLog, room string, first, n int) []int64 {
+	t.Helper()
+	var ends []int64
+	for i := first; i < first+n; i++ {
+		message := Message{ID: uint64(i), Sender: "alice", RoomName: room, Content: fmt.Sprintf("message %d", i), Type: "text"}
+		if err := l.Append(message); err != nil {
+			t.Fatal(err)
+		}
+		ends = append(ends, l.rooms[room].size)
+	}
+	return ends
+}
+
+// checkIDs fails unless messages have exactly the given IDs, in order
+func checkIDs(t *testing.T, messages []Message, ids ...uint64) {
+	t.Helper()
+	got := make([]uint64, len(messages))
+	for i, message := range messages {
+		got[i] = message.ID
+	}
+	if fmt.Sprint(got) != fmt.Sprint(ids) {
+		t.Fatalf("got messages %v, want %v", got, ids)
+	}
+}
+
+func openTestLog(t *testing.T, dir string, segmentSize int64) *MessageLog {
+	t.Helper()
+	l, err := OpenMessageLog(dir, segmentSize, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestMessageLogTornTail(t *testing.T) {
+	dir := t.TempDir()
+	l := openTestLog(t, dir, 0)
+	ends := appendMessages(t, l, "general", 1, 5)
+	l.Close()
+
+	// A crash while writing message 5 left only part of it
+	path := segmentPath(filepath.Join(dir, "general"), 0)
+	torn := ends[3] + 6
+	if err := os.Truncate(path, torn); err != nil {
+		t.Fatal(err)
+	}
+
+	// The repair is reported through the server's logger
+	var logs syncBuffer
+	l = openTestLog(t, dir, 0)
+	s := NewServerWithConfig(Config{MessageLog: l, Logger: log.New(&logs, "", 0)})
+	if err := s.recoverRooms(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "Truncating torn record") {
+		t.Fatalf("server log does not mention the torn record:\n%s", logs.String())
+	}
+	messages, err := l.Recover("general", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIDs(t, messages, 1, 2, 3, 4)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != ends[3] {
+		t.Fatalf("segment is %d bytes after recovery, want the torn record cut at %d", info.Size(), ends[3])
+	}
+
+	// Appends continue from the clean tail
+	appendMessages(t, l, "general", 6, 1)
+	messages, err = l.Recover("general", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIDs(t, messages, 1, 2, 3, 4, 6)
+}
+
+func TestMessageLogMidFileCorruption(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		offset func(start int64) int64 // Byte to flip in the record starting at start
+	}{
+		{"payload", func(start int64) int64 { return start + recordHeaderSize + 10 }},
+		{"checksum", func(start int64) int64 { return start + 5 }},
+		{"length", func(start int64) int64 { return start }},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l := openTestLog(t, dir, 0)
+			ends := appendMessages(t, l, "general", 1, 5)
+			l.Close()
+
+			// Flip one byte of message 2
+			path := segmentPath(filepath.Join(dir, "general"), 0)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data[c.offset(ends[0])] ^= 0x40
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			l = openTestLog(t, dir, 0)
+			messages, err := l.Recover("general", 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkIDs(t, messages, 1, 3, 4, 5)
+
+			// Nothing after the bad record was thrown away
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != int64(len(data)) {
+				t.Fatalf("segment shrank from %d to %d bytes", len(data), info.Size())
+			}
+		})
+	}
+}
+
+func TestMessageLogCorruptLastRecord(t *testing.T) {
+	dir := t.TempDir()
+	l := openTestLog(t, dir, 0)
+	ends := appendMessages(t, l, "general", 1, 3)
+	l.Close()
+
+	// A bad record running to the end of the file is a torn tail
+	path := segmentPath(filepath.Join(dir, "general"), 0)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[ends[1]+recordHeaderSize+3] ^= 0x40
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l = openTestLog(t, dir, 0)
+	messages, err := l.Recover("general", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIDs(t, messages, 1, 2)
+	if info, _ := os.Stat(path); info.Size() != ends[1] {
+		t.Fatalf("segment is %d bytes, want %d", info.Size(), ends[1])
+	}
+}
+
+func TestMessageLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	// Room for two records per segment
+	l := openTestLog(t, dir, 300)
+	appendMessages(t, l, "general", 1, 20)
+
+	numbers, err := segments(filepath.Join(dir, "general"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(numbers) < 5 {
+		t.Fatalf("20 messages made %d segments, want rotation", len(numbers))
+	}
+	for _, n := range numbers {
+		info, err := os.Stat(segmentPath(filepath.Join(dir, "general"), n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 300 {
+			t.Fatalf("segment %d is %d bytes, over the segment size", n, info.Size())
+		}
+	}
+
+	// Recover reads across segments, oldest first, and stops at the limit
+	messages, err := l.Recover("general", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIDs(t, messages, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20)
+	messages, err = l.Recover("general", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIDs(t, messages, 17, 18, 19, 20)
+
+	// After a restart appends go to the newest segment
+	l.Close()
+	l = openTestLog(t, dir, 300)
+	appendMessages(t, l, "general", 21, 1)
+	after, err := segments(filepath.Join(dir, "general"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after[0] != numbers[0] || after[len(after)-1] < numbers[len(numbers)-1] {
+		t.Fatalf("segments went from %v to %v", numbers, after)
+	}
+	messages, err = l.Recover("general", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIDs(t, messages, 19, 20, 21)
+}
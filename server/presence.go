@@ -0,0 +1,242 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultAutoAwayAfter = 10 * time.Minute
+
+// Presence is whether a user is around
+type Presence int
+
+const (
+	PresenceOnline Presence = iota
+	PresenceAway
+	PresenceBusy
+	PresenceOffline
+)
+
+func (p Presence) String() string {
+	switch p {
+	case PresenceOnline:
+		return "online"
+	case PresenceAway:
+		return "away"
+	case PresenceBusy:
+		return "busy"
+	case PresenceOffline:
+		return "offline"
+	}
+	return fmt.Sprintf("Presence(%d)", int(p))
+}
+
+// Presence returns the client's presence and the reason given for it
+func (c *Client) Presence() (Presence, string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.presence, c.presenceReason
+}
+
+// setPresence changes the presence of all sessions of the client's user and
+// tells the members of their rooms. It reports false if nothing changed.
+func (c *Client) setPresence(presence Presence, reason string, auto bool) bool {
+	username := c.Username()
+	changed := false
+	for _, session := range c.server.sessionsOf(username) {
+		session.mutex.Lock()
+		if session.presence != presence || session.presenceReason != reason {
+			session.presence = presence
+			session.presenceReason = reason
+			changed = true
+		}
+		session.autoAway = auto
+		session.mutex.Unlock()
+	}
+	if !changed {
+		return false
+	}
+
+	content := username + " is " + presence.String()
+	if presence == PresenceOnline {
+		content = username + " is back"
+	}
+	if reason != "" {
+		content += ": " + reason
+	}
+	c.server.notifyPresence(username, content)
+	return true
+}
+
+// touch records activity from the user, bringing it back from auto-away
+func (c *Client) touch() {
+	c.mutex.Lock()
+	c.lastActive = time.Now()
+	auto := c.autoAway
+	c.mutex.Unlock()
+
+	if auto && c.setPresence(PresenceOnline, "", false) {
+		c.deliver(Message{Sender: "Server", Content: "Welcome back, you are no longer away", Type: "text"})
+	}
+}
+
+// idle returns how long the user has not sent anything
+func (c *Client) idle() time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return time.Since(c.lastActive)
+}
+
+// userRooms returns the rooms any session of username is in
+func (s *Server) userRooms(username string) []*Room {
+	var rooms []*Room
+	seen := make(map[*Room]bool)
+	for _, session := range s.sessionsOf(username) {
+		for _, room := range s.roomsOf(session) {
+			if !seen[room] {
+				seen[room] = true
+				rooms = append(rooms, room)
+			}
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].name < rooms[j].name })
+	return rooms
+}
+
+// notifyPresence pushes a presence change of username to everyone sharing a
+// room with it, once each
+func (s *Server) notifyPresence(username, content string) {
+	notified := make(map[*Client]bool)
+	for _, room := range s.userRooms(username) {
+		room.mutex.Lock()
+		for member := range room.clients {
+			if !notified[member] && member.Username() != username {
+				notified[member] = true
+				member.deliver(Message{Sender: username, RoomName: room.name, Content: content, Type: "presence"})
+			}
+		}
+		room.mutex.Unlock()
+	}
+}
+
+// autoAway marks users away once all their sessions have been idle for
+// autoAwayAfter
+func (s *Server) autoAway() {
+	for _, client := range s.connectedClients() {
+		if !client.IsAuthenticated() {
+			continue
+		}
+		// The most recently active session decides
+		if active := s.FindClient(client.Username()); active == nil || active.idle() < s.autoAwayAfter {
+			continue
+		}
+		if presence, _ := client.Presence(); presence != PresenceOnline {
+			continue
+		}
+		if client.setPresence(PresenceAway, "idle", true) {
+			client.deliver(Message{
+				Sender:  "Server",
+				Content: fmt.Sprintf("You have been marked away after %v without activity", s.autoAwayAfter),
+				Type:    "text",
+			})
+		}
+	}
+}
+
+// autoAwayLoop periodically applies auto-away until the server shuts down
+func (s *Server) autoAwayLoop() {
+	interval := s.autoAwayAfter / 4
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if s.closing.Load() {
+				return
+			}
+			s.autoAway()
+		case <-s.stopped:
+			return
+		}
+	}
+}
+
+// recordLastSeen stores when a user disconnected
+func (s *Server) recordLastSeen(username string) {
+	if err := s.users.UpdateLastSeen(username, time.Now()); err != nil && err != ErrUserNotFound {
+		s.logger.Printf("Error storing last seen time of %s: %v", username, err)
+	}
+}
+
+// whois describes a user for the client asking
+func (s *Server) whois(asker *Client, username string) (string, error) {
+	var info strings.Builder
+	target := s.FindClient(username)
+	if target == nil {
+		user, err := s.users.Get(username)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&info, "%s is %s\n", username, PresenceOffline)
+		if user.LastSeen.IsZero() {
+			info.WriteString("Last seen: never\n")
+		} else {
+			fmt.Fprintf(&info, "Last seen: %s (%s ago)\n", user.LastSeen.Format("2006-01-02 15:04"), formatDuration(time.Since(user.LastSeen)))
+		}
+		return info.String(), nil
+	}
+
+	presence, reason := target.Presence()
+	fmt.Fprintf(&info, "%s is %s", username, presence)
+	if reason != "" {
+		fmt.Fprintf(&info, " (%s)", reason)
+	}
+	info.WriteString("\n")
+
+	var rooms []string
+	for _, room := range s.userRooms(username) {
+		if s.roomVisibleTo(room, asker) {
+			rooms = append(rooms, room.name)
+		}
+	}
+	if len(rooms) > 0 {
+		fmt.Fprintf(&info, "Rooms: %s\n", strings.Join(rooms, ", "))
+	}
+	sessions := s.Sessions(username)
+	if len(sessions) > 0 {
+		// Sessions are oldest first
+		fmt.Fprintf(&info, "Connected since: %s\n", sessions[0].Connected.Format("2006-01-02 15:04"))
+	}
+	if len(sessions) > 1 {
+		ids := make([]string, len(sessions))
+		for i, session := range sessions {
+			ids[i] = fmt.Sprintf("#%d", session.ID)
+		}
+		fmt.Fprintf(&info, "Sessions: %s\n", strings.Join(ids, ", "))
+	}
+	fmt.Fprintf(&info, "Idle: %s\n", formatDuration(target.idle()))
+	info.WriteString("Last seen: now\n")
+	return info.String(), nil
+}
+
+// formatDuration rounds d to a readable precision
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return d.Round(time.Second).String()
+	case d < time.Hour:
+		return d.Round(time.Minute).String()
+	}
+	return d.Round(time.Hour).String()
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForPresence reads messages until a presence change with content
+func (c *testClient) waitForPresence(t *testing.T, content string) {
+	t.Helper()
+	if _, err := c.waitFor("presence "+content, func(m Message) bool {
+		return m.Type == "presence" && m.Content == content
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAwayAndBack(t *testing.T) {
+	_, addr := startServer(t, Config{Logger: testLogger()})
+	alice := loginClient(t, addr, "alice")
+	bob := loginClient(t, addr, "bob")
+
+	alice.mustSend(t, "/away lunch")
+	alice.mustWaitForContent(t, "You are now away: lunch")
+	bob.waitForPresence(t, "alice is away: lunch")
+	bob.mustSend(t, "/whois alice")
+	info := bob.mustWaitForContent(t, "alice is away (lunch)")
+	for _, line := range []string{"Rooms: general", "Connected since:", "Last seen: now"} {
+		if !strings.Contains(info.Content, line) {
+			t.Errorf("whois is missing %q:\n%s", line, info.Content)
+		}
+	}
+
+	alice.mustSend(t, "/busy")
+	bob.waitForPresence(t, "alice is busy")
+	alice.mustSend(t, "/back")
+	alice.mustWaitForContent(t, "You are back online")
+	bob.waitForPresence(t, "alice is back")
+	alice.mustSend(t, "/back")
+	alice.mustWaitForContent(t, "You are already online")
+}
+
+func TestAutoAway(t *testing.T) {
+	s, addr := startServer(t, Config{AutoAwayAfter: 100 * time.Millisecond, Logger: testLogger()})
+	alice := loginClient(t, addr, "alice")
+	bob := loginClient(t, addr, "bob")
+
+	time.Sleep(150 * time.Millisecond)
+	s.autoAway()
+	alice.mustWaitForContent(t, "You have been marked away")
+	bob.waitForPresence(t, "alice is away: idle")
+
+	// Saying anything brings alice back
+	alice.mustSend(t, "/rooms")
+	alice.mustWaitForContent(t, "Welcome back, you are no longer away")
+	bob.waitForPresence(t, "alice is back")
+}
+
+func TestLastSeen(t *testing.T) {
+	users := NewMemoryUserStore()
+	users.Create(NewUser("dave", "password1", testPasswordIterations))
+	_, addr := startServer(t, Config{Users: users, Logger: testLogger()})
+	alice := loginClient(t, addr, "alice")
+	carol := loginClient(t, addr, "carol")
+
+	alice.mustSend(t, "/whois dave")
+	info := alice.mustWaitForContent(t, "dave is offline")
+	if !strings.Contains(info.Content, "Last seen: never") {
+		t.Fatalf("whois of a user who never logged in:\n%s", info.Content)
+	}
+	alice.mustSend(t, "/whois nobody")
+	alice.mustWaitForContent(t, "No such user: nobody")
+
+	before := time.Now()
+	carol.conn.Close()
+	waitUntil(t, "carol's last seen time", func() bool {
+		user, err := users.Get("carol")
+		return err == nil && !user.LastSeen.Before(before)
+	})
+	alice.mustSend(t, "/whois carol")
+	info = alice.mustWaitForContent(t, "carol is offline")
+	if strings.Contains(info.Content, "Last seen: never") || strings.Contains(info.Content, "Rooms:") {
+		t.Fatalf("whois of a user who left:\n%s", info.Content)
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Wire protocol versions.
+//
+// Version 1 (legacy): clients send raw newline-terminated text lines. Lines
+// starting with "/" are commands, JSON objects are file chunks and anything
+// else is chat text. The server answers with one JSON encoded Message per line.
+//
+// Version 2: both sides exchange newline-delimited Frame envelopes
+//
+//	{"v":2,"id":17,"ts":1715888290000,"type":"text","payload":{...}}
+//
+// A client opts in by sending a "hello" frame as its first line with the
+// versions it supports. The server answers with a "hello" frame carrying the
+// chosen version, or an "error" frame if none is supported, in which case the
+// connection stays in legacy mode. Frames sent by the client:
+//
+//	hello       payload Hello
+//	text        payload Message, Content is posted to the current room
+//	command     payload Message, Content holds the command line ("/join r1")
+//	file-chunk  payload Message with FileName, FileData and Target, the receiver
+//
+// The client may also list optional features in its hello; the server echoes
+// back the ones it supports. With "binary-files" file chunks travel as raw
+// binary frames in both directions (see binary.go).
+//
+// Every frame sent by the server has a Message payload and its type is the
+// Message Type ("text", "private", "history", "file-request", ...). Frame ids
+// are unique and increase over the lifetime of a server; ts is the Unix time
+// in milliseconds.
+const (
+	protocolLegacy = 1
+	protocolV2     = 2
+)
+
+var errBadFrame = errors.New("malformed frame")
+
+// Frame is the v2 envelope around every message on the wire
+type Frame struct {
+	V       int             `json:"v"`
+	ID      uint64          `json:"id,omitempty"`
+	TS      int64           `json:"ts"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Hello is the payload of the handshake frame
+type Hello struct {
+	Versions []int    `json:"versions,omitempty"` // Offered by the client
+	Version  int      `json:"version,omitempty"`  // Chosen by the server
+	Agent    string   `json:"agent,omitempty"`
+	Features []string `json:"features,omitempty"` // Optional extensions, e.g. "binary-files"
+}
+
+// parseHello reports whether line is a v2 handshake frame and returns its payload
+func parseHello(line string) (Hello, bool) {
+	var frame Frame
+	if err := json.Unmarshal([]byte(line), &frame); err != nil || frame.Type != "hello" || frame.V == 0 {
+		return Hello{}, false
+	}
+
+	var hello Hello
+	if len(frame.Payload) > 0 {
+		if err := json.Unmarshal(frame.Payload, &hello); err != nil {
+			return Hello{}, false
+		}
+	}
+	return hello, true
+}
+
+// decodeFrame parses a v2 frame sent by a client and returns its Message payload
+func decodeFrame(line string) (Frame, Message, error) {
+	var frame Frame
+	if err := json.Unmarshal([]byte(line), &frame); err != nil {
+		return frame, Message{}, errBadFrame
+	}
+	if frame.V != protocolV2 || frame.Type == "" {
+		return frame, Message{}, errBadFrame
+	}
+
+	var message Message
+	if len(frame.Payload) > 0 {
+		if err := json.Unmarshal(frame.Payload, &message); err != nil {
+			return frame, Message{}, errBadFrame
+		}
+	}
+	message.Type = frame.Type
+	return frame, message, nil
+}
+
+// encodeFrame wraps a message in a v2 envelope
+func encodeFrame(message Message) ([]byte, error) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Frame{
+		V:       protocolV2,
+		ID:      message.ID,
+		TS:      message.Time,
+		Type:    message.Type,
+		Payload: payload,
+	})
+}
+
+// encodeControlFrame builds a server frame with an arbitrary payload, used
+// for the handshake
+func encodeControlFrame(id uint64, frameType string, payload interface{}) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Frame{
+		V:       protocolV2,
+		ID:      id,
+		TS:      time.Now().UnixMilli(),
+		Type:    frameType,
+		Payload: data,
+	})
+}
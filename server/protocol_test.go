@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sendFrame sends message as a v2 frame of its type
+func (c *testClient) sendFrame(t *testing.T, message Message) {
+	t.Helper()
+	payload, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := json.Marshal(Frame{V: protocolV2, TS: time.Now().UnixMilli(), Type: message.Type, Payload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.mustSend(t, string(line))
+}
+
+// waitForFrame reads v2 frames until one whose payload content contains substr
+func (c *testClient) waitForFrame(t *testing.T, substr string) (Frame, Message) {
+	t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		line, err := c.reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("waiting for %q: %v", substr, err)
+		}
+		var frame Frame
+		var message Message
+		if err := json.Unmarshal(line, &frame); err != nil || frame.V != protocolV2 {
+			t.Fatalf("not a v2 frame: %s", line)
+		}
+		if err := json.Unmarshal(frame.Payload, &message); err != nil {
+			t.Fatalf("frame payload: %v", err)
+		}
+		if frame.ID == 0 || frame.TS == 0 || frame.Type != message.Type {
+			t.Fatalf("frame without id, timestamp or type: %s", line)
+		}
+		if strings.Contains(message.Content, substr) {
+			return frame, message
+		}
+	}
+}
+
+func TestHelloHandshake(t *testing.T) {
+	_, addr := startServer(t, Config{Logger: testLogger()})
+	c, hello := dialV2(t, addr, featureBinaryFiles, "telepathy")
+	if hello.Version != protocolV2 {
+		t.Fatalf("server chose version %d, want %d", hello.Version, protocolV2)
+	}
+	if len(hello.Features) != 1 || hello.Features[0] != featureBinaryFiles {
+		t.Fatalf("server accepted features %v, want only %s", hello.Features, featureBinaryFiles)
+	}
+
+	c.sendFrame(t, Message{Type: "command", Content: "/register alice password1"})
+	login, _ := c.waitForFrame(t, "Registered and logged in")
+	c.sendFrame(t, Message{Type: "text", Content: "framed hello"})
+	frame, message := c.waitForFrame(t, "framed hello")
+	if frame.Type != "text" || message.Sender != "alice" || message.RoomName != "general" {
+		t.Fatalf("chat came back as %s %+v", frame.Type, message)
+	}
+	if frame.ID <= login.ID {
+		t.Fatalf("frame ids went from %d to %d", login.ID, frame.ID)
+	}
+
+	c.mustSend(t, `{"v":2,"type":`)
+	c.waitForFrame(t, "Malformed frame")
+	c.sendFrame(t, Message{Type: "teleport"})
+	c.waitForFrame(t, "Unknown frame type: teleport")
+}
+
+func TestLegacyFallback(t *testing.T) {
+	_, addr := startServer(t, Config{Logger: testLogger()})
+
+	// Without a hello the connection speaks v1 from the start
+	legacy := loginClient(t, addr, "alice")
+	legacy.mustSend(t, "plain text")
+	if _, err := legacy.waitFor("chat", func(m Message) bool { return m.Content == "plain text" && m.Sender == "alice" }); err != nil {
+		t.Fatal(err)
+	}
+
+	// A hello offering only unknown versions is refused and the connection
+	// stays legacy
+	c := dialClient(t, addr)
+	hello, err := encodeControlFrame(0, "hello", Hello{Versions: []int{3}, Agent: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.mustSend(t, string(hello))
+	c.conn.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		line, err := c.reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("waiting for the refusal: %v", err)
+		}
+		var frame Frame
+		if json.Unmarshal(line, &frame) == nil && frame.V == protocolV2 {
+			if frame.Type != "error" {
+				t.Fatalf("hello for v3 answered with %s", line)
+			}
+			break
+		}
+	}
+	if err := c.register("bob"); err != nil {
+		t.Fatal(err)
+	}
+	c.mustSend(t, "/rooms")
+	line := c.mustWaitForContent(t, "Available rooms")
+	if line.Type != "text" {
+		t.Fatalf("legacy reply has type %q", line.Type)
+	}
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSendQueueSize = 256
+	defaultWriteTimeout  = 10 * time.Second
+)
+
+// SlowConsumerPolicy decides what happens when a client's send queue is full
+type SlowConsumerPolicy int
+
+const (
+	// DropOldest discards the oldest queued chat messages to make room
+	DropOldest SlowConsumerPolicy = iota
+	// Disconnect closes the connection of the slow client
+	Disconnect
+	// MarkLagging discards new messages until the client has caught up
+	MarkLagging
+)
+
+var (
+	errSlowConsumer = errors.New("send queue full")
+	errQueueClosed  = errors.New("client disconnected")
+)
+
+func (p SlowConsumerPolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop-oldest"
+	case Disconnect:
+		return "disconnect"
+	case MarkLagging:
+		return "lag"
+	}
+	return fmt.Sprintf("SlowConsumerPolicy(%d)", int(p))
+}
+
+// ParseSlowConsumerPolicy parses "drop-oldest", "disconnect" or "lag"
+func ParseSlowConsumerPolicy(name string) (SlowConsumerPolicy, error) {
+	for _, p := range []SlowConsumerPolicy{DropOldest, Disconnect, MarkLagging} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown slow consumer policy %q", name)
+}
+
+// Metrics counts outbound delivery problems since the server started
+type Metrics struct {
+	MessagesDropped   uint64 // Messages discarded because a send queue was full
+	SlowConsumers     uint64 // Times a client's send queue filled up
+	SlowConsumerKicks uint64 // Clients disconnected by the Disconnect policy
+	WriteTimeouts     uint64 // Clients disconnected because a write timed out
+	StalledTransfers  uint64 // File transfers aborted because the receiver stopped reading
+}
+
+// serverMetrics holds the live counters behind Metrics
+type serverMetrics struct {
+	messagesDropped   atomic.Uint64
+	slowConsumers     atomic.Uint64
+	slowConsumerKicks atomic.Uint64
+	writeTimeouts     atomic.Uint64
+	stalledTransfers  atomic.Uint64
+}
+
+// Metrics returns a snapshot of the delivery counters
+func (s *Server) Metrics() Metrics {
+	return Metrics{
+		MessagesDropped:   s.metrics.messagesDropped.Load(),
+		SlowConsumers:     s.metrics.slowConsumers.Load(),
+		SlowConsumerKicks: s.metrics.slowConsumerKicks.Load(),
+		WriteTimeouts:     s.metrics.writeTimeouts.Load(),
+		StalledTransfers:  s.metrics.stalledTransfers.Load(),
+	}
+}
+
+// queuedFrame is an encoded message waiting to be written
+type queuedFrame struct {
+	data     []byte
+	reliable bool // File transfer traffic, never dropped
+}
+
+// sendQueue is a client's bounded queue of outgoing frames, drained by
+// writePump. Chat messages are subject to the slow consumer policy when the
+// queue is full; reliable frames wait for space instead.
+type sendQueue struct {
+	mutex   sync.Mutex
+	frames  []queuedFrame
+	size    int
+	missed  int // Messages dropped since the client last caught up
+	closed  bool
+	pending chan struct{} // Wakes writePump when frames are added
+	space   chan struct{} // Wakes reliable senders when frames are removed
+	done    chan struct{} // Closed with the queue
+}
+
+func newSendQueue(size int) *sendQueue {
+	return &sendQueue{
+		size:    size,
+		pending: make(chan struct{}, 1),
+		space:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// wake signals whoever waits on ch without blocking
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// push adds a chat message, applying policy if the queue is full. If a
+// message had to be dropped it returns how many were dropped since the
+// client last caught up. Under the Disconnect policy it returns
+// errSlowConsumer instead.
+func (q *sendQueue) push(data []byte, policy SlowConsumerPolicy) (missed int, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return 0, nil
+	}
+
+	if len(q.frames) >= q.size {
+		switch policy {
+		case Disconnect:
+			return 0, errSlowConsumer
+		case MarkLagging:
+			q.missed++
+			return q.missed, nil
+		default:
+			// Make room by dropping the oldest chat message
+			removed := false
+			for i, frame := range q.frames {
+				if !frame.reliable {
+					q.frames = append(q.frames[:i], q.frames[i+1:]...)
+					removed = true
+					break
+				}
+			}
+			q.missed++
+			if !removed {
+				// Only file traffic is queued, drop the new message instead
+				return q.missed, nil
+			}
+			missed = q.missed
+		}
+	}
+
+	q.frames = append(q.frames, queuedFrame{data: data})
+	wake(q.pending)
+	return missed, nil
+}
+
+// pushReliable adds a frame that must not be dropped, waiting up to timeout
+// for space in the queue
+func (q *sendQueue) pushReliable(data []byte, timeout time.Duration) error {
+	var deadline <-chan time.Time
+	for {
+		q.mutex.Lock()
+		if q.closed {
+			q.mutex.Unlock()
+			return errQueueClosed
+		}
+		if len(q.frames) < q.size {
+			q.frames = append(q.frames, queuedFrame{data: data, reliable: true})
+			q.mutex.Unlock()
+			wake(q.pending)
+			return nil
+		}
+		q.mutex.Unlock()
+
+		if deadline == nil {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		select {
+		case <-q.space:
+		case <-q.done:
+		case <-deadline:
+			return errSlowConsumer
+		}
+	}
+}
+
+// pushControl adds a frame that must not be dropped without waiting for
+// space, going over the size if the queue is full. It is only for the few
+// messages that end a file transfer, so the queue cannot grow far.
+func (q *sendQueue) pushControl(data []byte) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return errQueueClosed
+	}
+	q.frames = append(q.frames, queuedFrame{data: data, reliable: true})
+	wake(q.pending)
+	return nil
+}
+
+// pop waits for the next frame. It returns false once the queue is closed
+// and empty.
+func (q *sendQueue) pop() ([]byte, bool) {
+	for {
+		q.mutex.Lock()
+		if len(q.frames) > 0 {
+			frame := q.frames[0]
+			q.frames[0] = queuedFrame{}
+			q.frames = q.frames[1:]
+			q.mutex.Unlock()
+			wake(q.space)
+			return frame.data, true
+		}
+		closed := q.closed
+		q.mutex.Unlock()
+
+		if closed {
+			return nil, false
+		}
+		select {
+		case <-q.pending:
+		case <-q.done:
+		}
+	}
+}
+
+// caughtUp returns how many messages were dropped if the queue has drained
+// since, resetting the count
+func (q *sendQueue) caughtUp() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.frames) > 0 || q.missed == 0 {
+		return 0
+	}
+	missed := q.missed
+	q.missed = 0
+	return missed
+}
+
+// close stops the queue. With flush the frames already queued are still
+// written, otherwise they are discarded. Later calls have no effect.
+func (q *sendQueue) close(flush bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// The first close decides whether to flush
+	if q.closed {
+		return
+	}
+	if !flush {
+		q.frames = nil
+	}
+	q.closed = true
+	close(q.done)
+}
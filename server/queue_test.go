@@ -0,0 +1,178 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// queued returns the frames waiting in q as strings, oldest first
+func queued(q *sendQueue) []string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	var frames []string
+	for _, frame := range q.frames {
+		frames = append(frames, string(frame.data))
+	}
+	return frames
+}
+
+// checkQueued fails unless q holds exactly the given frames
+func checkQueued(t *testing.T, q *sendQueue, want ...string) {
+	t.Helper()
+	if got := queued(q); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("queue holds %v, want %v", got, want)
+	}
+}
+
+// mustPush pushes frames that are expected to fit
+func mustPush(t *testing.T, q *sendQueue, policy SlowConsumerPolicy, frames ...string) {
+	t.Helper()
+	for _, frame := range frames {
+		if missed, err := q.push([]byte(frame), policy); missed != 0 || err != nil {
+			t.Fatalf("push %s into a queue with room gave %d, %v", frame, missed, err)
+		}
+	}
+}
+
+func TestSendQueueDropOldest(t *testing.T) {
+	q := newSendQueue(3)
+	if err := q.pushReliable([]byte("chunk"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	mustPush(t, q, DropOldest, "a", "b")
+
+	// The oldest chat message goes, the file chunk before it stays
+	for i, frame := range []string{"c", "d"} {
+		missed, err := q.push([]byte(frame), DropOldest)
+		if err != nil || missed != i+1 {
+			t.Fatalf("push %s into a full queue gave %d, %v, want %d dropped", frame, missed, err, i+1)
+		}
+	}
+	checkQueued(t, q, "chunk", "c", "d")
+
+	// With only file chunks queued the new message is the one dropped
+	q = newSendQueue(2)
+	for _, frame := range []string{"chunk1", "chunk2"} {
+		if err := q.pushReliable([]byte(frame), time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if missed, err := q.push([]byte("a"), DropOldest); err != nil || missed != 1 {
+		t.Fatalf("push into a queue of chunks gave %d, %v", missed, err)
+	}
+	checkQueued(t, q, "chunk1", "chunk2")
+}
+
+func TestSendQueueDisconnect(t *testing.T) {
+	q := newSendQueue(2)
+	mustPush(t, q, Disconnect, "a", "b")
+	if _, err := q.push([]byte("c"), Disconnect); err != errSlowConsumer {
+		t.Fatalf("push into a full queue gave %v, want %v", err, errSlowConsumer)
+	}
+	checkQueued(t, q, "a", "b")
+}
+
+func TestSendQueueMarkLagging(t *testing.T) {
+	q := newSendQueue(2)
+	mustPush(t, q, MarkLagging, "a", "b")
+
+	// New messages are dropped and counted while the client lags
+	for i, frame := range []string{"c", "d", "e"} {
+		missed, err := q.push([]byte(frame), MarkLagging)
+		if err != nil || missed != i+1 {
+			t.Fatalf("push %s into a full queue gave %d, %v, want %d dropped", frame, missed, err, i+1)
+		}
+	}
+	checkQueued(t, q, "a", "b")
+
+	// The count is reported once, after the queue drains
+	q.pop()
+	if missed := q.caughtUp(); missed != 0 {
+		t.Fatalf("caughtUp with a frame queued gave %d", missed)
+	}
+	q.pop()
+	if missed := q.caughtUp(); missed != 3 {
+		t.Fatalf("caughtUp gave %d, want 3", missed)
+	}
+	if missed := q.caughtUp(); missed != 0 {
+		t.Fatalf("second caughtUp gave %d, want 0", missed)
+	}
+	mustPush(t, q, MarkLagging, "f")
+	checkQueued(t, q, "f")
+}
+
+func TestSendQueuePushReliable(t *testing.T) {
+	// A receiver that never reads times the sender out
+	q := newSendQueue(1)
+	mustPush(t, q, DropOldest, "a")
+	start := time.Now()
+	if err := q.pushReliable([]byte("chunk"), 50*time.Millisecond); err != errSlowConsumer {
+		t.Fatalf("pushReliable into a stuck queue gave %v, want %v", err, errSlowConsumer)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Fatalf("pushReliable gave up after %v, before its timeout", waited)
+	}
+	checkQueued(t, q, "a")
+
+	// One that catches up lets the sender through
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.pop()
+	}()
+	if err := q.pushReliable([]byte("chunk"), testTimeout); err != nil {
+		t.Fatalf("pushReliable after the queue drained gave %v", err)
+	}
+	checkQueued(t, q, "chunk")
+
+	// One that disconnects releases the sender at once
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.close(false)
+	}()
+	if err := q.pushReliable([]byte("chunk2"), testTimeout); err != errQueueClosed {
+		t.Fatalf("pushReliable on a closed queue gave %v, want %v", err, errQueueClosed)
+	}
+}
+
+func TestDeliverReliableTypes(t *testing.T) {
+	server := NewServerWithConfig(Config{SendQueueSize: 2, WriteTimeout: testTimeout, Logger: testLogger()})
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	// No writePump, the client never reads
+	c := NewClient(conn, server)
+	for _, chunk := range []string{"chunk1", "chunk2"} {
+		if err := c.queueReliable([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, messageType := range []string{"file-request", "text", "file-complete", "file-aborted"} {
+			c.deliver(Message{Sender: "alice", FileName: "report.pdf", Type: messageType})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(testTimeout / 2):
+		t.Fatal("deliver waited for a client that is not reading")
+	}
+
+	// The request and chat message were dropped, the end of the transfer was not
+	var types []string
+	for _, frame := range queued(c.send)[2:] {
+		var message Message
+		if err := json.Unmarshal([]byte(frame), &message); err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, message.Type)
+	}
+	if fmt.Sprint(types) != "[file-complete file-aborted]" {
+		t.Fatalf("queued %v after the chunks, want the file-complete and file-aborted", types)
+	}
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultResumeGrace = 2 * time.Minute
+	resumeTokenBytes   = 24
+)
+
+var ErrResumeExpired = errors.New("unknown or expired session, log in again")
+
+// resumable is what a session token brings back after a dropped connection.
+// Flood violations and mutes are kept per user, so they carry over as well.
+type resumable struct {
+	username    string
+	client      *Client   // The session while it is connected, nil once dropped
+	rooms       []string  // Rooms the session was in when it dropped
+	currentRoom string    // Where plain text went
+	expires     time.Time // End of the grace window once dropped
+	lastID      uint64    // Newest message the client says it has seen, 0 to replay nothing
+}
+
+// resumeTokens maps session tokens to the sessions they resume. A token can
+// be used once; resuming issues a new one.
+type resumeTokens struct {
+	tokens map[string]*resumable
+	grace  time.Duration // Negative disables resuming
+	mutex  sync.Mutex
+}
+
+func newResumeTokens(grace time.Duration) *resumeTokens {
+	return &resumeTokens{
+		tokens: make(map[string]*resumable),
+		grace:  grace,
+	}
+}
+
+// issue creates a token for client. It returns "" if resuming is disabled.
+func (r *resumeTokens) issue(client *Client, username string) (string, error) {
+	if r.grace < 0 {
+		return "", nil
+	}
+	buf := make([]byte, resumeTokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Drop tokens whose grace window has passed while we hold the lock
+	now := time.Now()
+	for t, state := range r.tokens {
+		if state.client == nil && now.After(state.expires) {
+			delete(r.tokens, t)
+		}
+	}
+
+	r.tokens[token] = &resumable{username: username, client: client}
+	return token, nil
+}
+
+// suspend starts the grace window of a token whose connection dropped
+func (r *resumeTokens) suspend(token string, rooms []string, currentRoom string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	state, ok := r.tokens[token]
+	if !ok {
+		return
+	}
+	state.client = nil
+	state.rooms = rooms
+	state.currentRoom = currentRoom
+	state.expires = time.Now().Add(r.grace)
+}
+
+// take removes a token and returns the session it resumes
+func (r *resumeTokens) take(token string) (*resumable, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	state, ok := r.tokens[token]
+	if !ok {
+		return nil, ErrResumeExpired
+	}
+	delete(r.tokens, token)
+	if state.client == nil && time.Now().After(state.expires) {
+		return nil, ErrResumeExpired
+	}
+	return state, nil
+}
+
+// revoke invalidates a token
+func (r *resumeTokens) revoke(token string) {
+	if token == "" {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.tokens, token)
+}
+
+// revokeResume makes the session impossible to resume. It is for
+// connections the server closes on purpose rather than ones that drop.
+func (c *Client) revokeResume() {
+	c.server.resume.revoke(c.takeResumeToken())
+}
+
+// takeResumeToken returns the client's token and forgets it
+func (c *Client) takeResumeToken() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	token := c.resumeToken
+	c.resumeToken = ""
+	return token
+}
+
+// issueResumeToken gives the client a token to resume its session with
+func (c *Client) issueResumeToken() {
+	token, err := c.server.resume.issue(c, c.username)
+	if err != nil {
+		c.server.logger.Printf("Error creating session token for %s: %v", c.username, err)
+		return
+	}
+	if token == "" {
+		return
+	}
+
+	c.mutex.Lock()
+	c.resumeToken = token
+	c.mutex.Unlock()
+
+	c.deliver(Message{Sender: "Server", Content: token, Type: "session"})
+}
+
+// suspend keeps the rooms of a dropped session for the grace window. A
+// session the server ended has no token left to suspend.
+func (c *Client) suspend(rooms []*Room) {
+	token := c.takeResumeToken()
+	if token == "" {
+		return
+	}
+	names := make([]string, len(rooms))
+	for i, room := range rooms {
+		names[i] = room.name
+	}
+	c.server.resume.suspend(token, names, c.CurrentRoom())
+}
+
+// resumeSession logs the client in as the session token belongs to,
+// rejoining its rooms and replaying what it missed after lastID
+func (c *Client) resumeSession(token string, lastID uint64) {
+	state, err := c.server.resume.take(token)
+	if err == nil {
+		_, err = c.server.users.Get(state.username)
+	}
+	if err != nil {
+		c.deliver(Message{Sender: "Server", Content: "Resume failed: " + ErrResumeExpired.Error(), Type: "text"})
+		c.server.logger.Printf("Failed to resume a session from %s: %v", c.ip, err)
+		return
+	}
+
+	// The old connection may not have noticed it is gone yet
+	if old := state.client; old != nil {
+		for _, room := range c.server.roomsOf(old) {
+			state.rooms = append(state.rooms, room.name)
+		}
+		state.currentRoom = old.CurrentRoom()
+		old.logout("This session was resumed from " + c.ip)
+	}
+	state.lastID = lastID
+
+	if !c.completeLogin(state.username, "Session resumed, logged in as "+state.username+".", state) {
+		return
+	}
+	c.server.securityEvent(EventSessionResumed, state.username, c.ip, fmt.Sprintf("%d rooms", len(state.rooms)))
+}
+
+// restoreRooms rejoins the rooms of a resumed session and replays the
+// messages posted there after the last one the client saw
+func (c *Client) restoreRooms(state *resumable) {
+	for _, name := range state.rooms {
+		room := c.server.getRoom(name)
+		if room == nil {
+			c.deliver(Message{Sender: "Server", Content: "Room " + name + " no longer exists", Type: "text"})
+			continue
+		}
+		if room.IsBanned(c.username) {
+			c.deliver(Message{Sender: "Server", Content: "You are banned from " + name, Type: "text"})
+			continue
+		}
+		// Take the history while joining so nothing arrives twice
+		room.addClient(c, func() {
+			messages, pos := room.RecentHistory(c.server.historySize)
+			c.historyPos[name] = pos
+			if state.lastID == 0 {
+				// The client did not say what it has seen, /history can page back
+				return
+			}
+			missed := messages[:0:0]
+			for _, message := range messages {
+				if message.ID > state.lastID {
+					missed = append(missed, message)
+				}
+			}
+			c.sendHistory(missed)
+		})
+	}
+
+	if room := c.server.getRoom(state.currentRoom); room != nil && room.HasClient(c) {
+		c.switchRoom(room.name)
+	} else {
+		c.switchAway()
+	}
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sessionToken waits for the token the server sends after a login
+func (c *testClient) sessionToken(t *testing.T) string {
+	t.Helper()
+	message, err := c.waitFor("session token", func(m Message) bool { return m.Type == "session" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message.Content
+}
+
+// waitUntil polls cond until it holds
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// dropConnection closes c as a network failure would and waits for the
+// server to notice
+func dropConnection(t *testing.T, s *Server, c *testClient, username string) {
+	t.Helper()
+	c.conn.Close()
+	waitUntil(t, username+" to be offline", func() bool { return len(s.Sessions(username)) == 0 })
+}
+
+// postAndWait posts lines as c and waits until c sees the last of them
+func postAndWait(t *testing.T, c *testClient, username string, lines ...string) []Message {
+	t.Helper()
+	var posted []Message
+	for _, line := range lines {
+		c.mustSend(t, line)
+		message, err := c.waitFor(line, func(m Message) bool { return m.Sender == username && m.Content == line })
+		if err != nil {
+			t.Fatal(err)
+		}
+		posted = append(posted, message)
+	}
+	return posted
+}
+
+func TestResumeReplay(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		lastID func(seen []Message) uint64
+		want   string // Contents replayed as history
+	}{
+		{"after last seen", func(seen []Message) uint64 { return seen[1].ID }, "[three four]"},
+		{"after first seen", func(seen []Message) uint64 { return seen[0].ID }, "[two three four]"},
+		{"nothing seen", func(seen []Message) uint64 { return 0 }, "[]"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s, addr := startServer(t, Config{Logger: testLogger()})
+			alice := loginClient(t, addr, "alice")
+			token := alice.sessionToken(t)
+			bob := loginClient(t, addr, "bob")
+
+			seen := postAndWait(t, bob, "bob", "one", "two")
+			for _, message := range seen {
+				if _, err := alice.waitFor(message.Content, func(m Message) bool { return m.ID == message.ID }); err != nil {
+					t.Fatal(err)
+				}
+			}
+			dropConnection(t, s, alice, "alice")
+			postAndWait(t, bob, "bob", "three", "four")
+
+			again := dialClient(t, addr)
+			again.mustSend(t, fmt.Sprintf("/resume %s %d", token, c.lastID(seen)))
+			again.mustWaitForContent(t, "Session resumed")
+			bob.mustSend(t, "five")
+
+			// Everything up to the live message, each exactly once
+			var replayed []string
+			ids := make(map[uint64]bool)
+			_, err := again.waitFor("five", func(m Message) bool {
+				if m.Sender != "bob" {
+					return false
+				}
+				if ids[m.ID] {
+					t.Errorf("message %q arrived twice", m.Content)
+				}
+				ids[m.ID] = true
+				if m.Type == "history" {
+					replayed = append(replayed, m.Content)
+				}
+				return m.Content == "five"
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(replayed) != c.want {
+				t.Fatalf("replayed %v, want %s", replayed, c.want)
+			}
+		})
+	}
+}
+
+func TestResumeTokenSingleUse(t *testing.T) {
+	s, addr := startServer(t, Config{Logger: testLogger()})
+	alice := loginClient(t, addr, "alice")
+	token := alice.sessionToken(t)
+	dropConnection(t, s, alice, "alice")
+
+	resumed := dialClient(t, addr)
+	resumed.mustSend(t, "/resume "+token)
+	resumed.mustWaitForContent(t, "Session resumed")
+	if next := resumed.sessionToken(t); next == token {
+		t.Fatal("resuming handed out the same token again")
+	}
+
+	// Neither while the resumed session is connected nor after it drops
+	again := dialClient(t, addr)
+	again.mustSend(t, "/resume "+token)
+	again.mustWaitForContent(t, "Resume failed")
+	dropConnection(t, s, resumed, "alice")
+	again.mustSend(t, "/resume "+token)
+	again.mustWaitForContent(t, "Resume failed")
+}
+
+func TestResumeTokenExpiry(t *testing.T) {
+	s, addr := startServer(t, Config{ResumeGrace: 50 * time.Millisecond, Logger: testLogger()})
+	alice := loginClient(t, addr, "alice")
+	token := alice.sessionToken(t)
+	dropConnection(t, s, alice, "alice")
+	time.Sleep(100 * time.Millisecond)
+
+	again := dialClient(t, addr)
+	again.mustSend(t, "/resume "+token)
+	again.mustWaitForContent(t, "Resume failed")
+	if len(s.Sessions("alice")) != 0 {
+		t.Fatal("an expired token logged alice in")
+	}
+}
+
+func TestResumeRevokedWhenDisconnected(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		disconnect func(c *Client)
+	}{
+		{"kicked", func(c *Client) { c.kick() }},
+		{"slow consumer", func(c *Client) {
+			// The token message filled the queue
+			c.deliver(Message{Sender: "Server", Content: "one too many", Type: "text"})
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s := NewServerWithConfig(Config{SendQueueSize: 1, SlowConsumerPolicy: Disconnect, Logger: testLogger()})
+			conn, peer := net.Pipe()
+			defer conn.Close()
+			defer peer.Close()
+			client := NewClient(conn, s)
+			client.username, client.authenticated = "alice", true
+			client.issueResumeToken()
+			token := client.resumeToken
+
+			c.disconnect(client)
+			client.suspend(nil)
+			if _, err := s.resume.take(token); err != ErrResumeExpired {
+				t.Fatalf("token of a session the server ended gave %v, want %v", err, ErrResumeExpired)
+			}
+		})
+	}
+}
+
+func TestResumeKeepsMute(t *testing.T) {
+	s, addr := startServer(t, Config{
+		MessageRate:     10,
+		MessageBurst:    3,
+		MuteAfter:       1,
+		MuteDuration:    time.Minute,
+		DisconnectAfter: -1,
+		Logger:          testLogger(),
+	})
+	alice := loginClient(t, addr, "alice")
+	token := alice.sessionToken(t)
+	for _, line := range []string{"one", "two", "three", "four"} {
+		alice.mustSend(t, line)
+	}
+	alice.mustWaitForContent(t, "You are muted for 1m0s")
+	dropConnection(t, s, alice, "alice")
+	time.Sleep(300 * time.Millisecond)
+
+	again := dialClient(t, addr)
+	again.mustSend(t, "/resume "+token)
+	again.mustWaitForContent(t, "Session resumed")
+	again.mustSend(t, "hello")
+	again.mustWaitForContent(t, "You are muted for another")
+}
+
+func TestResumeTokenNotLogged(t *testing.T) {
+	var logs syncBuffer
+	s, addr := startServer(t, Config{Logger: log.New(&logs, "", 0)})
+	alice := loginClient(t, addr, "alice")
+	token := alice.sessionToken(t)
+	dropConnection(t, s, alice, "alice")
+
+	again := dialClient(t, addr)
+	again.mustSend(t, "/resume "+token+" 0")
+	again.mustWaitForContent(t, "Session resumed")
+	if strings.Contains(logs.String(), token) {
+		t.Fatalf("session token in the log:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,376 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Role is a user's standing in a room
+type Role int
+
+const (
+	RoleMember Role = iota
+	RoleOperator
+	RoleOwner
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleMember:
+		return "member"
+	case RoleOperator:
+		return "operator"
+	case RoleOwner:
+		return "owner"
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// Permission is a moderation action in a room
+type Permission int
+
+const (
+	PermKick Permission = iota
+	PermBan             // Also unban
+	PermSetTopic
+	PermInvite
+	PermOp // Grant and revoke operator status
+	PermDeleteRoom
+	PermSetMode
+)
+
+// rolePermissions lists what each role may do. Members may do none of it.
+var rolePermissions = map[Role][]Permission{
+	RoleOperator: {PermKick, PermBan, PermSetTopic, PermInvite},
+	RoleOwner:    {PermKick, PermBan, PermSetTopic, PermInvite, PermOp, PermDeleteRoom, PermSetMode},
+}
+
+// Can reports whether the role grants permission
+func (r Role) Can(permission Permission) bool {
+	for _, p := range rolePermissions[r] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// RoomState is what is kept about a room across restarts besides its messages
+type RoomState struct {
+	Owner        string   `json:",omitempty"`
+	Operators    []string `json:",omitempty"`
+	Banned       []string `json:",omitempty"`
+	Mode         string   `json:",omitempty"` // RoomMode name, public if empty
+	PasswordHash string   `json:",omitempty"`
+	Invited      []string `json:",omitempty"`
+	Topic        string   `json:",omitempty"`
+	Description  string   `json:",omitempty"`
+	Created      time.Time
+	Persistent   bool `json:",omitempty"` // Kept while empty
+}
+
+// Owner returns the username of the room's creator, empty for rooms made by the server
+func (r *Room) Owner() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.owner
+}
+
+// Role returns the role of username in the room
+func (r *Room) Role(username string) Role {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.role(username)
+}
+
+func (r *Room) role(username string) Role {
+	switch {
+	case r.owner != "" && r.owner == username:
+		return RoleOwner
+	case r.operators[username]:
+		return RoleOperator
+	}
+	return RoleMember
+}
+
+// SetOperator grants or revokes operator status. The owner's role does not change.
+func (r *Room) SetOperator(username string, op bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if op {
+		r.operators[username] = true
+	} else {
+		delete(r.operators, username)
+	}
+}
+
+// IsBanned reports whether username may not join the room
+func (r *Room) IsBanned(username string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.banned[username]
+}
+
+// Ban keeps username out of the room and revokes its operator status and
+// invitation. Its clients in the room are removed with notice, and returned.
+func (r *Room) Ban(username, notice string) []*Client {
+	r.mutex.Lock()
+	r.banned[username] = true
+	delete(r.operators, username)
+	delete(r.invited, username)
+	r.mutex.Unlock()
+
+	return r.RemoveUser(username, notice)
+}
+
+// Unban lets username join again, reporting whether it was banned
+func (r *Room) Unban(username string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.banned[username] {
+		return false
+	}
+	delete(r.banned, username)
+	return true
+}
+
+// RemoveUser removes every client of username from the room, telling the
+// other members notice, and returns the removed clients
+func (r *Room) RemoveUser(username, notice string) []*Client {
+	var removed []*Client
+	r.mutex.Lock()
+	for client := range r.clients {
+		if client.Username() == username {
+			removed = append(removed, client)
+		}
+	}
+	r.mutex.Unlock()
+
+	for _, client := range removed {
+		r.removeClient(client, notice)
+	}
+	return removed
+}
+
+// HasClient reports whether client is in the room
+func (r *Room) HasClient(client *Client) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.clients[client]
+}
+
+// State returns the room's persistent state
+func (r *Room) State() RoomState {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	state := RoomState{
+		Owner:        r.owner,
+		PasswordHash: r.passwordHash,
+		Topic:        r.topic,
+		Description:  r.description,
+		Created:      r.created,
+		Persistent:   r.persistent,
+	}
+	if r.mode != ModePublic {
+		state.Mode = r.mode.String()
+	}
+	state.Operators = sortedKeys(r.operators)
+	state.Banned = sortedKeys(r.banned)
+	state.Invited = sortedKeys(r.invited)
+	return state
+}
+
+// restore replaces the room's state with one loaded from disk
+func (r *Room) restore(state RoomState) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.owner = state.Owner
+	r.operators = make(map[string]bool)
+	for _, username := range state.Operators {
+		r.operators[username] = true
+	}
+	r.banned = make(map[string]bool)
+	for _, username := range state.Banned {
+		r.banned[username] = true
+	}
+	r.invited = make(map[string]bool)
+	for _, username := range state.Invited {
+		r.invited[username] = true
+	}
+	r.mode = ModePublic
+	if state.Mode != "" {
+		mode, err := ParseRoomMode(state.Mode)
+		if err == nil {
+			r.mode = mode
+		}
+	}
+	r.passwordHash = state.PasswordHash
+	r.topic = state.Topic
+	r.description = state.Description
+	r.created = state.Created
+	r.persistent = state.Persistent
+}
+
+// sortedKeys returns the usernames in a set in alphabetical order
+func sortedKeys(set map[string]bool) []string {
+	var keys []string
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// roomRole returns the role of username in room. Server admins count as
+// owners of every room.
+func (s *Server) roomRole(room *Room, username string) Role {
+	if s.IsAdmin(username) {
+		return RoleOwner
+	}
+	return room.Role(username)
+}
+
+// saveRoom writes the state of room to the message log, if there is one
+func (s *Server) saveRoom(room *Room) {
+	if s.messageLog == nil {
+		return
+	}
+	if err := s.messageLog.SaveRoom(room.name, room.State()); err != nil {
+		s.logger.Printf("Error saving room %s: %v", room.name, err)
+	}
+}
+
+// moderatedRoom returns the client's current room if it has permission
+// there, telling the client why not otherwise
+func (c *Client) moderatedRoom(permission Permission) *Room {
+	room := c.server.getRoom(c.CurrentRoom())
+	if room == nil || !room.HasClient(c) {
+		c.deliver(Message{Sender: "Server", Content: "You are not in any room", Type: "text"})
+		return nil
+	}
+	if !c.server.roomRole(room, c.username).Can(permission) {
+		c.deliver(Message{Sender: "Server", Content: "You do not have permission to do that in " + room.name, Type: "text"})
+		return nil
+	}
+	return room
+}
+
+// outranks reports whether the client may act against target in room,
+// telling the client if not. Admins outrank everyone else.
+func (c *Client) outranks(room *Room, target string) bool {
+	if target == c.username {
+		c.deliver(Message{Sender: "Server", Content: "You cannot do that to yourself", Type: "text"})
+		return false
+	}
+	if c.server.IsAdmin(c.username) && !c.server.IsAdmin(target) {
+		return true
+	}
+	if c.server.roomRole(room, c.username) <= c.server.roomRole(room, target) {
+		c.deliver(Message{Sender: "Server", Content: target + " is " + c.server.roomRole(room, target).String() + " of " + room.name, Type: "text"})
+		return false
+	}
+	return true
+}
+
+// setOperator grants or revokes operator status in the client's room
+func (c *Client) setOperator(target string, op bool) {
+	room := c.moderatedRoom(PermOp)
+	if room == nil {
+		return
+	}
+	if _, err := c.server.users.Get(target); err != nil {
+		c.deliver(Message{Sender: "Server", Content: "No such user: " + target, Type: "text"})
+		return
+	}
+	if room.Role(target) == RoleOwner {
+		c.deliver(Message{Sender: "Server", Content: target + " owns " + room.name, Type: "text"})
+		return
+	}
+	if (room.Role(target) == RoleOperator) == op {
+		c.deliver(Message{Sender: "Server", Content: "Nothing to do, " + target + " is " + room.Role(target).String() + " of " + room.name, Type: "text"})
+		return
+	}
+
+	room.SetOperator(target, op)
+	c.server.saveRoom(room)
+
+	content := target + " is now an operator of " + room.name
+	if !op {
+		content = target + " is no longer an operator of " + room.name
+	}
+	room.Announce(content + " (set by " + c.username + ")")
+	c.server.logger.Printf("%s set operator status of %s in %s to %v", c.username, target, room.name, op)
+}
+
+// kickUser removes target from the client's room
+func (c *Client) kickUser(target, reason string) {
+	room := c.moderatedRoom(PermKick)
+	if room == nil || !c.outranks(room, target) {
+		return
+	}
+
+	kicked := room.RemoveUser(target, target+" was kicked by "+c.username+withReason(reason))
+	if len(kicked) == 0 {
+		c.deliver(Message{Sender: "Server", Content: target + " is not in " + room.name, Type: "text"})
+		return
+	}
+	for _, client := range kicked {
+		client.deliver(Message{Sender: "Server", Content: "You were kicked from " + room.name + " by " + c.username + withReason(reason), Type: "text"})
+		client.removedFrom(room.name)
+	}
+	c.server.logger.Printf("%s kicked %s from %s", c.username, target, room.name)
+}
+
+// banUser keeps target out of the client's room, removing it if present
+func (c *Client) banUser(target, reason string) {
+	room := c.moderatedRoom(PermBan)
+	if room == nil || !c.outranks(room, target) {
+		return
+	}
+	if room.IsBanned(target) {
+		c.deliver(Message{Sender: "Server", Content: target + " is already banned from " + room.name, Type: "text"})
+		return
+	}
+
+	for _, client := range room.Ban(target, target+" was banned by "+c.username+withReason(reason)) {
+		client.deliver(Message{Sender: "Server", Content: "You were banned from " + room.name + " by " + c.username + withReason(reason), Type: "text"})
+		client.removedFrom(room.name)
+	}
+	c.server.saveRoom(room)
+
+	c.deliver(Message{Sender: "Server", Content: target + " is banned from " + room.name, Type: "text"})
+	c.server.logger.Printf("%s banned %s from %s", c.username, target, room.name)
+}
+
+// unbanUser lets target join the client's room again
+func (c *Client) unbanUser(target string) {
+	room := c.moderatedRoom(PermBan)
+	if room == nil {
+		return
+	}
+	if !room.Unban(target) {
+		c.deliver(Message{Sender: "Server", Content: target + " is not banned from " + room.name, Type: "text"})
+		return
+	}
+	c.server.saveRoom(room)
+
+	c.deliver(Message{Sender: "Server", Content: target + " may join " + room.name + " again", Type: "text"})
+	c.server.logger.Printf("%s unbanned %s from %s", c.username, target, room.name)
+}
+
+// withReason formats an optional reason for appending to a notice
+func withReason(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	return ": " + reason
+}
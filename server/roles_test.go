@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestRolePermissions(t *testing.T) {
+	all := []Permission{PermKick, PermBan, PermSetTopic, PermInvite, PermOp, PermDeleteRoom, PermSetMode}
+	allowed := map[Role][]Permission{
+		RoleMember:   nil,
+		RoleOperator: {PermKick, PermBan, PermSetTopic, PermInvite},
+		RoleOwner:    all,
+	}
+
+	for role, permissions := range allowed {
+		want := make(map[Permission]bool)
+		for _, p := range permissions {
+			want[p] = true
+		}
+		for _, p := range all {
+			if got := role.Can(p); got != want[p] {
+				t.Errorf("%s.Can(%d) = %v, want %v", role, p, got, want[p])
+			}
+		}
+	}
+}
+
+func TestOutranks(t *testing.T) {
+	s := NewServerWithConfig(Config{Admins: []string{"root", "root2"}, Logger: testLogger()})
+	room := NewRoom("den", nil)
+	room.restore(RoomState{Owner: "owner", Operators: []string{"op1", "op2"}})
+
+	for _, c := range []struct {
+		actor, target string
+		want          bool
+	}{
+		{"owner", "op1", true},
+		{"owner", "member1", true},
+		{"op1", "member1", true},
+		{"op1", "op2", false},
+		{"op1", "owner", false},
+		{"member1", "member2", false},
+		{"member1", "op1", false},
+		{"owner", "owner", false}, // Not even yourself
+		{"root", "owner", true},
+		{"root", "op1", true},
+		{"root", "root2", false},
+		{"owner", "root", false},
+		{"op1", "root", false},
+	} {
+		t.Run(fmt.Sprintf("%s-%s", c.actor, c.target), func(t *testing.T) {
+			conn, peer := net.Pipe()
+			defer conn.Close()
+			defer peer.Close()
+			client := NewClient(conn, s)
+			client.username, client.authenticated = c.actor, true
+
+			if got := client.outranks(room, c.target); got != c.want {
+				t.Fatalf("%s outranks %s = %v, want %v", c.actor, c.target, got, c.want)
+			}
+			// Refusals are explained
+			if !c.want && len(queued(client.send)) == 0 {
+				t.Fatal("refused without telling the client why")
+			}
+		})
+	}
+}
+
+func TestRemovedClientSwitchesRoom(t *testing.T) {
+	for _, command := range []string{"/kick", "/ban"} {
+		t.Run(command, func(t *testing.T) {
+			_, addr := startServer(t, Config{Logger: testLogger()})
+			alice := loginClient(t, addr, "alice")
+			bob := loginClient(t, addr, "bob")
+
+			alice.mustSend(t, "/join den")
+			alice.mustWaitForContent(t, "You have joined room: den")
+			bob.mustSend(t, "/join den")
+			bob.mustWaitForContent(t, "You have joined room: den")
+
+			alice.mustSend(t, command+" bob spamming")
+			bob.mustWaitForContent(t, "by alice: spamming")
+			bob.mustWaitForContent(t, "You have switched to room: general")
+
+			// Plain text goes to general now instead of being refused
+			bob.mustSend(t, "still here")
+			message, err := bob.waitFor("bob's message", func(m Message) bool { return m.Sender == "bob" })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if message.RoomName != "general" || message.Content != "still here" {
+				t.Fatalf("bob's message went to %q as %q", message.RoomName, message.Content)
+			}
+		})
+	}
+}
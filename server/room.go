@@ -2,57 +2,116 @@ package server
 
 import (
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 )
 
 type Room struct {
-	name    string
-	clients map[*Client]bool
-	mutex   sync.Mutex
+	name         string
+	clients      map[*Client]bool
+	history      History
+	owner        string          // Creator of the room, empty for rooms made by the server
+	operators    map[string]bool // Usernames allowed to moderate
+	banned       map[string]bool // Usernames that may not join
+	mode         RoomMode
+	passwordHash string          // Hash of the password of a ModePassword room
+	invited      map[string]bool // Usernames allowed into a ModeInviteOnly room
+	topic        string
+	description  string
+	created      time.Time // Zero if unknown
+	persistent   bool      // Kept while empty
+	lastActive   time.Time // Last join, part or message, for idle expiry
+	deleted      bool      // Removed from the server, nobody may join
+	mutex        sync.Mutex
 }
 
-func NewRoom(name string) *Room {
+func NewRoom(name string, history History) *Room {
+	if history == nil {
+		history = NewRingHistory(defaultHistorySize)
+	}
 	return &Room{
-		name:    name,
-		clients: make(map[*Client]bool),
+		name:       name,
+		clients:    make(map[*Client]bool),
+		history:    history,
+		operators:  make(map[string]bool),
+		banned:     make(map[string]bool),
+		invited:    make(map[string]bool),
+		created:    time.Now(),
+		lastActive: time.Now(),
 	}
 }
 
-func (r *Room) AddClient(client *Client) {
+// AddClient puts client in the room. It reports false if the room has just
+// been deleted.
+func (r *Room) AddClient(client *Client) bool {
+	return r.addClient(client, nil)
+}
+
+// addClient is AddClient, calling added once client is in the room but
+// before anything else is broadcast there. A message posted meanwhile is
+// either in the history added sees or delivered to client afterwards, never
+// both.
+func (r *Room) addClient(client *Client, added func()) bool {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
+	if r.deleted {
+		return false
+	}
+	present := r.hasUser(client.Username())
 	r.clients[client] = true
-	fmt.Printf("Added %s to room %s\n", client.username, r.name)
+	r.lastActive = time.Now()
+	fmt.Printf("Added %s to room %s\n", client.Username(), r.name)
+	if added != nil {
+		added()
+	}
+
+	// Another session of the user is already here, nothing to announce
+	if present {
+		return true
+	}
 
 	// Broadcast to room that a new user has joined, but not to the new user
 	for c := range r.clients {
-		if c != client && c.authenticated {
-			c.directSend(Message{
+		if c != client && c.IsAuthenticated() {
+			c.deliver(Message{
 				Sender:   "Server",
 				RoomName: r.name,
-				Content:  client.username + " has joined the room",
+				Content:  client.Username() + " has joined the room",
 				Type:     "text",
 			})
 		}
 	}
+	return true
 }
 
 func (r *Room) RemoveClient(client *Client) {
+	r.removeClient(client, client.Username()+" has left the room")
+}
+
+// removeClient takes client out of the room and tells the others notice
+func (r *Room) removeClient(client *Client, notice string) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
 	if _, ok := r.clients[client]; ok {
 		delete(r.clients, client)
-		fmt.Printf("Removed %s from room %s\n", client.username, r.name)
+		r.lastActive = time.Now()
+		fmt.Printf("Removed %s from room %s\n", client.Username(), r.name)
+
+		// The user is still here with another session
+		if r.hasUser(client.Username()) {
+			return
+		}
 
 		// Broadcast to room that a user has left
 		for c := range r.clients {
-			if c.authenticated {
-				c.directSend(Message{
+			if c.IsAuthenticated() {
+				c.deliver(Message{
 					Sender:   "Server",
 					RoomName: r.name,
-					Content:  client.username + " has left the room",
+					Content:  notice,
 					Type:     "text",
 				})
 			}
@@ -60,15 +119,81 @@ func (r *Room) RemoveClient(client *Client) {
 	}
 }
 
+// Announce tells everyone in the room something from the server, without
+// keeping it in the history
+func (r *Room) Announce(content string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for client := range r.clients {
+		if client.IsAuthenticated() {
+			client.deliver(Message{
+				Sender:   "Server",
+				RoomName: r.name,
+				Content:  content,
+				Type:     "text",
+			})
+		}
+	}
+}
+
 func (r *Room) Broadcast(message Message) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
 	fmt.Printf("Broadcasting in room %s: %s\n", r.name, message.Content)
+	r.lastActive = time.Now()
+
+	// Keep chat messages so they can be replayed to users joining later
+	if message.Type == "text" {
+		r.history.Add(message)
+	}
 
 	for client := range r.clients {
-		if client.authenticated {
-			client.directSend(message)
+		if client.IsAuthenticated() {
+			client.deliver(message)
 		}
 	}
 }
+
+// Usernames returns the names of the clients in the room
+func (r *Room) Usernames() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	usernames := make([]string, 0, len(r.clients))
+	seen := make(map[string]bool)
+	for client := range r.clients {
+		// Users with several sessions are listed once
+		if username := client.Username(); !seen[username] {
+			seen[username] = true
+			usernames = append(usernames, username)
+		}
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+// hasUser reports whether any session of username is in the room. The caller
+// must hold mutex.
+func (r *Room) hasUser(username string) bool {
+	for client := range r.clients {
+		if client.Username() == username {
+			return true
+		}
+	}
+	return false
+}
+
+// RecentHistory returns up to n of the newest messages, oldest first, along
+// with the position of the first one for paging further back
+func (r *Room) RecentHistory(n int) ([]Message, int) {
+	total := r.history.Total()
+	messages := r.history.Before(total, n)
+	return messages, total - len(messages)
+}
+
+// HistoryBefore returns up to n messages positioned before pos, oldest first
+func (r *Room) HistoryBefore(pos, n int) []Message {
+	return r.history.Before(pos, n)
+}
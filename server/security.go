@@ -0,0 +1,335 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLoginMaxFailures      = 5
+	defaultLoginMaxFailuresPerIP = 20
+	defaultLoginBackoff          = time.Second
+	defaultLoginLockout          = 15 * time.Minute
+
+	// Failure records kept before expired ones are swept
+	maxLoginRecords = 10000
+	// Security events kept in memory for /security
+	securityEventBuffer = 1000
+)
+
+// Security event types
+const (
+	EventLoginSuccess      = "login_success"
+	EventLoginFailure      = "login_failure"
+	EventLoginBlocked      = "login_blocked"
+	EventAccountLocked     = "account_locked"
+	EventAddressLocked     = "address_locked"
+	EventCertRejected      = "cert_rejected"
+	EventConnectionRefused = "connection_refused"
+	EventFloodMute         = "flood_mute"
+	EventFloodDisconnect   = "flood_disconnect"
+	EventAddressBanned     = "address_banned"
+	EventSessionResumed    = "session_resumed"
+	EventRoomPassword      = "room_password_failure"
+	EventRoomLocked        = "room_password_locked"
+	EventRoomBlocked       = "room_password_blocked"
+)
+
+// ErrInvalidCredentials is returned by AuthenticateUser for a wrong username or password
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// LoginBlockedError is returned by AuthenticateUser while a username or
+// address has to wait after failed logins
+type LoginBlockedError struct {
+	Username   string
+	Address    bool // The address is locked out rather than the account
+	Locked     bool // Locked out, as opposed to backing off between attempts
+	RetryAfter time.Duration
+}
+
+func (e *LoginBlockedError) Error() string {
+	wait := e.wait()
+	switch {
+	case e.Address:
+		return fmt.Sprintf("too many failed logins from your address, try again in %v", wait)
+	case e.Locked:
+		return fmt.Sprintf("account %s is locked after too many failed logins, try again in %v", e.Username, wait)
+	}
+	return fmt.Sprintf("too many failed logins for %s, try again in %v", e.Username, wait)
+}
+
+// wait returns RetryAfter in whole seconds, at least one
+func (e *LoginBlockedError) wait() time.Duration {
+	wait := e.RetryAfter.Round(time.Second)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait
+}
+
+// loginRecord counts the recent failed logins of a username or address
+type loginRecord struct {
+	failures    int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// loginGuard tracks failed logins per username and per address. Every
+// failure doubles the wait before the username may try again, and enough
+// failures lock the username or address out for a while.
+type loginGuard struct {
+	mutex         sync.Mutex
+	users         map[string]*loginRecord
+	addresses     map[string]*loginRecord
+	maxFailures   int
+	maxFailuresIP int
+	backoff       time.Duration
+	lockout       time.Duration
+}
+
+func newLoginGuard(config Config) *loginGuard {
+	g := &loginGuard{
+		users:         make(map[string]*loginRecord),
+		addresses:     make(map[string]*loginRecord),
+		maxFailures:   config.LoginMaxFailures,
+		maxFailuresIP: config.LoginMaxFailuresPerIP,
+		backoff:       config.LoginBackoff,
+		lockout:       config.LoginLockout,
+	}
+	if g.maxFailures == 0 {
+		g.maxFailures = defaultLoginMaxFailures
+	}
+	if g.maxFailuresIP == 0 {
+		g.maxFailuresIP = defaultLoginMaxFailuresPerIP
+	}
+	if g.backoff == 0 {
+		g.backoff = defaultLoginBackoff
+	}
+	if g.lockout <= 0 {
+		g.lockout = defaultLoginLockout
+	}
+	return g
+}
+
+// record returns the live record for key, forgetting failures that are older
+// than the lockout period
+func (g *loginGuard) record(records map[string]*loginRecord, key string, now time.Time) *loginRecord {
+	r, ok := records[key]
+	if !ok {
+		return nil
+	}
+	if now.After(r.lockedUntil) && now.Sub(r.last) > g.lockout {
+		delete(records, key)
+		return nil
+	}
+	return r
+}
+
+// check returns a *LoginBlockedError if username or address may not try to log in yet
+func (g *loginGuard) check(username, address string) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := time.Now()
+	if r := g.record(g.addresses, address, now); r != nil && now.Before(r.lockedUntil) {
+		return &LoginBlockedError{Username: username, Address: true, Locked: true, RetryAfter: r.lockedUntil.Sub(now)}
+	}
+	if r := g.record(g.users, username, now); r != nil {
+		if now.Before(r.lockedUntil) {
+			return &LoginBlockedError{Username: username, Locked: true, RetryAfter: r.lockedUntil.Sub(now)}
+		}
+		if wait := r.last.Add(g.delay(r.failures)).Sub(now); wait > 0 {
+			return &LoginBlockedError{Username: username, RetryAfter: wait}
+		}
+	}
+	return nil
+}
+
+// delay is the backoff after the given number of consecutive failures
+func (g *loginGuard) delay(failures int) time.Duration {
+	if g.backoff < 0 || failures <= 0 {
+		return 0
+	}
+	delay := g.backoff
+	for i := 1; i < failures && delay < g.lockout; i++ {
+		delay *= 2
+	}
+	if delay > g.lockout {
+		delay = g.lockout
+	}
+	return delay
+}
+
+// fail records a failed login. It returns the failures counted for username
+// and whether username or address just got locked out.
+func (g *loginGuard) fail(username, address string) (failures int, userLocked, addressLocked bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := time.Now()
+	if len(g.users)+len(g.addresses) > maxLoginRecords {
+		g.sweep(now)
+	}
+
+	user := g.record(g.users, username, now)
+	if user == nil {
+		user = &loginRecord{}
+		g.users[username] = user
+	}
+	user.failures++
+	user.last = now
+	if g.maxFailures > 0 && user.failures >= g.maxFailures {
+		user.failures = 0
+		user.lockedUntil = now.Add(g.lockout)
+		userLocked = true
+	}
+
+	addr := g.record(g.addresses, address, now)
+	if addr == nil {
+		addr = &loginRecord{}
+		g.addresses[address] = addr
+	}
+	addr.failures++
+	addr.last = now
+	if g.maxFailuresIP > 0 && addr.failures >= g.maxFailuresIP {
+		addr.failures = 0
+		addr.lockedUntil = now.Add(g.lockout)
+		addressLocked = true
+	}
+
+	return user.failures, userLocked, addressLocked
+}
+
+// remaining returns how many more failed logins lock username out, or -1
+// if it is never locked
+func (g *loginGuard) remaining(username string) int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.maxFailures <= 0 {
+		return -1
+	}
+	if r := g.record(g.users, username, time.Now()); r != nil {
+		return g.maxFailures - r.failures
+	}
+	return g.maxFailures
+}
+
+// succeed clears the failures of username. Those of the address are left
+// to expire, or logging into an account of one's own between guesses would
+// keep the address from ever being locked out.
+func (g *loginGuard) succeed(username string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	delete(g.users, username)
+}
+
+// sweep drops records that have expired
+func (g *loginGuard) sweep(now time.Time) {
+	for key := range g.users {
+		g.record(g.users, key, now)
+	}
+	for key := range g.addresses {
+		g.record(g.addresses, key, now)
+	}
+}
+
+// SecurityEvent is a security relevant event such as a failed login
+type SecurityEvent struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Username string    `json:"username,omitempty"`
+	Address  string    `json:"address,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+func (e SecurityEvent) String() string {
+	s := e.Time.Format("2006-01-02 15:04:05") + " " + e.Type
+	if e.Username != "" {
+		s += " user=" + e.Username
+	}
+	if e.Address != "" {
+		s += " addr=" + e.Address
+	}
+	if e.Detail != "" {
+		s += " (" + e.Detail + ")"
+	}
+	return s
+}
+
+// securityLog keeps the most recent security events
+type securityLog struct {
+	mutex  sync.Mutex
+	events []SecurityEvent
+	next   int
+	full   bool
+}
+
+func newSecurityLog(size int) *securityLog {
+	return &securityLog{events: make([]SecurityEvent, size)}
+}
+
+func (l *securityLog) add(event SecurityEvent) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.events[l.next] = event
+	l.next = (l.next + 1) % len(l.events)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// recent returns up to n of the newest events matching filter, oldest first
+func (l *securityLog) recent(n int, filter string) []SecurityEvent {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	count := l.next
+	if l.full {
+		count = len(l.events)
+	}
+
+	var matched []SecurityEvent
+	for i := 1; i <= count && len(matched) < n; i++ {
+		event := l.events[(l.next-i+len(l.events))%len(l.events)]
+		if filter == "" || event.Type == filter || strings.EqualFold(event.Username, filter) || event.Address == filter {
+			matched = append(matched, event)
+		}
+	}
+
+	// Newest were collected first
+	for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+		matched[i], matched[j] = matched[j], matched[i]
+	}
+	return matched
+}
+
+// securityEvent records an event and writes it to the log as JSON
+func (s *Server) securityEvent(eventType, username, address, detail string) {
+	event := SecurityEvent{
+		Time:     time.Now(),
+		Type:     eventType,
+		Username: username,
+		Address:  address,
+		Detail:   detail,
+	}
+	s.security.add(event)
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	s.logger.Printf("security %s", data)
+}
+
+// SecurityEvents returns up to n of the most recent security events, oldest
+// first. A non-empty filter keeps only events of that type, username or address.
+func (s *Server) SecurityEvents(n int, filter string) []SecurityEvent {
+	return s.security.recent(n, filter)
+}
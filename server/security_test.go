@@ -0,0 +1,48 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAddressLockoutSurvivesSuccess(t *testing.T) {
+	users := NewMemoryUserStore()
+	users.Create(&User{Username: "mallory", PasswordHash: hashPassword("own password", testPasswordIterations)})
+	users.Create(&User{Username: "victim", PasswordHash: hashPassword("secret", testPasswordIterations)})
+	s := NewServerWithConfig(Config{
+		Users:                 users,
+		LoginBackoff:          -1,
+		LoginMaxFailures:      100,
+		LoginMaxFailuresPerIP: 3,
+		PasswordIterations:    testPasswordIterations,
+		Logger:                testLogger(),
+	})
+	const addr = "192.0.2.1"
+
+	// Logging into an account of one's own between guesses does not help
+	if err := s.AuthenticateUser("victim", "guess1", addr); err != ErrInvalidCredentials {
+		t.Fatalf("guess 1 gave %v", err)
+	}
+	if err := s.AuthenticateUser("mallory", "own password", addr); err != nil {
+		t.Fatalf("own login failed: %v", err)
+	}
+	for _, guess := range []string{"guess2", "guess3"} {
+		if err := s.AuthenticateUser("victim", guess, addr); err != ErrInvalidCredentials {
+			t.Fatalf("%s gave %v", guess, err)
+		}
+	}
+
+	var blocked *LoginBlockedError
+	err := s.AuthenticateUser("mallory", "own password", addr)
+	if !errors.As(err, &blocked) || !blocked.Address {
+		t.Fatalf("login from an address with 3 failures gave %v, want it locked out", err)
+	}
+	if len(s.SecurityEvents(10, EventAddressLocked)) != 1 {
+		t.Fatal("no address_locked event")
+	}
+
+	// Other addresses are not affected
+	if err := s.AuthenticateUser("mallory", "own password", "192.0.2.2"); err != nil {
+		t.Fatalf("login from another address gave %v", err)
+	}
+}
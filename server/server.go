@@ -1,70 +1,259 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Server struct {
-	port       int
-	clients    map[*Client]bool
-	rooms      map[string]*Room
-	users      map[string]*User
-	broadcast  chan Message
-	register   chan *Client
-	unregister chan *Client
-	mutex      sync.Mutex
+	addr               string // Plaintext listen address, empty disables the plaintext listener
+	tlsAddr            string
+	tlsConfig          *tls.Config
+	wsAddr             string // WebSocket gateway address, empty disables it
+	clients            map[*Client]bool
+	sessions           map[string][]*Client // Logged in clients per username, oldest first
+	maxSessions        int                  // Sessions per user, negative allows any number
+	sessionPolicy      SessionPolicy
+	lastSessionID      atomic.Uint64
+	rooms              map[string]*Room
+	users              UserStore
+	openRegistration   bool
+	passwordIterations int // PBKDF2 cost of new password hashes
+	admins             map[string]bool
+	invites            *inviteCodes
+	transfers          *fileTransfers
+	historyFactory     HistoryFactory
+	historySize        int
+	historyReplay      int
+	roomIdleTimeout    time.Duration // Empty rooms are deleted after this long, negative keeps them
+	autoAwayAfter      time.Duration // Idle users are marked away after this long, negative disables it
+	messageLog         *MessageLog
+	handshakeTimeout   time.Duration
+	shutdownTimeout    time.Duration
+	writeTimeout       time.Duration
+	sendQueueSize      int
+	slowConsumerPolicy SlowConsumerPolicy
+	metrics            serverMetrics
+	limits             floodLimits
+	conns              *connTracker
+	floods             *floodTracker
+	logins             *loginGuard
+	roomLogins         *loginGuard // Wrong room passwords, keyed by room and user
+	security           *securityLog
+	mail               *mailboxes // Messages waiting for offline users
+	resume             *resumeTokens
+	logger             *log.Logger
+	lastID             atomic.Uint64
+	startOnce          sync.Once
+	startErr           error
+	listeners          []net.Listener
+	httpServer         *http.Server
+	closing            atomic.Bool
+	stopped            chan struct{} // Closed when Shutdown has finished
+	broadcast          chan Message
+	register           chan *Client
+	unregister         chan *Client
+	mutex              sync.Mutex
 }
 
 type Message struct {
+	ID       uint64 `json:",omitempty"` // Unique, increasing message ID assigned by the server
 	Sender   string
 	RoomName string
 	Content  string
-	Type     string // "text", "file", "command", "file-request", "file-chunk"
+	Type     string // "text", "private", "file", "command", "file-request", "file-chunk", "file-aborted"
 	FileData []byte // Used for file transfer
 	FileName string // Used for file transfer
+	Target   string // Recipient username for private messages
+	Time     int64  `json:",omitempty"` // Unix milliseconds when the server accepted the message
 }
 
+// NewServer creates a server listening on port with the default configuration.
+// A port of 0 disables the plaintext listener.
 func NewServer(port int) *Server {
-	return &Server{
-		port:       port,
-		clients:    make(map[*Client]bool),
-		rooms:      make(map[string]*Room),
-		users:      make(map[string]*User),
-		broadcast:  make(chan Message),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
+	var config Config
+	if port > 0 {
+		config.Addr = fmt.Sprintf(":%d", port)
 	}
+	return NewServerWithConfig(config)
 }
 
+// nextID returns a new unique message ID
+func (s *Server) nextID() uint64 {
+	return s.lastID.Add(1)
+}
+
+// Run listens on the configured addresses and serves until Shutdown is called
 func (s *Server) Run() error {
+	if s.addr == "" && s.tlsConfig == nil && s.wsAddr == "" {
+		return errors.New("no listener configured")
+	}
+
 	// Start TCP server
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
-	if err != nil {
+	var listener, tlsListener net.Listener
+	var err error
+	if s.addr != "" {
+		listener, err = net.Listen("tcp", s.addr)
+		if err != nil {
+			return err
+		}
+		s.trackListener(listener)
+		s.logger.Printf("Server started on %s", listener.Addr())
+	}
+	if s.tlsConfig != nil {
+		tlsListener, err = tls.Listen("tcp", s.tlsAddr, s.tlsConfig)
+		if err != nil {
+			if listener != nil {
+				listener.Close()
+			}
+			return err
+		}
+		s.trackListener(tlsListener)
+		s.logger.Printf("TLS server started on %s", tlsListener.Addr())
+	}
+
+	ctx := context.Background()
+	if err := s.start(); err != nil {
 		return err
 	}
+
+	// Serve WebSocket clients over HTTP, sharing rooms with TCP clients
+	wsErr := make(chan error, 1)
+	if s.wsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/ws", s.WebSocketHandler())
+		httpServer := &http.Server{Addr: s.wsAddr, Handler: mux}
+		s.mutex.Lock()
+		s.httpServer = httpServer
+		s.mutex.Unlock()
+		if s.closing.Load() {
+			return ErrServerClosed
+		}
+
+		s.logger.Printf("WebSocket gateway started on %s", s.wsAddr)
+		go func() {
+			err := httpServer.ListenAndServe()
+			if err == http.ErrServerClosed {
+				err = ErrServerClosed
+			}
+			wsErr <- err
+		}()
+	}
+
+	// Accept connections
+	if tlsListener != nil && listener != nil {
+		go s.Serve(ctx, tlsListener)
+	} else if tlsListener != nil {
+		return s.Serve(ctx, tlsListener)
+	}
+	if listener == nil {
+		return <-wsErr
+	}
+	return s.Serve(ctx, listener)
+}
+
+// Serve accepts connections on listener until Shutdown is called or ctx is
+// cancelled, which shuts the whole server down gracefully. It returns
+// ErrServerClosed once the shutdown has finished. Serve may be called for
+// several listeners at once; the listener is closed when Serve returns.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
 	defer listener.Close()
+	s.trackListener(listener)
 
-	// Create a default room
-	s.rooms["general"] = NewRoom("general")
+	if err := s.start(); err != nil {
+		return err
+	}
 
-	// Log server startup
-	log.Printf("Server started on port %d", s.port)
+	stop := context.AfterFunc(ctx, func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(shutdownCtx); err != nil && err != ErrServerClosed {
+			s.logger.Printf("Shutdown: %v", err)
+		}
+	})
+	defer stop()
 
-	// Start handling messages in a goroutine
-	go s.handleMessages()
+	err := s.acceptLoop(listener)
+	if err == ErrServerClosed {
+		<-s.stopped
+	}
+	return err
+}
 
-	// Accept connections
+// start restores rooms from the message log and starts the message loop.
+// Only the first call does anything.
+func (s *Server) start() error {
+	s.startOnce.Do(func() {
+		// Rebuild rooms and recent history from the message log
+		if s.messageLog != nil {
+			if err := s.recoverRooms(); err != nil {
+				s.startErr = err
+				return
+			}
+			if err := s.recoverMail(); err != nil {
+				s.startErr = err
+				return
+			}
+		}
+
+		// Create a default room
+		s.getOrCreateRoom("general", "")
+
+		// Start handling messages in a goroutine
+		go s.handleMessages()
+		if s.roomIdleTimeout > 0 {
+			go s.expireRoomsLoop()
+		}
+		if s.autoAwayAfter > 0 {
+			go s.autoAwayLoop()
+		}
+	})
+	return s.startErr
+}
+
+// acceptLoop accepts connections until the server shuts down or the
+// listener is closed, backing off while Accept keeps failing
+func (s *Server) acceptLoop(listener net.Listener) error {
+	var delay time.Duration
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Println("Error accepting connection:", err)
+			if s.closing.Load() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
+			// Probably out of file descriptors, wait for some to be released
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			s.logger.Printf("Error accepting connection: %v, retrying in %v", err, delay)
+			select {
+			case <-time.After(delay):
+			case <-s.stopped:
+				return ErrServerClosed
+			}
 			continue
 		}
+		delay = 0
 
-		log.Printf("New connection from %s", conn.RemoteAddr().String())
+		s.logger.Printf("New connection from %s", conn.RemoteAddr().String())
+		if !s.admit(conn) {
+			continue
+		}
 
 		// Create a new client
 		client := NewClient(conn, s)
@@ -83,58 +272,259 @@ func (s *Server) handleMessages() {
 			s.mutex.Unlock()
 		case client := <-s.unregister:
 			s.mutex.Lock()
-			if _, ok := s.clients[client]; ok {
-				delete(s.clients, client)
-				close(client.send)
-			}
+			delete(s.clients, client)
 			s.mutex.Unlock()
 		case message := <-s.broadcast:
-			s.mutex.Lock()
+			// Fan-out only queues messages, so a slow client cannot stall the loop
 			// If it's a room message, send only to clients in that room
 			if message.RoomName != "" {
-				room, exists := s.rooms[message.RoomName]
-				if exists {
+				if room := s.getRoom(message.RoomName); room != nil {
+					// Persist before fan-out so nothing shown to users is lost on a crash
+					if s.messageLog != nil && message.Type == "text" {
+						if err := s.messageLog.Append(message); err != nil {
+							s.logger.Printf("Error writing message to log: %v", err)
+						}
+					}
 					room.Broadcast(message)
 				}
 			} else {
 				// Otherwise, broadcast to all clients
-				for client := range s.clients {
-					if client.authenticated {
-						select {
-						case client.send <- message:
-						default:
-							close(client.send)
-							delete(s.clients, client)
-						}
+				for _, client := range s.connectedClients() {
+					if client.IsAuthenticated() {
+						client.deliver(message)
 					}
 				}
 			}
-			s.mutex.Unlock()
 		}
 	}
 }
 
-func (s *Server) RegisterUser(username, password string) bool {
+// FindClient returns the most recently active session of username, or nil
+// if the user is not logged in
+func (s *Server) FindClient(username string) *Client {
+	var found *Client
+	var foundActive time.Time
+	for _, client := range s.sessionsOf(username) {
+		client.mutex.Lock()
+		active := client.lastActive
+		client.mutex.Unlock()
+		if found == nil || active.After(foundActive) {
+			found, foundActive = client, active
+		}
+	}
+	return found
+}
+
+// SetUserStore replaces the backend used to store user accounts.
+// It must be called before Run.
+func (s *Server) SetUserStore(store UserStore) {
+	s.users = store
+}
+
+// SetHistoryFactory sets how the message history of new rooms is stored.
+// It must be called before Run.
+func (s *Server) SetHistoryFactory(factory HistoryFactory) {
+	s.historyFactory = factory
+}
+
+// SetHistorySize sets how many messages the default in-memory history keeps
+// per room. It must be called before Run.
+func (s *Server) SetHistorySize(n int) {
+	s.historySize = n
+}
+
+// SetMessageLog enables on-disk persistence of room messages.
+// It must be called before Run.
+func (s *Server) SetMessageLog(messageLog *MessageLog) {
+	messageLog.logger = s.logger
+	s.messageLog = messageLog
+}
+
+// recoverRooms recreates the rooms found in the message log and fills their
+// history with the newest messages
+func (s *Server) recoverRooms() error {
+	names, err := s.messageLog.Rooms()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		messages, err := s.messageLog.Recover(name, s.historySize)
+		if err != nil {
+			return fmt.Errorf("recovering room %s: %w", name, err)
+		}
+
+		state, err := s.messageLog.LoadRoom(name)
+		if err != nil {
+			return fmt.Errorf("recovering room %s: %w", name, err)
+		}
+
+		room, _ := s.getOrCreateRoom(name, "")
+		room.restore(state)
+		for _, message := range messages {
+			room.history.Add(message)
+		}
+	}
+
+	s.logger.Printf("Recovered %d rooms from the message log", len(names))
+	return nil
+}
+
+// SetHistoryReplay sets how many past messages are replayed on /join
+func (s *Server) SetHistoryReplay(n int) {
+	s.historyReplay = n
+}
+
+// getRoom returns the room called name, or nil if it does not exist
+func (s *Server) getRoom(name string) *Room {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	if _, exists := s.users[username]; exists {
-		return false // User already exists
-	}
+	return s.rooms[name]
+}
+
+// getOrCreateRoom returns the room called name, creating it with owner if
+// needed, and reports whether it was created
+func (s *Server) getOrCreateRoom(name, owner string) (*Room, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	// Create and store the user
-	s.users[username] = NewUser(username, password)
-	return true
+	if room, exists := s.rooms[name]; exists {
+		return room, false
+	}
+	room := s.newRoom(name)
+	room.owner = owner
+	s.rooms[name] = room
+	return room, true
 }
 
-func (s *Server) AuthenticateUser(username, password string) bool {
+// roomNames returns the names of all rooms in alphabetical order
+func (s *Server) roomNames() []string {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	user, exists := s.users[username]
-	if !exists {
-		return false
+	names := make([]string, 0, len(s.rooms))
+	for name := range s.rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// roomsOf returns the rooms client is in, in alphabetical order
+func (s *Server) roomsOf(client *Client) []*Room {
+	var rooms []*Room
+	for _, name := range s.roomNames() {
+		if room := s.getRoom(name); room != nil && room.HasClient(client) {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms
+}
+
+// newRoom creates a room with a history from the configured factory
+func (s *Server) newRoom(name string) *Room {
+	if s.historyFactory == nil {
+		return NewRoom(name, NewRingHistory(s.historySize))
+	}
+	return NewRoom(name, s.historyFactory(name))
+}
+
+// SetOpenRegistration controls whether anyone can /register. When disabled an
+// invite code generated by an admin is required.
+func (s *Server) SetOpenRegistration(open bool) {
+	s.openRegistration = open
+}
+
+// SetAdmins sets the usernames allowed to run admin commands such as /invitecode
+func (s *Server) SetAdmins(usernames []string) {
+	s.admins = make(map[string]bool)
+	for _, username := range usernames {
+		s.admins[username] = true
+	}
+}
+
+// IsAdmin reports whether username is a server admin
+func (s *Server) IsAdmin(username string) bool {
+	return s.admins[username]
+}
+
+// GenerateInvite creates a single-use registration code
+func (s *Server) GenerateInvite() (string, error) {
+	return s.invites.Generate()
+}
+
+// RegisterUser creates a new account. inviteCode may be empty when open
+// registration is enabled; if given it is always checked and consumed.
+func (s *Server) RegisterUser(username, password, inviteCode string) error {
+	if err := ValidateUsername(username); err != nil {
+		return err
+	}
+	// Before spending an invite or a password hash on it. Create checks again.
+	if _, err := s.users.Get(username); err == nil {
+		return ErrUserExists
+	}
+
+	if inviteCode != "" {
+		if !s.invites.Consume(inviteCode) {
+			return ErrInvalidInvite
+		}
+	} else if !s.openRegistration {
+		return ErrRegistrationClosed
+	}
+
+	if err := s.users.Create(NewUser(username, password, s.passwordIterations)); err != nil {
+		if inviteCode != "" {
+			s.invites.Restore(inviteCode)
+		}
+		if err != ErrUserExists {
+			s.logger.Printf("Error storing user %s: %v", username, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// AuthenticateUser checks a password for username, logging in from the IP
+// address addr. It returns ErrInvalidCredentials for a wrong username or
+// password, and a *LoginBlockedError while too many failed logins make the
+// username or address wait.
+func (s *Server) AuthenticateUser(username, password, addr string) error {
+	// Refuse before hashing so that guessing stays cheap for the server
+	if err := s.logins.check(username, addr); err != nil {
+		s.securityEvent(EventLoginBlocked, username, addr, err.Error())
+		return err
+	}
+
+	user, err := s.users.Get(username)
+	if err != nil || !user.CheckPassword(password) {
+		s.loginFailed(username, addr)
+		return ErrInvalidCredentials
+	}
+	s.logins.succeed(username)
+	s.securityEvent(EventLoginSuccess, username, addr, "")
+
+	// Transparently upgrade legacy or low-cost hashes now that we know the password
+	if user.NeedsRehash(s.passwordIterations) {
+		if err := s.users.UpdatePassword(username, hashPassword(password, s.passwordIterations)); err != nil {
+			s.logger.Printf("Error upgrading password hash for %s: %v", username, err)
+		} else {
+			s.logger.Printf("Upgraded password hash for %s", username)
+		}
 	}
 
-	return user.CheckPassword(password)
+	return nil
+}
+
+// loginFailed records a failed login and any lockout it causes
+func (s *Server) loginFailed(username, addr string) {
+	failures, userLocked, addrLocked := s.logins.fail(username, addr)
+	if userLocked {
+		s.securityEvent(EventAccountLocked, username, addr, fmt.Sprintf("locked for %v", s.logins.lockout))
+	} else {
+		s.securityEvent(EventLoginFailure, username, addr, fmt.Sprintf("%d consecutive failures", failures))
+	}
+	if addrLocked {
+		s.securityEvent(EventAddressLocked, "", addr, fmt.Sprintf("locked for %v", s.logins.lockout))
+	}
 }
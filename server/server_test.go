@@ -0,0 +1,649 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testTimeout = 10 * time.Second
+
+// startServer serves config on a 127.0.0.1:0 listener until the test ends
+// and returns the address to dial
+func startServer(t *testing.T, config Config) (*Server, string) {
+	t.Helper()
+	if config.PasswordIterations == 0 {
+		config.PasswordIterations = testPasswordIterations
+	}
+	if config.Logger == nil {
+		config.Logger = testLogger()
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServerWithConfig(config)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ctx, listener) }()
+
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(testTimeout):
+			t.Error("server did not shut down")
+		}
+	})
+	return s, listener.Addr().String()
+}
+
+// testClient speaks the legacy text protocol: it sends lines and receives
+// one JSON message per line
+type testClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	v2     bool // Receives v2 frames and binary file frames instead
+}
+
+func dial(addr string) (*testClient, error) {
+	conn, err := net.DialTimeout("tcp", addr, testTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &testClient{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// dialClient connects to addr and closes the connection when the test ends
+func dialClient(t *testing.T, addr string) *testClient {
+	t.Helper()
+	c, err := dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.conn.Close() })
+	return c
+}
+
+func (c *testClient) send(line string) error {
+	c.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+	_, err := c.conn.Write([]byte(line + "\n"))
+	return err
+}
+
+// next reads the next message from the server
+func (c *testClient) next() (Message, error) {
+	c.conn.SetReadDeadline(time.Now().Add(testTimeout))
+	if c.v2 && IsBinaryFrame(c.reader) {
+		frame, err := ReadFileFrame(c.reader)
+		return Message{Sender: frame.Sender, FileName: frame.FileName, FileData: frame.Data, Type: "file-chunk"}, err
+	}
+	line, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		return Message{}, err
+	}
+	var message Message
+	if !c.v2 {
+		err = json.Unmarshal(line, &message)
+		return message, err
+	}
+	var frame Frame
+	if err := json.Unmarshal(line, &frame); err != nil {
+		return Message{}, err
+	}
+	err = json.Unmarshal(frame.Payload, &message)
+	return message, err
+}
+
+// dialV2 connects to addr and negotiates protocol v2 with the given
+// features, returning the hello of the server. Commands can still be sent as
+// plain lines.
+func dialV2(t *testing.T, addr string, features ...string) (*testClient, Hello) {
+	t.Helper()
+	c := dialClient(t, addr)
+	hello, err := encodeControlFrame(0, "hello", Hello{Versions: []int{protocolV2}, Agent: "test", Features: features})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.mustSend(t, string(hello))
+
+	// The welcome message may come first, in legacy format
+	c.conn.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		line, err := c.reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("waiting for the handshake: %v", err)
+		}
+		var frame Frame
+		if json.Unmarshal(line, &frame) != nil || frame.V != protocolV2 {
+			continue
+		}
+		var reply Hello
+		if frame.Type != "hello" || json.Unmarshal(frame.Payload, &reply) != nil {
+			t.Fatalf("handshake answered with %s", line)
+		}
+		c.v2 = true
+		return c, reply
+	}
+}
+
+// waitFor reads messages until one matches, returning it
+func (c *testClient) waitFor(what string, match func(Message) bool) (Message, error) {
+	for {
+		message, err := c.next()
+		if err != nil {
+			return Message{}, fmt.Errorf("waiting for %s: %w", what, err)
+		}
+		if match(message) {
+			return message, nil
+		}
+	}
+}
+
+// waitForContent reads messages until one contains substr
+func (c *testClient) waitForContent(substr string) (Message, error) {
+	return c.waitFor(fmt.Sprintf("%q", substr), func(m Message) bool { return strings.Contains(m.Content, substr) })
+}
+
+// register creates an account for username and logs in with it
+func (c *testClient) register(username string) error {
+	if err := c.send("/register " + username + " password1"); err != nil {
+		return err
+	}
+	_, err := c.waitForContent("Registered and logged in")
+	return err
+}
+
+// mustWaitForContent is waitForContent for the test goroutine
+func (c *testClient) mustWaitForContent(t *testing.T, substr string) Message {
+	t.Helper()
+	message, err := c.waitForContent(substr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+// mustSend is send for the test goroutine
+func (c *testClient) mustSend(t *testing.T, line string) {
+	t.Helper()
+	if err := c.send(line); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// loginClient connects and registers username
+func loginClient(t *testing.T, addr, username string) *testClient {
+	t.Helper()
+	c := dialClient(t, addr)
+	if err := c.register(username); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// syncBuffer collects log output written from several goroutines
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+func TestServeAddr(t *testing.T) {
+	s, addr := startServer(t, Config{})
+
+	// Serve registers the listener from its own goroutine
+	deadline := time.Now().Add(testTimeout)
+	for s.Addr() == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if s.Addr() == nil || s.Addr().String() != addr {
+		t.Fatalf("Addr() = %v, want %s", s.Addr(), addr)
+	}
+
+	alice := loginClient(t, addr, "alice")
+	bob := loginClient(t, addr, "bob")
+	alice.mustWaitForContent(t, "bob has joined the room")
+	bob.mustSend(t, "hello alice")
+	message := alice.mustWaitForContent(t, "hello alice")
+	if message.Sender != "bob" || message.RoomName != "general" {
+		t.Fatalf("got %+v, want a message from bob in general", message)
+	}
+}
+
+func TestServeContextCancel(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServerWithConfig(Config{PasswordIterations: testPasswordIterations, Logger: testLogger()})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ctx, listener) }()
+
+	alice := loginClient(t, listener.Addr().String(), "alice")
+	cancel()
+
+	alice.mustWaitForContent(t, "Server is shutting down")
+	// The connection is closed after the notice
+	if _, err := alice.waitFor("EOF", func(Message) bool { return false }); err == nil {
+		t.Fatal("connection still open after shutdown")
+	}
+	select {
+	case err := <-done:
+		if err != ErrServerClosed {
+			t.Fatalf("Serve returned %v, want ErrServerClosed", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Serve did not return after the context was cancelled")
+	}
+	if _, err := net.DialTimeout("tcp", listener.Addr().String(), time.Second); err == nil {
+		t.Fatal("listener still accepting after shutdown")
+	}
+}
+
+func TestServeListenerClosed(t *testing.T) {
+	var logs syncBuffer
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServerWithConfig(Config{Logger: log.New(&logs, "", 0)})
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(context.Background(), listener) }()
+
+	// Closing the listener from outside ends Serve instead of spinning on Accept
+	time.Sleep(20 * time.Millisecond)
+	listener.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("Serve returned %v, want net.ErrClosed", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Serve did not return after its listener was closed")
+	}
+	if strings.Contains(logs.String(), "Error accepting") {
+		t.Fatalf("closed listener was logged as an accept error:\n%s", logs.String())
+	}
+}
+
+// failingListener fails Accept a number of times, then reports it is closed
+type failingListener struct {
+	net.Listener
+	failures int
+	calls    []time.Time
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.calls = append(l.calls, time.Now())
+	if len(l.calls) <= l.failures {
+		return nil, errors.New("accept: too many open files")
+	}
+	return nil, net.ErrClosed
+}
+
+func TestServeAcceptBackoff(t *testing.T) {
+	var logs syncBuffer
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &failingListener{Listener: inner, failures: 4}
+	s := NewServerWithConfig(Config{Logger: log.New(&logs, "", 0)})
+
+	err = s.Serve(context.Background(), listener)
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Serve returned %v, want net.ErrClosed", err)
+	}
+	if len(listener.calls) != 5 {
+		t.Fatalf("Accept was called %d times, want 5", len(listener.calls))
+	}
+
+	// Waits of 5, 10, 20 and 40ms between the attempts
+	for i := 1; i < len(listener.calls); i++ {
+		want := 5 * time.Millisecond << (i - 1)
+		if gap := listener.calls[i].Sub(listener.calls[i-1]); gap < want {
+			t.Errorf("retry %d came after %v, want at least %v", i, gap, want)
+		}
+	}
+	if n := strings.Count(logs.String(), "Error accepting"); n != 4 {
+		t.Fatalf("logged %d accept errors, want 4", n)
+	}
+}
+
+// stressTimeout allows for hundreds of clients sharing the server under -race
+const stressTimeout = 60 * time.Second
+
+// stressClient reads everything the server sends in the background so the
+// server never sees a slow consumer while the test is busy sending
+type stressClient struct {
+	*testClient
+	mutex    sync.Mutex
+	messages []Message
+	pos      int   // First message not yet looked at by await
+	err      error // Why reading stopped
+	notify   chan struct{}
+}
+
+func newStressClient(addr string) (*stressClient, error) {
+	c, err := dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	sc := &stressClient{testClient: c, notify: make(chan struct{}, 1)}
+	go sc.readLoop()
+	return sc, nil
+}
+
+func (c *stressClient) readLoop() {
+	for {
+		// No deadline, the connection stays quiet while others are busy
+		line, err := c.reader.ReadBytes('\n')
+		var message Message
+		if err == nil {
+			err = json.Unmarshal(line, &message)
+		}
+		c.mutex.Lock()
+		if err != nil {
+			c.err = err
+		} else {
+			c.messages = append(c.messages, message)
+		}
+		c.mutex.Unlock()
+		wake(c.notify)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// await skips messages until one matches
+func (c *stressClient) await(what string, match func(Message) bool) (Message, error) {
+	return c.awaitFrom(&c.pos, what, match)
+}
+
+// awaitFrom is await for a goroutine keeping its own place in the messages
+func (c *stressClient) awaitFrom(pos *int, what string, match func(Message) bool) (Message, error) {
+	deadline := time.NewTimer(stressTimeout)
+	defer deadline.Stop()
+	for {
+		c.mutex.Lock()
+		for *pos < len(c.messages) {
+			message := c.messages[*pos]
+			*pos++
+			if match(message) {
+				c.mutex.Unlock()
+				return message, nil
+			}
+		}
+		err := c.err
+		c.mutex.Unlock()
+		if err != nil {
+			return Message{}, fmt.Errorf("waiting for %s: %w", what, err)
+		}
+
+		select {
+		case <-c.notify:
+		case <-deadline.C:
+			return Message{}, fmt.Errorf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// register is testClient.register reading through the inbox
+func (c *stressClient) register(username string) error {
+	if err := c.send("/register " + username + " password1"); err != nil {
+		return err
+	}
+	return c.awaitContent("Registered and logged in")
+}
+
+func (c *stressClient) awaitContent(substr string) error {
+	_, err := c.await(fmt.Sprintf("%q", substr), func(m Message) bool { return strings.Contains(m.Content, substr) })
+	return err
+}
+
+// sendAll sends lines, stopping at the first error
+func (c *stressClient) sendAll(lines ...string) error {
+	for _, line := range lines {
+		if err := c.send(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stressFile is the content sent between pairs of clients, several chunks long
+func stressFile(i int) []byte {
+	data := make([]byte, 3*chunkSize+i)
+	for j := range data {
+		data[j] = byte(i + j)
+	}
+	return data
+}
+
+// sendStressFile offers a file to peer and sends it once accepted. It runs
+// next to the rest of the client's script and keeps its own place in the
+// messages.
+func (c *stressClient) sendStressFile(i int, peer string) error {
+	data := stressFile(i)
+	name := fmt.Sprintf("file%d.bin", i)
+	pos := 0
+	if err := c.send(fmt.Sprintf("/sendfile %s %s %d", peer, name, len(data))); err != nil {
+		return err
+	}
+	if _, err := c.awaitFrom(&pos, "file-accepted", func(m Message) bool { return m.Type == "file-accepted" && m.Sender == peer }); err != nil {
+		return err
+	}
+	for offset := 0; offset < len(data); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		line, err := json.Marshal(Message{Type: "file-chunk", FileName: name, FileData: data[offset:end], Target: peer})
+		if err != nil {
+			return err
+		}
+		if err := c.send(string(line)); err != nil {
+			return err
+		}
+	}
+	_, err := c.awaitFrom(&pos, "transfer success", func(m Message) bool {
+		return strings.Contains(m.Content, "transferred successfully to "+peer)
+	})
+	return err
+}
+
+// receiveStressFile accepts the file peer offers and checks what arrives
+func (c *stressClient) receiveStressFile(peerIndex int, peer string) error {
+	pos := 0
+	if _, err := c.awaitFrom(&pos, "file-request", func(m Message) bool { return m.Type == "file-request" && m.Sender == peer }); err != nil {
+		return err
+	}
+	if err := c.send("/accept " + peer); err != nil {
+		return err
+	}
+
+	var received []byte
+	_, err := c.awaitFrom(&pos, "file-complete", func(m Message) bool {
+		if m.Type == "file-chunk" && m.Sender == peer {
+			received = append(received, m.FileData...)
+		}
+		return m.Type == "file-complete" && m.Sender == peer
+	})
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(received, stressFile(peerIndex)) {
+		return fmt.Errorf("file from %s arrived with %d bytes, want %d", peer, len(received), len(stressFile(peerIndex)))
+	}
+	return nil
+}
+
+// TestStress has hundreds of clients join and leave rooms, chat, message
+// each other, transfer files and disconnect at the same time. Run it with
+// -race to check the locking of rooms, clients and transfers.
+func TestStress(t *testing.T) {
+	clients, iterations := 200, 3
+	if testing.Short() {
+		clients, iterations = 40, 2
+	}
+
+	s, addr := startServer(t, Config{
+		MessageRate:   -1,
+		MaxConnsPerIP: -1,
+		SendQueueSize: 4096,
+		MaxSessions:   -1,
+	})
+
+	var registered, finished sync.WaitGroup
+	registered.Add(clients)
+	finished.Add(clients)
+	errs := make(chan error, clients)
+
+	for i := 0; i < clients; i++ {
+		go func(i int) {
+			defer finished.Done()
+			username := fmt.Sprintf("user%d", i)
+			fail := func(err error) { errs <- fmt.Errorf("%s: %w", username, err) }
+
+			c, err := newStressClient(addr)
+			if err != nil {
+				registered.Done()
+				fail(err)
+				return
+			}
+			defer c.conn.Close()
+			err = c.register(username)
+			registered.Done()
+			if err != nil {
+				fail(err)
+				return
+			}
+			// Everyone must be online before files are offered
+			registered.Wait()
+
+			// Even clients send a file to the next odd one while chatting
+			peer := i ^ 1
+			transfer := make(chan error, 1)
+			if peer < clients {
+				go func() {
+					if i%2 == 0 {
+						transfer <- c.sendStressFile(i, fmt.Sprintf("user%d", peer))
+					} else {
+						transfer <- c.receiveStressFile(peer, fmt.Sprintf("user%d", peer))
+					}
+				}()
+			} else {
+				transfer <- nil
+			}
+
+			for n := 0; n < iterations; n++ {
+				room := fmt.Sprintf("room%d", (i+n)%10)
+				lines := []string{
+					"/join " + room,
+					fmt.Sprintf("hello from %s, round %d", username, n),
+					"/users",
+					fmt.Sprintf("/msg user%d ping %d", (i+7)%clients, n),
+					fmt.Sprintf("/whois user%d", (i+3)%clients),
+					"/rooms",
+					"/part " + room,
+				}
+				// Everyone is in general, a few posts there reach all clients
+				if i%10 == 0 {
+					lines = append(lines, "/say general hi everyone")
+				}
+				if err := c.sendAll(lines...); err != nil {
+					fail(err)
+					return
+				}
+			}
+
+			if err := <-transfer; err != nil {
+				fail(err)
+				return
+			}
+
+			// Leave in different ways while others are still busy
+			switch i % 3 {
+			case 0:
+				c.send("/quit")
+				c.awaitContent("Goodbye")
+			case 1:
+				c.conn.Close()
+			default:
+				// Reconnect and log in again before leaving
+				c.conn.Close()
+				again, err := newStressClient(addr)
+				if err != nil {
+					fail(err)
+					return
+				}
+				defer again.conn.Close()
+				err = again.sendAll("/login "+username+" password1", "/join lobby", "back again")
+				if err == nil {
+					err = again.awaitContent("You have joined room: lobby")
+				}
+				if err != nil {
+					fail(err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	finished.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if t.Failed() {
+		return
+	}
+
+	// Every connection is gone, nothing may be left behind
+	deadline := time.Now().Add(testTimeout)
+	for len(s.connectedClients()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(s.connectedClients()); n > 0 {
+		t.Fatalf("%d clients still registered after all disconnected", n)
+	}
+	for _, name := range s.roomNames() {
+		if room := s.getRoom(name); room != nil && len(room.Usernames()) > 0 {
+			t.Errorf("room %s still has members %v", name, room.Usernames())
+		}
+	}
+	s.mutex.Lock()
+	sessions := len(s.sessions)
+	s.mutex.Unlock()
+	if sessions > 0 {
+		t.Errorf("%d users still have sessions", sessions)
+	}
+	if n := s.countTransfers("pending") + s.countTransfers("accepted"); n > 0 {
+		t.Errorf("%d transfers still active", n)
+	}
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultMaxSessions = 5
+
+var ErrTooManySessions = errors.New("too many sessions")
+
+// SessionPolicy decides what happens when a user logs in while already
+// having the maximum number of sessions
+type SessionPolicy int
+
+const (
+	// RefuseNewSession refuses the new login
+	RefuseNewSession SessionPolicy = iota
+	// KickOldestSession logs the oldest session out to make room
+	KickOldestSession
+)
+
+func (p SessionPolicy) String() string {
+	switch p {
+	case RefuseNewSession:
+		return "refuse"
+	case KickOldestSession:
+		return "kick-oldest"
+	}
+	return fmt.Sprintf("SessionPolicy(%d)", int(p))
+}
+
+// ParseSessionPolicy parses "refuse" or "kick-oldest"
+func ParseSessionPolicy(name string) (SessionPolicy, error) {
+	for _, p := range []SessionPolicy{RefuseNewSession, KickOldestSession} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown session policy %q", name)
+}
+
+// Session describes one connection of a logged in user
+type Session struct {
+	ID         uint64
+	Username   string
+	Addr       string
+	Connected  time.Time
+	LastActive time.Time
+}
+
+// session returns a description of the client's session
+func (c *Client) session() Session {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return Session{
+		ID:         c.sessionID,
+		Username:   c.username,
+		Addr:       c.ip,
+		Connected:  c.connectedAt,
+		LastActive: c.lastActive,
+	}
+}
+
+// addSession records client as a session of username. If the user already
+// has the maximum number of sessions it either refuses or returns the oldest
+// session, which the caller must log out.
+func (s *Server) addSession(client *Client, username string) (*Client, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var oldest *Client
+	sessions := s.sessions[username]
+	if s.maxSessions > 0 && len(sessions) >= s.maxSessions {
+		if s.sessionPolicy != KickOldestSession {
+			return nil, fmt.Errorf("%w, at most %d per user", ErrTooManySessions, s.maxSessions)
+		}
+		oldest = sessions[0]
+		sessions = sessions[1:]
+	}
+	s.sessions[username] = append(sessions, client)
+	return oldest, nil
+}
+
+// removeSession forgets a session and reports how many the user has left
+func (s *Server) removeSession(client *Client) int {
+	username := client.Username()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sessions := s.sessions[username]
+	for i, session := range sessions {
+		if session == client {
+			sessions = append(sessions[:i:i], sessions[i+1:]...)
+			break
+		}
+	}
+	if len(sessions) == 0 {
+		delete(s.sessions, username)
+	} else {
+		s.sessions[username] = sessions
+	}
+	return len(sessions)
+}
+
+// sessionsOf returns the sessions of username, oldest first
+func (s *Server) sessionsOf(username string) []*Client {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]*Client(nil), s.sessions[username]...)
+}
+
+// findSession returns the session of username with the given ID, or nil
+func (s *Server) findSession(username string, id uint64) *Client {
+	for _, session := range s.sessionsOf(username) {
+		if session.sessionID == id {
+			return session
+		}
+	}
+	return nil
+}
+
+// Sessions describes the sessions of username, oldest first
+func (s *Server) Sessions(username string) []Session {
+	var sessions []Session
+	for _, client := range s.sessionsOf(username) {
+		sessions = append(sessions, client.session())
+	}
+	return sessions
+}
+
+// parseSessionTarget splits "alice#3" into the username and session ID. A
+// plain username has ID 0.
+func parseSessionTarget(target string) (string, uint64, error) {
+	username, id, found := strings.Cut(target, "#")
+	if !found {
+		return target, 0, nil
+	}
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil || n == 0 {
+		return "", 0, fmt.Errorf("invalid session %q", id)
+	}
+	return username, n, nil
+}
+
+// logout ends the session after telling it notice. It is safe to call from
+// any goroutine.
+func (c *Client) logout(notice string) {
+	c.server.removeSession(c)
+	c.revokeResume()
+	c.deliver(Message{Sender: "Server", Content: notice, Type: "text"})
+	// The read goroutine cleans up once writePump has closed the connection
+	c.send.close(true)
+}
+
+// listSessions tells the client about all sessions of its user
+func (c *Client) listSessions() {
+	var list strings.Builder
+	list.WriteString("Your sessions:\n")
+	for _, session := range c.server.Sessions(c.username) {
+		fmt.Fprintf(&list, "- #%d from %s, connected %s, idle %s",
+			session.ID, session.Addr, session.Connected.Format("2006-01-02 15:04"), formatDuration(time.Since(session.LastActive)))
+		if session.ID == c.sessionID {
+			list.WriteString(" (this session)")
+		}
+		list.WriteString("\n")
+	}
+	c.deliver(Message{Sender: "Server", Content: list.String(), Type: "text"})
+}
+
+// logoutSessions ends another session of the client's user, or all the
+// others if which is "others"
+func (c *Client) logoutSessions(which string) {
+	var targets []*Client
+	if which == "others" {
+		for _, session := range c.server.sessionsOf(c.username) {
+			if session != c {
+				targets = append(targets, session)
+			}
+		}
+	} else {
+		id, err := strconv.ParseUint(strings.TrimPrefix(which, "#"), 10, 64)
+		if err != nil {
+			c.deliver(Message{Sender: "Server", Content: "Usage: /sessions logout #<id>|others", Type: "text"})
+			return
+		}
+		session := c.server.findSession(c.username, id)
+		if session == nil {
+			c.deliver(Message{Sender: "Server", Content: fmt.Sprintf("No session #%d", id), Type: "text"})
+			return
+		}
+		if session == c {
+			c.deliver(Message{Sender: "Server", Content: "Use /quit to end this session", Type: "text"})
+			return
+		}
+		targets = append(targets, session)
+	}
+
+	for _, session := range targets {
+		session.logout(fmt.Sprintf("This session was logged out from session #%d (%s)", c.sessionID, c.ip))
+	}
+	c.deliver(Message{Sender: "Server", Content: fmt.Sprintf("Logged out %d session(s)", len(targets)), Type: "text"})
+	c.server.logger.Printf("%s logged out %d of their other sessions", c.username, len(targets))
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// loginSession logs in another session of a registered user
+func loginSession(t *testing.T, addr, username string) *testClient {
+	t.Helper()
+	c := dialClient(t, addr)
+	c.mustSend(t, "/login "+username+" password1")
+	c.mustWaitForContent(t, "Login successful!")
+	return c
+}
+
+func TestSessionLimitRefuse(t *testing.T) {
+	s, addr := startServer(t, Config{MaxSessions: 2, Logger: testLogger()})
+	loginClient(t, addr, "alice")
+	loginSession(t, addr, "alice")
+
+	third := dialClient(t, addr)
+	third.mustSend(t, "/login alice password1")
+	third.mustWaitForContent(t, "Login refused: too many sessions, at most 2 per user")
+	if n := len(s.Sessions("alice")); n != 2 {
+		t.Fatalf("alice has %d sessions after a refused login, want 2", n)
+	}
+}
+
+func TestSessionLimitKickOldest(t *testing.T) {
+	s, addr := startServer(t, Config{MaxSessions: 2, SessionPolicy: KickOldestSession, Logger: testLogger()})
+	first := loginClient(t, addr, "alice")
+	second := loginSession(t, addr, "alice")
+
+	// A room only the session about to be logged out is in
+	first.mustSend(t, "/join attic")
+	first.mustWaitForContent(t, "You have joined room: attic")
+
+	third := dialClient(t, addr)
+	third.mustSend(t, "/login alice password1")
+	third.mustWaitForContent(t, "Login successful!")
+	first.mustWaitForContent(t, "Logged out: alice logged in from")
+
+	// Only the second session is left to share rooms with
+	notice := third.mustWaitForContent(t, "You are also logged in from")
+	if !strings.Contains(notice.Content, "from 1 other session(s)") || strings.Contains(notice.Content, "attic") {
+		t.Fatalf("third session was told %q", notice.Content)
+	}
+	sessions := s.sessionsOf("alice")
+	if len(sessions) != 2 || sessions[0].session().ID != 2 {
+		t.Fatalf("alice has %d sessions, want the second and third", len(sessions))
+	}
+	if room := s.getRoom("attic"); room != nil && room.HasClient(sessions[1]) {
+		t.Fatal("third session joined the room of the session it replaced")
+	}
+	second.mustSend(t, "/sessions")
+	if list := second.mustWaitForContent(t, "Your sessions:"); strings.Count(list.Content, "- #") != 2 {
+		t.Fatalf("session list:\n%s", list.Content)
+	}
+}
+
+func TestDeliveryToAllSessions(t *testing.T) {
+	_, addr := startServer(t, Config{Logger: testLogger()})
+	sessions := []*testClient{loginClient(t, addr, "alice")}
+	for i := 0; i < 2; i++ {
+		sessions = append(sessions, loginSession(t, addr, "alice"))
+	}
+	bob := loginClient(t, addr, "bob")
+
+	bob.mustSend(t, "/msg alice are you there")
+	bob.mustSend(t, "hello general")
+	for i, session := range sessions {
+		message, err := session.waitFor("private message", func(m Message) bool { return m.Type == "private" })
+		if err != nil {
+			t.Fatalf("session %d: %v", i, err)
+		}
+		if message.Sender != "bob" || message.Content != "are you there" {
+			t.Fatalf("session %d got %q from %s", i, message.Content, message.Sender)
+		}
+		if _, err := session.waitFor("room message", func(m Message) bool {
+			return m.Sender == "bob" && m.RoomName == "general" && m.Content == "hello general"
+		}); err != nil {
+			t.Fatalf("session %d: %v", i, err)
+		}
+	}
+
+	// What one session sends privately is echoed to the others
+	sessions[0].mustSend(t, "/msg bob yes")
+	for i, session := range sessions[1:] {
+		if _, err := session.waitFor("echo", func(m Message) bool {
+			return m.Type == "private" && m.Sender == "alice" && m.Content == "yes"
+		}); err != nil {
+			t.Fatalf("session %d: %v", i+1, err)
+		}
+	}
+}
+
+func TestHistoryInRoomOfOtherSession(t *testing.T) {
+	_, addr := startServer(t, Config{Logger: testLogger()})
+	first := loginClient(t, addr, "alice")
+	first.mustSend(t, "/join den")
+	first.mustWaitForContent(t, "You have joined room: den")
+	postAndWait(t, first, "alice", "one", "two")
+
+	// Joined to den along with the first session, then switching to it
+	second := loginSession(t, addr, "alice")
+	second.mustWaitForContent(t, "which you joined too")
+	second.mustSend(t, "/join den")
+	second.mustWaitForContent(t, "You have switched to room: den")
+
+	second.mustSend(t, "/history")
+	var paged []string
+	_, err := second.waitFor("two", func(m Message) bool {
+		if m.Type == "history" {
+			paged = append(paged, m.Content)
+		}
+		return m.Type == "history" && m.Content == "two"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(paged) != "[one two]" {
+		t.Fatalf("/history paged %v, want [one two]", paged)
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrServerClosed is returned by Run after Shutdown has been called
+var ErrServerClosed = errors.New("server closed")
+
+// trackListener remembers a listener so Shutdown can close it
+func (s *Server) trackListener(listener net.Listener) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, l := range s.listeners {
+		if l == listener {
+			return
+		}
+	}
+	s.listeners = append(s.listeners, listener)
+	if s.closing.Load() {
+		// Shutdown already ran, don't start serving
+		listener.Close()
+	}
+}
+
+// Shutdown gracefully stops the server. It stops accepting connections,
+// tells every connected user, waits for file transfers in progress until ctx
+// expires and aborts the rest, closes all connections and flushes the
+// message log. Run and Serve return ErrServerClosed once it has finished.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !s.closing.CompareAndSwap(false, true) {
+		return ErrServerClosed
+	}
+	defer close(s.stopped)
+
+	// Stop accepting new connections
+	s.mutex.Lock()
+	listeners := s.listeners
+	httpServer := s.httpServer
+	s.mutex.Unlock()
+
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	if httpServer != nil {
+		// Hijacked WebSocket connections are not affected and closed below
+		httpServer.Shutdown(ctx)
+	}
+
+	// Notify everyone that is still connected
+	clients := s.connectedClients()
+	for _, client := range clients {
+		client.deliver(Message{
+			Sender:  "Server",
+			Content: "Server is shutting down",
+			Type:    "text",
+		})
+	}
+	s.logger.Printf("Shutting down, %d clients connected", len(clients))
+
+	// Give file transfers in progress a chance to finish
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+wait:
+	for s.countTransfers("accepted") > 0 {
+		select {
+		case <-ctx.Done():
+			break wait
+		case <-ticker.C:
+		}
+	}
+	if aborted := s.abortTransfers("server shutting down"); aborted > 0 {
+		s.logger.Printf("Aborted %d file transfers", aborted)
+	}
+
+	// Flush what is still queued, then close the connections
+	for _, client := range clients {
+		client.send.close(true)
+	}
+	for _, client := range clients {
+		select {
+		case <-client.writerDone:
+		case <-ctx.Done():
+		}
+		client.conn.Close()
+	}
+
+	metrics := s.Metrics()
+	s.logger.Printf("Delivery: %d messages dropped, %d slow consumers, %d disconnected, %d write timeouts, %d stalled transfers",
+		metrics.MessagesDropped, metrics.SlowConsumers, metrics.SlowConsumerKicks, metrics.WriteTimeouts, metrics.StalledTransfers)
+
+	// Flush persistence
+	if s.messageLog != nil {
+		if err := s.messageLog.Close(); err != nil {
+			return err
+		}
+	}
+
+	s.logger.Println("Server stopped")
+	return ctx.Err()
+}
+
+// connectedClients returns a snapshot of all connected clients
+func (s *Server) connectedClients() []*Client {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	clients := make([]*Client, 0, len(s.clients))
+	for client := range s.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
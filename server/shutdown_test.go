@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// startTransfer has alice offer bob a file of size bytes and bob accept it
+func startTransfer(t *testing.T, addr string, size int) (alice, bob *testClient) {
+	t.Helper()
+	alice = loginClient(t, addr, "alice")
+	bob = loginClient(t, addr, "bob")
+	alice.mustSend(t, fmt.Sprintf("/sendfile bob notes.txt %d", size))
+	if _, err := bob.waitFor("file-request", func(m Message) bool { return m.Type == "file-request" }); err != nil {
+		t.Fatal(err)
+	}
+	bob.mustSend(t, "/accept alice")
+	if _, err := alice.waitFor("file-accepted", func(m Message) bool { return m.Type == "file-accepted" }); err != nil {
+		t.Fatal(err)
+	}
+	return alice, bob
+}
+
+// sendChunk sends data as the next chunk of notes.txt
+func sendChunk(t *testing.T, c *testClient, data []byte) {
+	t.Helper()
+	line, err := json.Marshal(Message{Type: "file-chunk", FileName: "notes.txt", FileData: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.mustSend(t, string(line))
+}
+
+func TestShutdownWaitsForTransfers(t *testing.T) {
+	s, addr := startServer(t, Config{Logger: testLogger()})
+	alice, bob := startTransfer(t, addr, 8)
+	sendChunk(t, alice, []byte("half"))
+
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(context.Background()) }()
+	bob.mustWaitForContent(t, "Server is shutting down")
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v with a transfer in progress", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	sendChunk(t, alice, []byte("done"))
+	if _, err := bob.waitFor("file-complete", func(m Message) bool { return m.Type == "file-complete" }); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Shutdown returned %v, want nil", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Shutdown did not return after the transfer finished")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	s, addr := startServer(t, Config{Logger: testLogger()})
+	startTransfer(t, addr, 8)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if waited := time.Since(start); waited < 200*time.Millisecond {
+		t.Fatalf("Shutdown returned after %v, before the deadline", waited)
+	}
+	// Past the deadline the connections close without flushing, so the
+	// notice may not reach bob
+	if n := s.countTransfers("accepted"); n != 0 {
+		t.Fatalf("%d transfers left accepted after the deadline", n)
+	}
+}
+
+func TestTransfersPerServer(t *testing.T) {
+	s, addr := startServer(t, Config{Logger: testLogger()})
+	other, _ := startServer(t, Config{Logger: testLogger()})
+	alice, bob := startTransfer(t, addr, 4)
+
+	if err := other.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.countTransfers("accepted"); n != 1 {
+		t.Fatalf("%d accepted transfers after another server shut down, want 1", n)
+	}
+	sendChunk(t, alice, []byte("data"))
+	if _, err := bob.waitFor("file-complete", func(m Message) bool { return m.Type == "file-complete" }); err != nil {
+		t.Fatal(err)
+	}
+}
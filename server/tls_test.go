@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue signs a certificate for name, a server's IP address or a client's username
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClientCertificateLogin(t *testing.T) {
+	ca := newTestCA(t)
+	users := NewMemoryUserStore()
+	users.Create(NewUser("alice", "password1", testPasswordIterations))
+	s := NewServerWithConfig(Config{Users: users, PasswordIterations: testPasswordIterations, Logger: testLogger()})
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := tls.NewListener(inner, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "127.0.0.1", x509.ExtKeyUsageServerAuth)},
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ctx, listener) }()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(testTimeout):
+			t.Error("server did not shut down")
+		}
+	})
+
+	dialCert := func(username string) *testClient {
+		t.Helper()
+		conn, err := tls.Dial("tcp", inner.Addr().String(), &tls.Config{
+			RootCAs:      ca.pool,
+			Certificates: []tls.Certificate{ca.issue(t, username, x509.ExtKeyUsageClientAuth)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return &testClient{conn: conn, reader: bufio.NewReader(conn)}
+	}
+
+	alice := dialCert("alice")
+	alice.mustWaitForContent(t, "Authenticated as alice with a client certificate")
+	if events := s.SecurityEvents(10, EventLoginSuccess); len(events) != 1 || events[0].Username != "alice" {
+		t.Fatalf("login_success events %+v, want one for alice", events)
+	}
+
+	// A certificate for a name without an account logs nobody in
+	mallory := dialCert("mallory")
+	mallory.mustWaitForContent(t, "Please log in")
+	if events := s.SecurityEvents(10, EventCertRejected); len(events) != 1 || events[0].Username != "mallory" {
+		t.Fatalf("cert_rejected events %+v, want one for mallory", events)
+	}
+	if len(s.Sessions("mallory")) != 0 {
+		t.Fatal("mallory logged in without an account")
+	}
+}
@@ -1,27 +1,176 @@
 package server
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 )
 
+const (
+	hashAlgorithm = "pbkdf2-sha256"
+	saltSize      = 16
+	keySize       = 32
+
+	minUsernameLength = 2
+	maxUsernameLength = 32
+)
+
+var ErrInvalidUsername = errors.New("invalid username")
+
+// reservedUsernames cannot be registered since they would impersonate the server.
+// Compared case-insensitively.
+var reservedUsernames = map[string]bool{
+	"server":   true,
+	"system":   true,
+	"everyone": true,
+}
+
+// DefaultPasswordIterations is the PBKDF2 cost used for new password hashes
+// unless Config.PasswordIterations sets another
+const DefaultPasswordIterations = 600000
+
+// MinPasswordIterations is the lowest PBKDF2 cost that keeps stored hashes
+// expensive to crack
+const MinPasswordIterations = 10000
+
 type User struct {
 	Username     string
-	PasswordHash string
+	PasswordHash string    // algorithm$iterations$salt$hash, or legacy unsalted SHA-256 hex
+	LastSeen     time.Time // When the user last disconnected, zero if never
 }
 
-func NewUser(username, password string) *User {
+// NewUser creates a user whose password is hashed with the given PBKDF2 cost
+func NewUser(username, password string, iterations int) *User {
 	return &User{
 		Username:     username,
-		PasswordHash: hashPassword(password),
+		PasswordHash: hashPassword(password, iterations),
 	}
 }
 
-func hashPassword(password string) string {
+// ValidateUsername checks the length, character set and reserved names rules
+func ValidateUsername(username string) error {
+	if len(username) < minUsernameLength || len(username) > maxUsernameLength {
+		return fmt.Errorf("%w: must be between %d and %d characters",
+			ErrInvalidUsername, minUsernameLength, maxUsernameLength)
+	}
+
+	for _, r := range username {
+		isLetter := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+		isDigit := r >= '0' && r <= '9'
+		if !isLetter && !isDigit && r != '_' && r != '-' && r != '.' {
+			return fmt.Errorf("%w: only letters, digits, '_', '-' and '.' are allowed", ErrInvalidUsername)
+		}
+	}
+
+	if reservedUsernames[strings.ToLower(username)] {
+		return fmt.Errorf("%w: %s is reserved", ErrInvalidUsername, username)
+	}
+
+	return nil
+}
+
+// hashPassword derives a salted PBKDF2 hash in the self-describing
+// "pbkdf2-sha256$iterations$salt$hash" format
+func hashPassword(password string, iterations int) string {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		panic("unable to generate password salt: " + err.Error())
+	}
+
+	key := pbkdf2Key([]byte(password), salt, iterations, keySize)
+	return fmt.Sprintf("%s$%d$%s$%s", hashAlgorithm, iterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+}
+
+// legacyHashPassword is the unsalted SHA-256 scheme used by older versions
+func legacyHashPassword(password string) string {
 	hash := sha256.Sum256([]byte(password))
 	return hex.EncodeToString(hash[:])
 }
 
+// parseHash splits a PBKDF2 hash into its parts
+func parseHash(encoded string) (iterations int, salt, key []byte, ok bool) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != hashAlgorithm {
+		return 0, nil, nil, false
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return 0, nil, nil, false
+	}
+	salt, err = base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return 0, nil, nil, false
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return 0, nil, nil, false
+	}
+	return iterations, salt, key, true
+}
+
 func (u *User) CheckPassword(password string) bool {
-	return u.PasswordHash == hashPassword(password)
+	return checkPassword(u.PasswordHash, password)
+}
+
+// checkPassword compares password with a hash made by hashPassword or legacyHashPassword
+func checkPassword(encoded, password string) bool {
+	if iterations, salt, key, ok := parseHash(encoded); ok {
+		derived := pbkdf2Key([]byte(password), salt, iterations, len(key))
+		return subtle.ConstantTimeCompare(derived, key) == 1
+	}
+
+	// Fall back to the legacy unsalted format
+	return subtle.ConstantTimeCompare([]byte(encoded), []byte(legacyHashPassword(password))) == 1
+}
+
+// NeedsRehash reports whether the stored hash uses a legacy format or a
+// lower cost than iterations
+func (u *User) NeedsRehash(iterations int) bool {
+	cost, _, _, ok := parseHash(u.PasswordHash)
+	return !ok || cost < iterations
+}
+
+// pbkdf2Key implements PBKDF2 (RFC 8018) with HMAC-SHA256
+func pbkdf2Key(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	var blockIndex [4]byte
+	derived := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(blockIndex[:], uint32(block))
+		prf.Write(blockIndex[:])
+		derived = prf.Sum(derived)
+
+		t := derived[len(derived)-hashLen:]
+		copy(u, t)
+
+		for n := 2; n <= iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+
+	return derived[:keyLen]
 }
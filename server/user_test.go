@@ -0,0 +1,224 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLogger discards the server log so test output stays readable
+func testLogger() *log.Logger {
+	return log.New(io.Discard, "", 0)
+}
+
+// testPasswordIterations keeps hashing cheap, the tests register a lot of users
+const testPasswordIterations = 1000
+
+// Published PBKDF2-HMAC-SHA256 test vectors: the SHA-256 counterparts of the
+// RFC 6070 vectors, and the two from RFC 7914 section 11
+func TestPBKDF2KnownAnswers(t *testing.T) {
+	vectors := []struct {
+		password, salt string
+		iterations     int
+		key            string
+	}{
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096,
+			"348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+		{"pass\x00word", "sa\x00lt", 4096, "89b69d0516f829893c696226650a8687"},
+		{"passwd", "salt", 1,
+			"55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+				"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000,
+			"4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56" +
+				"a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+
+	for _, v := range vectors {
+		want, err := hex.DecodeString(v.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := pbkdf2Key([]byte(v.password), []byte(v.salt), v.iterations, len(want))
+		if hex.EncodeToString(got) != v.key {
+			t.Errorf("pbkdf2Key(%q, %q, %d, %d) = %x, want %s", v.password, v.salt, v.iterations, len(want), got, v.key)
+		}
+	}
+}
+
+func TestHashPasswordFormat(t *testing.T) {
+	hash := hashPassword("secret", testPasswordIterations)
+	iterations, salt, key, ok := parseHash(hash)
+	if !ok {
+		t.Fatalf("hash %q does not parse", hash)
+	}
+	if iterations != 1000 || len(salt) != saltSize || len(key) != keySize {
+		t.Fatalf("hash %q has %d iterations, %d byte salt and %d byte key", hash, iterations, len(salt), len(key))
+	}
+	if !checkPassword(hash, "secret") || checkPassword(hash, "Secret") {
+		t.Fatal("hash does not check the password it was made from")
+	}
+	// Salted: the same password hashes differently each time
+	if hashPassword("secret", testPasswordIterations) == hash {
+		t.Fatal("two hashes of the same password are equal")
+	}
+
+	for _, bad := range []string{
+		"pbkdf2-sha256$0$c2FsdA$a2V5",
+		"pbkdf2-sha256$-1$c2FsdA$a2V5",
+		"pbkdf2-sha256$1000$c2FsdA$",
+		"pbkdf2-sha512$1000$c2FsdA$a2V5",
+	} {
+		if _, _, _, ok := parseHash(bad); ok {
+			t.Errorf("parseHash accepted %q", bad)
+		}
+	}
+}
+
+func TestPasswordHashUpgrade(t *testing.T) {
+	users := NewMemoryUserStore()
+	users.Create(&User{Username: "legacy", PasswordHash: legacyHashPassword("old secret")})
+	users.Create(&User{Username: "cheap", PasswordHash: hashPassword("cheap secret", testPasswordIterations)})
+	// The server uses a higher cost, the cheap hash is below it. No backoff,
+	// the test fails a login on purpose.
+	server := NewServerWithConfig(Config{Users: users, PasswordIterations: 2000, LoginBackoff: -1, Logger: testLogger()})
+
+	for _, c := range []struct{ username, password string }{
+		{"legacy", "old secret"},
+		{"cheap", "cheap secret"},
+	} {
+		before, _ := users.Get(c.username)
+		if !before.NeedsRehash(2000) {
+			t.Fatalf("%s: hash %q does not need a rehash", c.username, before.PasswordHash)
+		}
+
+		// A wrong password must not rewrite the hash
+		if err := server.AuthenticateUser(c.username, "wrong", "127.0.0.1"); err != ErrInvalidCredentials {
+			t.Fatalf("%s: wrong password gave %v", c.username, err)
+		}
+		if after, _ := users.Get(c.username); after.PasswordHash != before.PasswordHash {
+			t.Fatalf("%s: failed login changed the hash", c.username)
+		}
+
+		if err := server.AuthenticateUser(c.username, c.password, "127.0.0.1"); err != nil {
+			t.Fatalf("%s: login failed: %v", c.username, err)
+		}
+		after, _ := users.Get(c.username)
+		iterations, _, _, ok := parseHash(after.PasswordHash)
+		if !ok || iterations != 2000 {
+			t.Fatalf("%s: hash after login is %q, want PBKDF2 with 2000 iterations", c.username, after.PasswordHash)
+		}
+		if after.NeedsRehash(2000) {
+			t.Fatalf("%s: upgraded hash still needs a rehash", c.username)
+		}
+
+		// The upgraded hash keeps working
+		if err := server.AuthenticateUser(c.username, c.password, "127.0.0.1"); err != nil {
+			t.Fatalf("%s: login with the upgraded hash failed: %v", c.username, err)
+		}
+	}
+}
+
+func TestCredentialsNotLogged(t *testing.T) {
+	var logs syncBuffer
+	s, addr := startServer(t, Config{InviteOnly: true, Logger: log.New(&logs, "", 0)})
+	code, err := s.GenerateInvite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := dialClient(t, addr)
+	alice.mustSend(t, "/register alice hunter2 "+code)
+	alice.mustWaitForContent(t, "Registered and logged in")
+	again := dialClient(t, addr)
+	again.mustSend(t, "/login alice hunter2")
+	again.mustWaitForContent(t, "Login successful!")
+
+	for _, secret := range []string{"hunter2", code} {
+		if strings.Contains(logs.String(), secret) {
+			t.Fatalf("%q in the log:\n%s", secret, logs.String())
+		}
+	}
+}
+
+func TestValidateUsername(t *testing.T) {
+	for _, c := range []struct {
+		username string
+		valid    bool
+	}{
+		{"alice", true},
+		{"Bob_the-2nd.", true},
+		{"ab", true},
+		{strings.Repeat("a", 32), true},
+		{"a", false},
+		{strings.Repeat("a", 33), false},
+		{"", false},
+		{"with space", false},
+		{"émile", false},
+		{"alice!", false},
+		{"server", false},
+		{"SYSTEM", false},
+		{"Everyone", false},
+		{"servers", true},
+	} {
+		err := ValidateUsername(c.username)
+		if c.valid && err != nil {
+			t.Errorf("ValidateUsername(%q) = %v, want nil", c.username, err)
+		}
+		if !c.valid && !errors.Is(err, ErrInvalidUsername) {
+			t.Errorf("ValidateUsername(%q) = %v, want ErrInvalidUsername", c.username, err)
+		}
+	}
+}
+
+func TestRegisterInviteCodes(t *testing.T) {
+	s := NewServerWithConfig(Config{InviteOnly: true, PasswordIterations: testPasswordIterations, Logger: testLogger()})
+	code, err := s.GenerateInvite()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.RegisterUser("alice", "password1", ""); err != ErrRegistrationClosed {
+		t.Fatalf("registering without a code gave %v, want ErrRegistrationClosed", err)
+	}
+	if err := s.RegisterUser("alice", "password1", "0123456789abcdef"); err != ErrInvalidInvite {
+		t.Fatalf("registering with an unknown code gave %v, want ErrInvalidInvite", err)
+	}
+	// An invalid username does not use up the code
+	if err := s.RegisterUser("server", "password1", code); !errors.Is(err, ErrInvalidUsername) {
+		t.Fatalf("registering a reserved name gave %v, want ErrInvalidUsername", err)
+	}
+	if err := s.RegisterUser("alice", "password1", code); err != nil {
+		t.Fatalf("registering with a valid code: %v", err)
+	}
+	if err := s.RegisterUser("bob", "password1", code); err != ErrInvalidInvite {
+		t.Fatalf("reusing a code gave %v, want ErrInvalidInvite", err)
+	}
+
+	// Nor does a taken username
+	code, err = s.GenerateInvite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterUser("alice", "password1", code); err != ErrUserExists {
+		t.Fatalf("registering a taken name gave %v, want ErrUserExists", err)
+	}
+	if err := s.RegisterUser("bob", "password1", code); err != nil {
+		t.Fatalf("code unusable after a failed registration: %v", err)
+	}
+
+	// Codes expire
+	code, err = s.GenerateInvite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.invites.codes[code] = time.Now().Add(-time.Second)
+	if err := s.RegisterUser("carol", "password1", code); err != ErrInvalidInvite {
+		t.Fatalf("registering with an expired code gave %v, want ErrInvalidInvite", err)
+	}
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUserExists   = errors.New("user already exists")
+	ErrUserNotFound = errors.New("user not found")
+)
+
+// UserStore is the storage backend for user accounts
+type UserStore interface {
+	Get(username string) (*User, error)
+	Create(user *User) error
+	UpdatePassword(username, passwordHash string) error
+	UpdateLastSeen(username string, lastSeen time.Time) error
+	Delete(username string) error
+	List() ([]*User, error)
+}
+
+// MemoryUserStore keeps accounts in memory only. Everything is lost on restart.
+type MemoryUserStore struct {
+	users map[string]*User
+	mutex sync.Mutex
+}
+
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{
+		users: make(map[string]*User),
+	}
+}
+
+func (m *MemoryUserStore) Get(username string) (*User, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	user, exists := m.users[username]
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (m *MemoryUserStore) Create(user *User) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, exists := m.users[user.Username]; exists {
+		return ErrUserExists
+	}
+	copied := *user
+	m.users[user.Username] = &copied
+	return nil
+}
+
+func (m *MemoryUserStore) UpdatePassword(username, passwordHash string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	user, exists := m.users[username]
+	if !exists {
+		return ErrUserNotFound
+	}
+	user.PasswordHash = passwordHash
+	return nil
+}
+
+func (m *MemoryUserStore) UpdateLastSeen(username string, lastSeen time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	user, exists := m.users[username]
+	if !exists {
+		return ErrUserNotFound
+	}
+	user.LastSeen = lastSeen
+	return nil
+}
+
+func (m *MemoryUserStore) Delete(username string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, exists := m.users[username]; !exists {
+		return ErrUserNotFound
+	}
+	delete(m.users, username)
+	return nil
+}
+
+func (m *MemoryUserStore) List() ([]*User, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	users := make([]*User, 0, len(m.users))
+	for _, user := range m.users {
+		copied := *user
+		users = append(users, &copied)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+// FileUserStore keeps accounts in memory and writes the whole set to a JSON
+// file after every change. The file is replaced atomically via rename so a
+// crash mid-write never leaves a truncated database behind.
+type FileUserStore struct {
+	path  string
+	mem   *MemoryUserStore
+	mutex sync.Mutex
+}
+
+// NewFileUserStore opens the database at path, creating it if it does not exist
+func NewFileUserStore(path string) (*FileUserStore, error) {
+	store := &FileUserStore{
+		path: path,
+		mem:  NewMemoryUserStore(),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if len(data) > 0 {
+		var users []*User
+		if err := json.Unmarshal(data, &users); err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			store.mem.users[user.Username] = user
+		}
+	}
+
+	return store, nil
+}
+
+func (f *FileUserStore) Get(username string) (*User, error) {
+	return f.mem.Get(username)
+}
+
+func (f *FileUserStore) Create(user *User) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.mem.Create(user); err != nil {
+		return err
+	}
+	if err := f.save(); err != nil {
+		f.mem.Delete(user.Username)
+		return err
+	}
+	return nil
+}
+
+func (f *FileUserStore) UpdatePassword(username, passwordHash string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	old, err := f.mem.Get(username)
+	if err != nil {
+		return err
+	}
+	f.mem.UpdatePassword(username, passwordHash)
+	if err := f.save(); err != nil {
+		f.mem.UpdatePassword(username, old.PasswordHash)
+		return err
+	}
+	return nil
+}
+
+func (f *FileUserStore) UpdateLastSeen(username string, lastSeen time.Time) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	old, err := f.mem.Get(username)
+	if err != nil {
+		return err
+	}
+	f.mem.UpdateLastSeen(username, lastSeen)
+	if err := f.save(); err != nil {
+		f.mem.UpdateLastSeen(username, old.LastSeen)
+		return err
+	}
+	return nil
+}
+
+func (f *FileUserStore) Delete(username string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	old, err := f.mem.Get(username)
+	if err != nil {
+		return err
+	}
+	f.mem.Delete(username)
+	if err := f.save(); err != nil {
+		f.mem.Create(old)
+		return err
+	}
+	return nil
+}
+
+func (f *FileUserStore) List() ([]*User, error) {
+	return f.mem.List()
+}
+
+// save writes all users to a temporary file and renames it over the database
+func (f *FileUserStore) save() error {
+	users, _ := f.mem.List()
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// storeFactory opens a store for a test. reopen returns a store reading the
+// same data, as after a restart.
+type storeFactory struct {
+	open   func(t *testing.T) UserStore
+	reopen func(t *testing.T, store UserStore) UserStore
+}
+
+func userStoreFactories() map[string]storeFactory {
+	return map[string]storeFactory{
+		"memory": {
+			open: func(t *testing.T) UserStore { return NewMemoryUserStore() },
+			// Nothing outlives the process, the same store stands in for a restart
+			reopen: func(t *testing.T, store UserStore) UserStore { return store },
+		},
+		"file": {
+			open: func(t *testing.T) UserStore {
+				store, err := NewFileUserStore(filepath.Join(t.TempDir(), "users.json"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return store
+			},
+			reopen: func(t *testing.T, store UserStore) UserStore {
+				reopened, err := NewFileUserStore(store.(*FileUserStore).path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return reopened
+			},
+		},
+	}
+}
+
+func TestUserStoreConformance(t *testing.T) {
+	for name, factory := range userStoreFactories() {
+		factory := factory
+		t.Run(name, func(t *testing.T) {
+			t.Run("CreateGet", func(t *testing.T) { testCreateGet(t, factory) })
+			t.Run("UpdatePassword", func(t *testing.T) { testUpdatePassword(t, factory) })
+			t.Run("UpdateLastSeen", func(t *testing.T) { testUpdateLastSeen(t, factory) })
+			t.Run("Delete", func(t *testing.T) { testDelete(t, factory) })
+			t.Run("List", func(t *testing.T) { testList(t, factory) })
+			t.Run("Copies", func(t *testing.T) { testCopies(t, factory) })
+		})
+	}
+}
+
+func testCreateGet(t *testing.T, factory storeFactory) {
+	store := factory.open(t)
+	if _, err := store.Get("alice"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Get of a missing user: got %v, want ErrUserNotFound", err)
+	}
+	if err := store.Create(&User{Username: "alice", PasswordHash: "h1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Create(&User{Username: "alice", PasswordHash: "h2"}); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("second Create: got %v, want ErrUserExists", err)
+	}
+
+	user, err := factory.reopen(t, store).Get("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "alice" || user.PasswordHash != "h1" {
+		t.Fatalf("got %+v, want alice with the first hash", user)
+	}
+}
+
+func testUpdatePassword(t *testing.T, factory storeFactory) {
+	store := factory.open(t)
+	if err := store.UpdatePassword("alice", "h"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("UpdatePassword of a missing user: got %v, want ErrUserNotFound", err)
+	}
+	if err := store.Create(&User{Username: "alice", PasswordHash: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdatePassword("alice", "new"); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := factory.reopen(t, store).Get("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.PasswordHash != "new" {
+		t.Fatalf("hash is %q, want new", user.PasswordHash)
+	}
+}
+
+func testUpdateLastSeen(t *testing.T, factory storeFactory) {
+	store := factory.open(t)
+	when := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	if err := store.UpdateLastSeen("alice", when); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("UpdateLastSeen of a missing user: got %v, want ErrUserNotFound", err)
+	}
+	if err := store.Create(&User{Username: "alice", PasswordHash: "h"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateLastSeen("alice", when); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := factory.reopen(t, store).Get("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.LastSeen.Equal(when) {
+		t.Fatalf("last seen is %v, want %v", user.LastSeen, when)
+	}
+	if user.PasswordHash != "h" {
+		t.Fatalf("UpdateLastSeen changed the hash to %q", user.PasswordHash)
+	}
+}
+
+func testDelete(t *testing.T, factory storeFactory) {
+	store := factory.open(t)
+	if err := store.Delete("alice"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Delete of a missing user: got %v, want ErrUserNotFound", err)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		if err := store.Create(&User{Username: name, PasswordHash: "h"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Delete("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := factory.reopen(t, store)
+	if _, err := reopened.Get("alice"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Get after Delete: got %v, want ErrUserNotFound", err)
+	}
+	if _, err := reopened.Get("bob"); err != nil {
+		t.Fatalf("Delete removed another user: %v", err)
+	}
+	// The name is free again
+	if err := reopened.Create(&User{Username: "alice", PasswordHash: "h"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testList(t *testing.T, factory storeFactory) {
+	store := factory.open(t)
+	users, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 {
+		t.Fatalf("new store lists %d users", len(users))
+	}
+	for _, name := range []string{"carol", "alice", "bob"} {
+		if err := store.Create(&User{Username: name, PasswordHash: "h"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	users, err = factory.reopen(t, store).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, user := range users {
+		names = append(names, user.Username)
+	}
+	if len(names) != 3 || names[0] != "alice" || names[1] != "bob" || names[2] != "carol" {
+		t.Fatalf("List returned %v, want [alice bob carol]", names)
+	}
+}
+
+func testCopies(t *testing.T, factory storeFactory) {
+	store := factory.open(t)
+	user := &User{Username: "alice", PasswordHash: "h"}
+	if err := store.Create(user); err != nil {
+		t.Fatal(err)
+	}
+	// Neither the created nor the returned user is shared with the store
+	user.PasswordHash = "changed"
+	got, err := store.Get("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.PasswordHash = "changed too"
+
+	got, err = store.Get("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.PasswordHash != "h" {
+		t.Fatalf("store hash is %q, want h", got.PasswordHash)
+	}
+}
+
+func TestFileUserStoreAtomicRewrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users.json")
+	store, err := NewFileUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		if err := store.Create(&User{Username: name, PasswordHash: "h"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.UpdatePassword("alice", "h2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The database is complete JSON and no temporary file is left behind
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var users []*User
+	if err := json.Unmarshal(data, &users); err != nil {
+		t.Fatalf("database is not valid JSON: %v", err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("database has %d users, want 2", len(users))
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("directory has %d files after rewrites, want only the database", len(entries))
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("database mode is %v, want 0600", info.Mode().Perm())
+	}
+
+	// Make the rename fail: a change that cannot be saved is rolled back
+	if err := os.Rename(path, path+".bak"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(path, "blocker"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Create(&User{Username: "carol", PasswordHash: "h"}); err == nil {
+		t.Fatal("Create succeeded although the database could not be written")
+	}
+	if _, err := store.Get("carol"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("failed Create left the user behind: %v", err)
+	}
+	if err := store.UpdatePassword("alice", "h3"); err == nil {
+		t.Fatal("UpdatePassword succeeded although the database could not be written")
+	}
+	if user, _ := store.Get("alice"); user.PasswordHash != "h2" {
+		t.Fatalf("failed UpdatePassword left hash %q, want h2", user.PasswordHash)
+	}
+	if err := store.Delete("bob"); err == nil {
+		t.Fatal("Delete succeeded although the database could not be written")
+	}
+	if _, err := store.Get("bob"); err != nil {
+		t.Fatalf("failed Delete removed the user: %v", err)
+	}
+
+	entries, err = os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "users.json" && entry.Name() != "users.json.bak" {
+			t.Fatalf("failed writes left %s behind", entry.Name())
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal RFC 6455 WebSocket support so browsers can join the same server as
+// TCP clients. A WebSocket connection is wrapped in wsConn, a net.Conn, and
+// handed to the regular Client code: every incoming text message becomes one
+// line, and every Write of the client becomes one outgoing message. Binary
+// file frames travel as binary WebSocket messages.
+
+const (
+	websocketGUID       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	maxWebSocketMessage = maxBinaryFrameData + 64*1024
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	// Control frames are at least this opcode and carry at most maxControlPayload bytes
+	wsOpControl       = 0x8
+	maxControlPayload = 125
+
+	wsCloseNormal        = 1000
+	wsCloseProtocolError = 1002
+)
+
+var errWebSocketProtocol = errors.New("websocket protocol error")
+
+// SetWebSocket enables the WebSocket gateway on port, served at /ws.
+// It must be called before Run.
+func (s *Server) SetWebSocket(port int) {
+	s.wsAddr = fmt.Sprintf(":%d", port)
+}
+
+// WebSocketHandler upgrades HTTP requests to WebSocket chat connections. It
+// can be mounted on any mux; Run serves it at /ws when SetWebSocket is used.
+func (s *Server) WebSocketHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgradeWebSocket(w, r)
+		if err != nil {
+			s.logger.Printf("WebSocket upgrade from %s failed: %v", r.RemoteAddr, err)
+			return
+		}
+
+		s.logger.Printf("New WebSocket connection from %s", conn.RemoteAddr().String())
+		if !s.admit(conn) {
+			return
+		}
+
+		client := NewClient(conn, s)
+		go client.Handle()
+	})
+}
+
+// upgradeWebSocket performs the opening handshake and takes over the connection
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "WebSocket upgrade required", http.StatusBadRequest)
+		return nil, errors.New("not a websocket upgrade request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("missing websocket key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("response writer cannot be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// Clear any deadlines set by the HTTP server
+	conn.SetDeadline(time.Time{})
+
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{Conn: conn, reader: rw.Reader}, nil
+}
+
+// headerContains reports whether a comma separated header contains token
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn adapts a WebSocket connection to the line based stream expected by Client
+type wsConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	pending    []byte // Unread part of the current message
+	writeMutex sync.Mutex
+	closeOnce  sync.Once
+}
+
+// Read returns the payload of incoming messages. Text messages are
+// terminated with a newline so they look like lines to the reader.
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		opcode, payload, err := c.readMessage()
+		if errors.Is(err, errWebSocketProtocol) {
+			c.closeWith(wsCloseProtocolError)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if opcode == wsOpText && (len(payload) == 0 || payload[len(payload)-1] != '\n') {
+			payload = append(payload, '\n')
+		}
+		c.pending = payload
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readMessage reads a complete (possibly fragmented) data message, answering
+// control frames along the way
+func (c *wsConn) readMessage() (byte, []byte, error) {
+	var opcode byte
+	var message []byte
+
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		if op >= wsOpControl && (!fin || len(payload) > maxControlPayload) {
+			return 0, nil, fmt.Errorf("%w: fragmented or oversized control frame", errWebSocketProtocol)
+		}
+
+		switch op {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			c.closeWith(wsCloseNormal)
+			return 0, nil, io.EOF
+		case wsOpText, wsOpBinary:
+			if message != nil {
+				return 0, nil, errWebSocketProtocol
+			}
+			opcode = op
+			message = payload
+		case wsOpContinuation:
+			if message == nil {
+				return 0, nil, errWebSocketProtocol
+			}
+			message = append(message, payload...)
+		default:
+			return 0, nil, errWebSocketProtocol
+		}
+
+		if len(message) > maxWebSocketMessage {
+			return 0, nil, fmt.Errorf("%w: message too large", errWebSocketProtocol)
+		}
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+// readFrame reads and unmasks a single frame
+func (c *wsConn) readFrame() (bool, byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	// Clients must mask every frame
+	if !masked {
+		return false, 0, nil, fmt.Errorf("%w: unmasked client frame", errWebSocketProtocol)
+	}
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if length > maxWebSocketMessage {
+		return false, 0, nil, fmt.Errorf("%w: frame too large", errWebSocketProtocol)
+	}
+
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(c.reader, mask); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// writeFrame sends a single unmasked frame
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	header := make([]byte, 0, 10)
+	header = append(header, 0x80|opcode)
+
+	switch {
+	case len(payload) < 126:
+		header = append(header, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	_, err := c.Conn.Write(append(header, payload...))
+	return err
+}
+
+// Write sends p as one message: binary file frames as binary messages and
+// everything else as text without the trailing newline
+func (c *wsConn) Write(p []byte) (int, error) {
+	opcode := byte(wsOpText)
+	payload := p
+	if len(p) > 0 && p[0] == binaryFrameMagic {
+		opcode = wsOpBinary
+	} else {
+		payload = []byte(strings.TrimSuffix(string(p), "\n"))
+	}
+
+	if err := c.writeFrame(opcode, payload); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends a close frame before closing the underlying connection
+func (c *wsConn) Close() error {
+	return c.closeWith(wsCloseNormal)
+}
+
+// closeWith is Close with the status code to send, only the first call
+// having any effect
+func (c *wsConn) closeWith(code uint16) error {
+	var err error
+	c.closeOnce.Do(func() {
+		payload := binary.BigEndian.AppendUint16(nil, code)
+		c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeFrame(wsOpClose, payload)
+		err = c.Conn.Close()
+	})
+	return err
+}
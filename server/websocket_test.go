@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsTestClient speaks just enough WebSocket to test the gateway
+type wsTestClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialWebSocket serves s over WebSocket and opens a connection to it
+func dialWebSocket(t *testing.T, s *Server) *wsTestClient {
+	t.Helper()
+	ts := httptest.NewServer(s.WebSocketHandler())
+	t.Cleanup(ts.Close)
+
+	conn, err := net.DialTimeout("tcp", ts.Listener.Addr().String(), testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(testTimeout))
+
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	request := "GET /ws HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: " + key + "\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	if response.StatusCode != http.StatusSwitchingProtocols ||
+		response.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(hash[:]) {
+		t.Fatalf("handshake answered %s with accept %q", response.Status, response.Header.Get("Sec-WebSocket-Accept"))
+	}
+	return &wsTestClient{conn: conn, reader: reader}
+}
+
+// writeFrame sends a masked frame, as clients must
+func (c *wsTestClient) writeFrame(t *testing.T, fin bool, opcode byte, payload []byte) {
+	t.Helper()
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	default:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readFrame reads an unmasked frame from the server
+func (c *wsTestClient) readFrame() (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return 0, nil, err
+	}
+	length := int(header[1] & 0x7F)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return 0, nil, err
+		}
+		length = int(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return 0, nil, err
+		}
+		length = int(binary.BigEndian.Uint64(ext))
+	}
+	payload := make([]byte, length)
+	_, err := io.ReadFull(c.reader, payload)
+	return header[0] & 0x0F, payload, err
+}
+
+// waitForFrame reads frames until one of opcode whose payload contains substr
+func (c *wsTestClient) waitForFrame(t *testing.T, opcode byte, substr string) []byte {
+	t.Helper()
+	for {
+		op, payload, err := c.readFrame()
+		if err != nil {
+			t.Fatalf("waiting for %q: %v", substr, err)
+		}
+		if op == opcode && strings.Contains(string(payload), substr) {
+			return payload
+		}
+	}
+}
+
+func TestWebSocketHandshakeRefused(t *testing.T) {
+	s, _ := startServer(t, Config{Logger: testLogger()})
+	ts := httptest.NewServer(s.WebSocketHandler())
+	defer ts.Close()
+
+	for _, c := range []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"plain request", nil, http.StatusBadRequest},
+		{"old version", map[string]string{"Sec-WebSocket-Version": "8", "Sec-WebSocket-Key": "a2V5"}, http.StatusUpgradeRequired},
+		{"no key", map[string]string{"Sec-WebSocket-Version": "13"}, http.StatusBadRequest},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			request, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.headers != nil {
+				request.Header.Set("Connection", "Upgrade")
+				request.Header.Set("Upgrade", "websocket")
+			}
+			for name, value := range c.headers {
+				request.Header.Set(name, value)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			if response.StatusCode != c.want {
+				t.Fatalf("answered %s, want %d", response.Status, c.want)
+			}
+		})
+	}
+}
+
+func TestWebSocketChat(t *testing.T) {
+	s, _ := startServer(t, Config{Logger: testLogger()})
+	c := dialWebSocket(t, s)
+
+	c.writeFrame(t, true, wsOpText, []byte("/register alice password1"))
+	c.waitForFrame(t, wsOpText, "Registered and logged in")
+
+	// A fragmented message is one line, with a ping in between
+	c.writeFrame(t, false, wsOpText, []byte("/ro"))
+	c.writeFrame(t, true, wsOpPing, []byte("still there?"))
+	c.writeFrame(t, true, wsOpContinuation, []byte("oms"))
+	c.waitForFrame(t, wsOpPong, "still there?")
+	c.waitForFrame(t, wsOpText, "Available rooms")
+
+	// The server answers a close once and hangs up
+	c.writeFrame(t, true, wsOpClose, binary.BigEndian.AppendUint16(nil, wsCloseNormal))
+	payload := c.waitForFrame(t, wsOpClose, "")
+	if len(payload) < 2 || binary.BigEndian.Uint16(payload) != wsCloseNormal {
+		t.Fatalf("closed with %v, want code %d", payload, wsCloseNormal)
+	}
+	if op, _, err := c.readFrame(); !errors.Is(err, io.EOF) {
+		t.Fatalf("after the close got opcode %d and %v, want EOF", op, err)
+	}
+}
+
+func TestWebSocketBadControlFrames(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		fin     bool
+		payload []byte
+	}{
+		{"fragmented", false, []byte("ping")},
+		{"oversized", true, make([]byte, maxControlPayload+1)},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s, _ := startServer(t, Config{Logger: testLogger()})
+			ws := dialWebSocket(t, s)
+			ws.writeFrame(t, c.fin, wsOpPing, c.payload)
+
+			payload := ws.waitForFrame(t, wsOpClose, "")
+			if len(payload) < 2 || binary.BigEndian.Uint16(payload) != wsCloseProtocolError {
+				t.Fatalf("closed with %v, want code %d", payload, wsCloseProtocolError)
+			}
+		})
+	}
+}